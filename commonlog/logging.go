@@ -44,6 +44,13 @@ func createFileBackend(fullFileName string, level logging.Level) logging.Leveled
 	return fileBackendLeveled
 }
 
+// NewConsoleLogger 只输出到控制台的日志, 不创建日志文件
+func NewConsoleLogger(module string, level logging.Level) *logging.Logger {
+	logger := logging.MustGetLogger(module)
+	logger.SetBackend(createConsoleBackend(level))
+	return logger
+}
+
 func NewLogger(module string, logDir string, level logging.Level) *logging.Logger {
 	logger := logging.MustGetLogger(module)
 	backends := make([]logging.Backend, 0)
@@ -59,3 +66,8 @@ func NewLogger(module string, logDir string, level logging.Level) *logging.Logge
 	logger.SetBackend(logging.MultiLogger(backends...))
 	return logger
 }
+
+// ParseLevel 解析日志级别名, 如 DEBUG, INFO
+func ParseLevel(name string) (logging.Level, error) {
+	return logging.LogLevel(name)
+}
@@ -1,13 +1,47 @@
 package main
 
 import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/yangzhao28/phantom/commonlog"
 	"github.com/yangzhao28/phantom/motherbase"
 )
 
 var logger = commonlog.NewLogger("main", "log", commonlog.DEBUG)
 
+// handleSignals SIGHUP重新加载配置, SIGINT/SIGTERM优雅退出
+func handleSignals(server *motherbase.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := server.Reload(); err != nil {
+				logger.Warning("fail to reload configure, keep the current one: " + err.Error())
+			}
+			continue
+		}
+		logger.Notice("receive signal " + sig.String() + ", shutting down")
+		server.Shutdown()
+		return
+	}
+}
+
 func main() {
+	configure, err := motherbase.LoadConfigure(os.Args[1:])
+	if err != nil {
+		log.Fatal("invalid configure: ", err)
+	}
+	server, err := motherbase.NewServer(configure)
+	if err != nil {
+		log.Fatal("fail to create server: ", err)
+	}
+	go handleSignals(server)
 	logger.Notice("service start")
-	motherbase.CreateServer()
+	if err := server.Run(); err != nil {
+		log.Fatal("server down: ", err)
+	}
 }
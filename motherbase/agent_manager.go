@@ -1,12 +1,15 @@
 package motherbase
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/yangzhao28/phantom/commonlog"
+	"github.com/op/go-logging"
 )
 
 // 收取请求(http)        √
@@ -17,13 +20,17 @@ import (
 //   - 探活              X
 //   - diff              X
 
-var managerLogger = commonlog.NewLogger("AgentManager", "log", commonlog.DEBUG)
+const (
+	DefaultDetectorInterval = 10 * time.Second
+	DefaultDifferInterval   = 15 * time.Second
+)
 
 type AgentManager struct {
 	enableAgents map[string]Configurable
 	enableMutex  sync.RWMutex
 
 	availableAgents map[string]Configurable
+	agentLabels     map[string]map[string]string
 	availableMutex  sync.RWMutex
 
 	agentEnableChannel  chan *AgentEvent
@@ -32,25 +39,67 @@ type AgentManager struct {
 	agentRemoveChannel  chan *AgentEvent
 
 	agentRunDetector    chan int
-	agentRunDiffer      chan int
+	agentRunDiffer      chan *diffScope
+	reconcileChannel    chan *diffScope
+	reconcileOverflow   int32
 	detectorRoundSecond time.Duration
 	differRoundSecond   time.Duration
-
-	cache *PersistCache
-
-	syncer sync.WaitGroup
-	quit   chan bool
+	reconcileDebounce   time.Duration
+	intervalMutex       sync.Mutex
+
+	cache     *PersistCache
+	status    *agentStatusBook
+	rollout   *rolloutTracker
+	heartbeat *heartbeatTracker
+	discovery *discovery
+	health    *healthTracker
+	pushes    *pushQueue
+	pool      *workerPool
+
+	pushWorkers    int
+	agentPushLimit int
+	diffLimit      int
+	lastRound      RoundResult
+	roundMutex     sync.Mutex
+
+	logger        *logging.Logger
+	bridgeTLS     *tls.Config
+	bridgeTimeout time.Duration
+	bridgeMutex   sync.Mutex
+	auditLog      AuditLog
+	metrics       *Metrics
+	watch         *watchHub
+	notifier      *notifier
+
+	syncer   sync.WaitGroup
+	quit     chan bool
+	quitOnce sync.Once
 }
 
 type AgentEvent struct {
 	name         string
 	configurable *Configurable
+	labels       map[string]string
+	// added 非空时Controller回复是否新增了agent
+	added chan bool
+}
+
+// ConflictError 同名agent已存在
+type ConflictError struct {
+	name string
+}
+
+func (err *ConflictError) Error() string {
+	return "agent " + err.name + " already exists"
 }
 
+var errManagerQuit = errors.New("agent manager quit")
+
 func NewAgentManager(cache *PersistCache) *AgentManager {
 	manager := &AgentManager{
 		enableAgents:    make(map[string]Configurable),
 		availableAgents: make(map[string]Configurable),
+		agentLabels:     make(map[string]map[string]string),
 
 		agentEnableChannel:  make(chan *AgentEvent),
 		agentDisablechannel: make(chan *AgentEvent),
@@ -58,15 +107,53 @@ func NewAgentManager(cache *PersistCache) *AgentManager {
 		agentRemoveChannel:  make(chan *AgentEvent),
 
 		agentRunDetector: make(chan int),
-		agentRunDiffer:   make(chan int),
-
-		detectorRoundSecond: 10 * time.Second,
-		differRoundSecond:   15 * time.Second,
-
-		cache: cache,
+		agentRunDiffer:   make(chan *diffScope),
+		reconcileChannel: make(chan *diffScope, 1024),
+
+		detectorRoundSecond: DefaultDetectorInterval,
+		differRoundSecond:   DefaultDifferInterval,
+		reconcileDebounce:   DefaultReconcileDebounce,
+
+		cache:     cache,
+		status:    newAgentStatusBook(),
+		rollout:   newRolloutTracker(),
+		heartbeat: newHeartbeatTracker(),
+		discovery: newDiscovery(),
+		health:    newHealthTracker(),
+		pushes:    newPushQueue(),
+
+		pushWorkers:    DefaultPushWorkers,
+		agentPushLimit: DefaultAgentPushLimit,
+		diffLimit:      DefaultDiffLimit,
+
+		logger:        defaultLogger(managerModule),
+		bridgeTimeout: HttpTimeout,
+		metrics:       NewMetrics(),
+		notifier:      newNotifier(),
 
 		quit: make(chan bool),
 	}
+	if cache != nil {
+		cache.SetMetrics(manager.metrics)
+		manager.watch = newWatchHub(cache)
+		cache.Watch(func(event CacheEvent) {
+			manager.watch.publish(WatchEvent{
+				Kind:           WatchConfig,
+				Type:           event.Type,
+				Id:             event.Id,
+				Md5sum:         event.Md5sum,
+				ConfigRevision: event.Revision,
+			})
+			manager.notify(Notification{
+				Event:    EventConfigChanged,
+				Id:       event.Id,
+				Type:     event.Type,
+				Md5sum:   event.Md5sum,
+				Revision: event.Revision,
+			})
+			manager.Trigger([]string{event.Id}, nil)
+		})
+	}
 	return manager
 }
 
@@ -76,7 +163,11 @@ func (manager *AgentManager) EnableAgent(name string, instance *Configurable) {
 
 	if _, ok := manager.enableAgents[name]; !ok {
 		manager.enableAgents[name] = *instance
-		managerLogger.Debug("new enable agent " + name)
+		manager.logger.Debug("new enable agent " + name)
+		manager.publishAgent(AgentEnabled, name)
+		// 不可用期间积累的重试和dead letter作废, 由接下来的diff重新提交
+		manager.pushes.dropAgent(name)
+		manager.Trigger(nil, []string{name})
 	}
 }
 
@@ -85,17 +176,24 @@ func (manager *AgentManager) DisableAgent(name string) {
 	defer manager.enableMutex.Unlock()
 	if _, ok := manager.enableAgents[name]; ok {
 		delete(manager.enableAgents, name)
-		managerLogger.Debug("disable agent " + name)
+		manager.logger.Debug("disable agent " + name)
+		manager.publishAgent(AgentDisabled, name)
 	}
 }
 
-func (manager *AgentManager) NewAvailableAgent(name string, instance *Configurable) {
+// NewAvailableAgent 添加agent, 同名agent已存在时返回false
+func (manager *AgentManager) NewAvailableAgent(name string, instance *Configurable, labels map[string]string) bool {
 	manager.availableMutex.Lock()
 	defer manager.availableMutex.Unlock()
-	if _, ok := manager.availableAgents[name]; !ok {
-		manager.availableAgents[name] = *instance
-		managerLogger.Debug("new available agent " + name)
+	if _, ok := manager.availableAgents[name]; ok {
+		return false
 	}
+	manager.availableAgents[name] = *instance
+	manager.agentLabels[name] = labels
+	manager.metrics.addAgent(name)
+	manager.logger.Debug("new available agent " + name)
+	manager.publishAgent(AgentAdded, name)
+	return true
 }
 
 func (manager *AgentManager) RemoveAvailableAgent(name string) {
@@ -103,13 +201,15 @@ func (manager *AgentManager) RemoveAvailableAgent(name string) {
 	defer manager.availableMutex.Unlock()
 	if _, ok := manager.availableAgents[name]; ok {
 		delete(manager.availableAgents, name)
-		managerLogger.Debug("delete agent " + name)
+		delete(manager.agentLabels, name)
+		manager.logger.Debug("delete agent " + name)
+		manager.publishAgent(AgentRemoved, name)
 	}
 }
 
 func (manager *AgentManager) Controller() {
-	managerLogger.Debug("enter controller")
-	defer managerLogger.Debug("leave controller")
+	manager.logger.Debug("enter controller")
+	defer manager.logger.Debug("leave controller")
 
 	defer manager.syncer.Done()
 	for {
@@ -119,172 +219,514 @@ func (manager *AgentManager) Controller() {
 		case event := <-manager.agentDisablechannel:
 			manager.DisableAgent(event.name)
 		case event := <-manager.agentCreateChannel:
-			manager.NewAvailableAgent(event.name, event.configurable)
+			added := manager.NewAvailableAgent(event.name, event.configurable, event.labels)
+			if event.added != nil {
+				event.added <- added
+			}
 		case event := <-manager.agentRemoveChannel:
 			manager.RemoveAvailableAgent(event.name)
 			manager.DisableAgent(event.name)
+			manager.status.remove(event.name)
+			manager.heartbeat.forget(event.name)
+			manager.health.forget(event.name)
+			manager.pushes.dropAgent(event.name)
+			manager.pool.forget(event.name)
+			manager.metrics.forgetAgent(event.name)
 		case <-manager.quit:
-			break
+			return
 		}
 	}
 }
 
 func (manager *AgentManager) Detector() {
-	managerLogger.Debug("enter detector")
-	defer managerLogger.Debug("leave detector")
+	manager.logger.Debug("enter detector")
+	defer manager.logger.Debug("leave detector")
 
 	defer manager.syncer.Done()
 	for {
 		select {
 		case <-manager.agentRunDetector:
+			detectorInterval, _ := manager.Intervals()
 			waitForDone := sync.WaitGroup{}
 			func() {
 				manager.availableMutex.RLock()
 				defer manager.availableMutex.RUnlock()
 				for name, agent := range manager.availableAgents {
+					if !manager.health.shouldProbe(name) {
+						manager.logger.Debug("probe backoff: " + name)
+						continue
+					}
 					waitForDone.Add(1)
 					go func(name string, bridge Configurable) {
 						defer waitForDone.Done()
-						managerLogger.Debug("ping")
+						manager.logger.Debug("ping")
+						start := time.Now()
 						err := bridge.Ping()
-						managerLogger.Debug("ping response")
+						manager.metrics.observePing(name, time.Since(start), err)
+						manager.logger.Debug("ping response")
+						manager.status.recordPing(name, err)
 						if err != nil {
-							manager.agentDisablechannel <- &AgentEvent{name, &agent}
+							manager.rollout.agentFailed(name, err)
+						}
+						event := &AgentEvent{name: name, configurable: &agent}
+						if manager.health.observe(name, err, detectorInterval) {
+							manager.send(manager.agentEnableChannel, event)
 						} else {
-							manager.agentEnableChannel <- &AgentEvent{name, &agent}
+							manager.send(manager.agentDisablechannel, event)
 						}
 					}(name, agent)
 				}
 			}()
 			waitForDone.Wait()
 		case <-manager.quit:
-			break
+			return
 		}
 	}
 }
 
 func (manager *AgentManager) Scheduler() {
-	managerLogger.Debug("enter scheduler")
-	defer managerLogger.Debug("leave scheduler")
+	manager.logger.Debug("enter scheduler")
+	defer manager.logger.Debug("leave scheduler")
 	defer manager.syncer.Done()
 
-	detectorTimer := time.NewTimer(manager.detectorRoundSecond)
-	differTimer := time.NewTimer(manager.differRoundSecond)
+	detectorInterval, differInterval := manager.Intervals()
+	detectorTimer := time.NewTimer(detectorInterval)
+	differTimer := time.NewTimer(differInterval)
 	for {
 		select {
 		case <-detectorTimer.C:
-			manager.agentRunDetector <- 0
-			detectorTimer.Reset(manager.detectorRoundSecond)
+			select {
+			case manager.agentRunDetector <- 0:
+			case <-manager.quit:
+				return
+			}
+			detectorInterval, _ := manager.Intervals()
+			detectorTimer.Reset(detectorInterval)
 		case <-differTimer.C:
-			manager.agentRunDiffer <- 0
-			differTimer.Reset(manager.differRoundSecond)
+			select {
+			case manager.agentRunDiffer <- nil:
+			case <-manager.quit:
+				return
+			}
+			_, differInterval := manager.Intervals()
+			differTimer.Reset(differInterval)
 		case <-manager.quit:
-			break
+			return
+		}
+	}
+}
+
+// desiredConfigs 一个agent应有的配置: selector与agent标签匹配的配置
+func desiredConfigs(activatedAgents []CacheItemInfo, labels map[string]string) []CacheItemInfo {
+	expected := make([]CacheItemInfo, 0, len(activatedAgents))
+	for _, info := range activatedAgents {
+		if info.matches(labels) {
+			expected = append(expected, info)
 		}
 	}
+	return expected
+}
+
+/**
+* @brief 对一个agent做diff: 删除不应存在的配置, 推送缺失或过期的配置
+*
+* @param name
+* @param bridge
+* @param activatedAgents cache中当前的所有配置
+* @param scope 本轮diff的范围
+ */
+func (manager *AgentManager) diffAgent(round *reconcileRound, name string, bridge Configurable, activatedAgents []CacheItemInfo, scope *diffScope) {
+	previous := manager.status.snapshot(name)
+	// map[string]string
+	foundAgents, err := bridge.ListConfig()
+	manager.logger.Debug(fmt.Sprintf("%v", foundAgents))
+	manager.status.recordList(name, foundAgents, err)
+	if err != nil {
+		// do something
+		manager.logger.Debug(fmt.Sprintf("fail to list config on %v: %v", name, err.Error()))
+		return
+	}
+	manager.logger.Debug(fmt.Sprintf("found %v agents on %v", len(foundAgents), name))
+	inSync := make([]string, 0)
+	missing := make([]string, 0)
+	unexpected := make([]string, 0)
+	// only configs selected by this agent's labels are expected
+	expectedAgents := desiredConfigs(activatedAgents, manager.GetLabels(name))
+	expectedAgentsId := make(map[string]bool)
+	for _, info := range expectedAgents {
+		expectedAgentsId[info.id] = true
+	}
+	// check unexpected agents
+	for id, _ := range foundAgents {
+		if _, ok := expectedAgentsId[id]; !ok {
+			unexpected = append(unexpected, id)
+			if scope.hasId(id) {
+				manager.submitPush(round, bridge, PushOperation{Agent: name, Id: id, Action: PushUnConfig, Before: foundAgents[id]})
+			}
+		}
+	}
+	// check agent not updated
+	for _, info := range expectedAgents {
+		manager.logger.Debug(fmt.Sprintf("expect id %v on %v", info.id, name))
+		if md5sum, ok := foundAgents[info.id]; ok && strings.ToLower(md5sum) == strings.ToLower(info.md5sum) {
+			manager.logger.Debug("matched")
+			inSync = append(inSync, info.id)
+			manager.rollout.synced(info.id, info.md5sum, name)
+			continue
+		}
+		missing = append(missing, info.id)
+		if !scope.hasId(info.id) {
+			continue
+		}
+		manager.logger.Debug(fmt.Sprintf("but missed, %v vs %v", foundAgents[info.id], info.md5sum))
+		if !manager.rollout.admit(info.id, info.md5sum, name) {
+			manager.logger.Debug(fmt.Sprintf("%v not admitted by rollout of %v", name, info.id))
+			continue
+		}
+		manager.submitPush(round, bridge, PushOperation{
+			Agent:  name,
+			Id:     info.id,
+			Action: PushDoConfig,
+			Md5sum: info.md5sum,
+			Before: foundAgents[info.id],
+		})
+	}
+	if drifted := previous.drifted(expectedAgents, foundAgents); len(drifted) > 0 {
+		manager.logger.Warning(fmt.Sprintf("config drifted on %v: %v", name, drifted))
+		manager.notify(Notification{Event: EventDriftDetected, Agent: name, Drifted: drifted})
+	}
+	manager.status.recordDiff(name, inSync, missing, unexpected)
 }
 
 func (manager *AgentManager) Differ() {
-	managerLogger.Debug("enter differ")
-	defer managerLogger.Debug("leave differ")
+	manager.logger.Debug("enter differ")
+	defer manager.logger.Debug("leave differ")
 
 	defer manager.syncer.Done()
 	for {
 		select {
-		case <-manager.agentRunDiffer:
-			if len(manager.enableAgents) == 0 {
-				managerLogger.Debug("no activated agents")
+		case scope := <-manager.agentRunDiffer:
+			agents := manager.enabledSnapshot()
+			if len(agents) == 0 {
+				manager.logger.Debug("no activated agents")
 				continue
 			}
-			func() {
-				managerLogger.Debug("run differ")
-				// get current agent list, eg: activated
-				activatedAgents, err := manager.cache.List()
-				if err != nil {
-					return
-				}
-				activatedAgentsId := make(map[string]bool)
-				for _, value := range activatedAgents {
-					activatedAgentsId[value.id] = true
-				}
-				waitForDone := sync.WaitGroup{}
-				func() {
-					manager.availableMutex.RLock()
-					defer manager.availableMutex.RUnlock()
-					for name, agent := range manager.enableAgents {
-						waitForDone.Add(1)
-						managerLogger.Debug("diff -> " + name)
-						go func(name string, bridge Configurable) {
-							defer waitForDone.Done()
-							// map[string]string
-							foundAgents, err := bridge.ListConfig()
-							managerLogger.Debug(fmt.Sprintf("%v", foundAgents))
-							if err != nil {
-								// do something
-								managerLogger.Debug(fmt.Sprintf("fail to list config on %v: %v", name, err.Error()))
-								return
-							}
-							managerLogger.Debug(fmt.Sprintf("found %v agents on %v", len(foundAgents), name))
-							// check unexpected agents
-							for id, _ := range foundAgents {
-								if _, ok := activatedAgentsId[id]; !ok {
-									agent.UnConfig(id)
-								}
-							}
-							// check agent not updated
-							for _, info := range activatedAgents {
-								managerLogger.Debug(fmt.Sprintf("expect id %v on %v", info.id, name))
-								if md5sum, ok := foundAgents[info.id]; ok && strings.ToLower(md5sum) == strings.ToLower(info.md5sum) {
-									managerLogger.Debug("matched")
-									continue
-								}
-								managerLogger.Debug(fmt.Sprintf("but missed, %v vs %v", foundAgents[info.id], info.md5sum))
-								go func(id string) {
-									managerLogger.Debug("try boot agent config: " + id)
-									if manager.cache != nil {
-										config, err := manager.cache.Get(id)
-										if err != nil {
-											managerLogger.Debug("no config for: " + id)
-											return
-										}
-										managerLogger.Debug("do config")
-										bridge.DoConfig(id, config)
-									}
-								}(info.id)
-							}
-						}(name, agent)
-					}
-				}()
-				waitForDone.Wait()
-			}()
+			manager.logger.Debug("run differ")
+			start := time.Now()
+			manager.runRound(scope, agents)
+			manager.metrics.observeRound(time.Since(start))
+			if advanced := manager.rollout.advance(agents); len(advanced) > 0 {
+				manager.Trigger(advanced, nil)
+			}
 		case <-manager.quit:
-			break
+			return
 		}
 	}
 }
 
+// Metrics 返回manager, cache和API共用的指标
+func (manager *AgentManager) Metrics() *Metrics {
+	return manager.metrics
+}
+
+// SetLogger 设置manager及其组件的日志, 需要在 Go() 之前调用
+func (manager *AgentManager) SetLogger(logger *logging.Logger) {
+	manager.logger = logger
+	manager.rollout.logger = logger
+	manager.health.logger = logger
+	manager.pushes.logger = logger
+}
+
+// SetIntervals 修改Detector和全量diff的周期, 在下一次定时器触发后生效
+func (manager *AgentManager) SetIntervals(detector time.Duration, differ time.Duration) error {
+	if detector <= 0 || differ <= 0 {
+		return errors.New("detector and differ interval should be positive")
+	}
+	manager.intervalMutex.Lock()
+	defer manager.intervalMutex.Unlock()
+	manager.detectorRoundSecond = detector
+	manager.differRoundSecond = differ
+	return nil
+}
+
+func (manager *AgentManager) Intervals() (time.Duration, time.Duration) {
+	manager.intervalMutex.Lock()
+	defer manager.intervalMutex.Unlock()
+	return manager.detectorRoundSecond, manager.differRoundSecond
+}
+
+// send 向Controller发送事件, 退出后直接丢弃
+func (manager *AgentManager) send(channel chan *AgentEvent, event *AgentEvent) bool {
+	select {
+	case channel <- event:
+		return true
+	case <-manager.quit:
+		manager.logger.Debug("manager quit, drop event of " + event.name)
+		return false
+	}
+}
+
+// Quit 通知所有routine退出, 可重复调用, Go() 在所有routine和进行中的推送结束后返回
 func (manager *AgentManager) Quit() {
-	managerLogger.Debug("Quit")
-	close(manager.quit)
+	manager.quitOnce.Do(func() {
+		manager.logger.Debug("Quit")
+		close(manager.quit)
+		manager.watch.close()
+	})
 }
 
 func (manager *AgentManager) AddAgent(name string, instance *Configurable) {
-	managerLogger.Debug("ready to send add agent" + name)
-	manager.agentCreateChannel <- &AgentEvent{
+	manager.AddAgentWithLabels(name, instance, nil)
+}
+
+func (manager *AgentManager) AddAgentWithLabels(name string, instance *Configurable, labels map[string]string) {
+	manager.logger.Debug("ready to send add agent" + name)
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	manager.send(manager.agentCreateChannel, &AgentEvent{
 		name:         name,
 		configurable: instance,
+		labels:       labels,
+	})
+	manager.logger.Debug("done")
+}
+
+// CreateAgent 由Controller添加agent并等待结果, 同名agent已存在时返回 *ConflictError
+func (manager *AgentManager) CreateAgent(name string, instance *Configurable, labels map[string]string) error {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	added := make(chan bool, 1)
+	if !manager.send(manager.agentCreateChannel, &AgentEvent{
+		name:         name,
+		configurable: instance,
+		labels:       labels,
+		added:        added,
+	}) {
+		return errManagerQuit
+	}
+	select {
+	case ok := <-added:
+		if !ok {
+			return &ConflictError{name: name}
+		}
+		return nil
+	case <-manager.quit:
+		return errManagerQuit
 	}
-	managerLogger.Debug("done")
 }
 
 func (manager *AgentManager) RemoveAgent(name string, instance *Configurable) {
-	manager.agentRemoveChannel <- &AgentEvent{
+	manager.send(manager.agentRemoveChannel, &AgentEvent{
 		name:         name,
 		configurable: instance,
+	})
+}
+
+type AgentInfo struct {
+	Name      string `json:"name"`
+	Bridge    string `json:"bridge"`
+	Host      string `json:"host,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Available bool   `json:"available"`
+	Enabled   bool   `json:"enabled"`
+
+	Labels map[string]string `json:"labels"`
+}
+
+func newAgentInfo(name string, agent Configurable) AgentInfo {
+	info := AgentInfo{
+		Name:   name,
+		Bridge: "unknown",
+	}
+	if bridge, ok := agent.(*BidderHttpBridge); ok {
+		info.Bridge = "http"
+		info.Host = bridge.Host
+		info.Port = bridge.Port
+	}
+	return info
+}
+
+func (manager *AgentManager) isEnabled(name string) bool {
+	manager.enableMutex.RLock()
+	defer manager.enableMutex.RUnlock()
+	_, ok := manager.enableAgents[name]
+	return ok
+}
+
+// GetLabels 返回agent标签的拷贝
+func (manager *AgentManager) GetLabels(name string) map[string]string {
+	manager.availableMutex.RLock()
+	defer manager.availableMutex.RUnlock()
+	labels := make(map[string]string, len(manager.agentLabels[name]))
+	for key, value := range manager.agentLabels[name] {
+		labels[key] = value
+	}
+	return labels
+}
+
+func (manager *AgentManager) SetLabels(name string, labels map[string]string) {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	manager.availableMutex.Lock()
+	defer manager.availableMutex.Unlock()
+	if _, ok := manager.availableAgents[name]; ok && !sameMeta(manager.agentLabels[name], labels) {
+		manager.agentLabels[name] = labels
+		manager.Trigger(nil, []string{name})
+	}
+}
+
+func (manager *AgentManager) HasAgent(name string) bool {
+	manager.availableMutex.RLock()
+	defer manager.availableMutex.RUnlock()
+	_, ok := manager.availableAgents[name]
+	return ok
+}
+
+func (manager *AgentManager) GetAgent(name string) (*AgentInfo, error) {
+	manager.availableMutex.RLock()
+	agent, ok := manager.availableAgents[name]
+	manager.availableMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("agent " + name + " not exist")
+	}
+	info := newAgentInfo(name, agent)
+	info.Labels = manager.GetLabels(name)
+	info.Available = true
+	info.Enabled = manager.isEnabled(name)
+	return &info, nil
+}
+
+func (manager *AgentManager) ListAgents() []AgentInfo {
+	manager.availableMutex.RLock()
+	agents := make(map[string]Configurable, len(manager.availableAgents))
+	for name, agent := range manager.availableAgents {
+		agents[name] = agent
+	}
+	manager.availableMutex.RUnlock()
+
+	names := make([]string, 0, len(agents))
+	for name := range agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	infoList := make([]AgentInfo, 0, len(names))
+	for _, name := range names {
+		info := newAgentInfo(name, agents[name])
+		info.Labels = manager.GetLabels(name)
+		info.Available = true
+		info.Enabled = manager.isEnabled(name)
+		infoList = append(infoList, info)
+	}
+	return infoList
+}
+
+func (manager *AgentManager) enabledSnapshot() map[string]Configurable {
+	manager.enableMutex.RLock()
+	defer manager.enableMutex.RUnlock()
+	agents := make(map[string]Configurable, len(manager.enableAgents))
+	for name, agent := range manager.enableAgents {
+		agents[name] = agent
+	}
+	return agents
+}
+
+// UnConfigAll 在所有enable的agent上删除配置, 返回每个agent的结果
+func (manager *AgentManager) UnConfigAll(id string) map[string]error {
+	agents := manager.enabledSnapshot()
+	results := make(map[string]error, len(agents))
+	resultMutex := sync.Mutex{}
+	waitForDone := sync.WaitGroup{}
+	for name, agent := range agents {
+		waitForDone.Add(1)
+		go func(name string, bridge Configurable) {
+			defer waitForDone.Done()
+			err := bridge.UnConfig(id)
+			if err != nil {
+				manager.logger.Debug(fmt.Sprintf("fail to unconfig %v on %v: %v", id, name, err.Error()))
+			}
+			resultMutex.Lock()
+			results[name] = err
+			resultMutex.Unlock()
+		}(name, agent)
+	}
+	waitForDone.Wait()
+	return results
+}
+
+func (manager *AgentManager) SetRolloutPolicy(policy RolloutPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	manager.rollout.setPolicy(policy)
+	return nil
+}
+
+func (manager *AgentManager) GetRolloutPolicy() RolloutPolicy {
+	return manager.rollout.getPolicy()
+}
+
+// StartRollout 按当前策略为配置id的最新revision开始分批推送
+func (manager *AgentManager) StartRollout(id string) error {
+	info, err := manager.cache.GetInfo(id)
+	if err != nil {
+		return err
+	}
+	agents := make([]string, 0)
+	for name := range manager.enabledSnapshot() {
+		if info.matches(manager.GetLabels(name)) {
+			agents = append(agents, name)
+		}
 	}
+	manager.rollout.start(id, info.md5sum, agents)
+	return nil
+}
+
+func (manager *AgentManager) CancelRollout(id string) {
+	manager.rollout.remove(id)
+}
+
+func (manager *AgentManager) ResumeRollout(id string) error {
+	return manager.rollout.resume(id)
+}
+
+func (manager *AgentManager) PromoteRollout(id string) error {
+	return manager.rollout.promote(id)
+}
+
+func (manager *AgentManager) ListRollouts() []Rollout {
+	return manager.rollout.list()
+}
+
+func (manager *AgentManager) GetAgentStatus(name string) (*AgentStatus, error) {
+	if !manager.HasAgent(name) {
+		return nil, errors.New("agent " + name + " not exist")
+	}
+	status := manager.status.snapshot(name)
+	status.Available = true
+	status.Enabled = manager.isEnabled(name)
+	status.Health = manager.health.state(name)
+	return &status, nil
+}
+
+func (manager *AgentManager) ListAgentStatus() []AgentStatus {
+	infoList := manager.ListAgents()
+	statusList := make([]AgentStatus, 0, len(infoList))
+	for _, info := range infoList {
+		status := manager.status.snapshot(info.Name)
+		status.Available = info.Available
+		status.Enabled = info.Enabled
+		status.Health = manager.health.state(info.Name)
+		statusList = append(statusList, status)
+	}
+	return statusList
 }
 
 func (manager *AgentManager) Go() {
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
 	manager.syncer.Add(1)
 	go manager.Controller()
 	manager.syncer.Add(1)
@@ -293,6 +735,17 @@ func (manager *AgentManager) Go() {
 	go manager.Scheduler()
 	manager.syncer.Add(1)
 	go manager.Differ()
+	manager.syncer.Add(1)
+	go manager.HeartbeatMonitor()
+	manager.syncer.Add(1)
+	go manager.DiscoveryMonitor()
+	manager.syncer.Add(1)
+	go manager.PushRetrier()
+	manager.syncer.Add(1)
+	go manager.Reconciler()
+	manager.syncer.Add(1)
+	go manager.Notifier()
 
 	manager.syncer.Wait()
+	manager.logger.Notice("agent manager stopped")
 }
@@ -2,6 +2,7 @@ package motherbase
 
 import (
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,3 +21,131 @@ func TestDispatcher(t *testing.T) {
 	fmt.Println("quit")
 	manager.Quit()
 }
+
+// fakeBidder 在内存中保存配置, 记录最大并发推送数
+type fakeBidder struct {
+	configs       map[string]string
+	running       int
+	maxConcurrent int
+	mutex         sync.Mutex
+}
+
+func newFakeBidder() *fakeBidder {
+	return &fakeBidder{configs: make(map[string]string)}
+}
+
+func (bidder *fakeBidder) ListConfig() (map[string]string, error) {
+	bidder.mutex.Lock()
+	defer bidder.mutex.Unlock()
+	configs := make(map[string]string, len(bidder.configs))
+	for id, md5sum := range bidder.configs {
+		configs[id] = md5sum
+	}
+	return configs, nil
+}
+
+func (bidder *fakeBidder) DoConfig(name string, body string) error {
+	bidder.mutex.Lock()
+	bidder.running++
+	if bidder.running > bidder.maxConcurrent {
+		bidder.maxConcurrent = bidder.running
+	}
+	bidder.mutex.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	bidder.mutex.Lock()
+	defer bidder.mutex.Unlock()
+	bidder.running--
+	bidder.configs[name] = Md5Sum([]byte(body))
+	return nil
+}
+
+func (bidder *fakeBidder) UnConfig(name string) error {
+	bidder.mutex.Lock()
+	defer bidder.mutex.Unlock()
+	delete(bidder.configs, name)
+	return nil
+}
+
+func (bidder *fakeBidder) Ping() error {
+	return nil
+}
+
+func TestRoundWaitsForPushes(t *testing.T) {
+	cache := NewPersistCacheWithStorage(NewMemoryStorage())
+	manager := NewAgentManager(cache)
+	if err := manager.SetConcurrency(4, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	defer manager.Quit()
+
+	bidder := newFakeBidder()
+	bidder.configs["stale"] = "md5"
+	var instance Configurable = bidder
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.EnableAgent("bidder1", &instance)
+	for _, id := range []string{"agent1", "agent2", "agent3"} {
+		if err := cache.Replace(id, "body of "+id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := manager.runRound(nil, manager.enabledSnapshot())
+	if result.Pushes != 4 || result.Failures != 0 {
+		t.Fatalf("expect 4 pushes, got %+v", result)
+	}
+	configs, _ := bidder.ListConfig()
+	if len(configs) != 3 || configs["agent1"] != Md5Sum([]byte("body of agent1")) {
+		t.Fatalf("unexpected configs after round: %v", configs)
+	}
+	if bidder.maxConcurrent > 1 {
+		t.Fatalf("per agent limit exceeded: %v", bidder.maxConcurrent)
+	}
+}
+
+// slowBidder 第一次DoConfig开始时通知测试, 用来在推送进行中触发退出
+type slowBidder struct {
+	*fakeBidder
+	started chan struct{}
+	once    sync.Once
+}
+
+func (bidder *slowBidder) DoConfig(name string, body string) error {
+	bidder.once.Do(func() { close(bidder.started) })
+	time.Sleep(200 * time.Millisecond)
+	return bidder.fakeBidder.DoConfig(name, body)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	cache := NewPersistCacheWithStorage(NewMemoryStorage())
+	gateway := NewAgentGateway(WithCache(cache))
+	bidder := &slowBidder{fakeBidder: newFakeBidder(), started: make(chan struct{})}
+	var instance Configurable = bidder
+	gateway.Manager.NewAvailableAgent("bidder1", &instance, nil)
+	gateway.Manager.EnableAgent("bidder1", &instance)
+	if err := cache.Replace("agent1", "body of agent1"); err != nil {
+		t.Fatal(err)
+	}
+
+	go gateway.Go()
+	select {
+	case <-bidder.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push not started")
+	}
+	if err := gateway.Shutdown(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gateway.stopped:
+	default:
+		t.Fatal("Go() not returned after shutdown")
+	}
+	configs, _ := bidder.ListConfig()
+	if _, ok := configs["agent1"]; !ok {
+		t.Fatal("in-flight push not drained")
+	}
+	// 重复调用不应panic
+	gateway.Manager.Quit()
+}
@@ -0,0 +1,163 @@
+package motherbase
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AgentStatus 记录每个agent最近一次探活和diff的结果
+type AgentStatus struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Enabled   bool   `json:"enabled"`
+	Health    string `json:"health,omitempty"`
+
+	LastHeartbeat *time.Time `json:"last_heartbeat,omitempty"`
+
+	LastPingTime  *time.Time `json:"last_ping_time,omitempty"`
+	LastPingError string     `json:"last_ping_error,omitempty"`
+
+	LastListTime  *time.Time        `json:"last_list_time,omitempty"`
+	LastListError string            `json:"last_list_error,omitempty"`
+	Configs       map[string]string `json:"configs"`
+
+	InSync     []string `json:"in_sync"`
+	Missing    []string `json:"missing"`
+	Unexpected []string `json:"unexpected"`
+
+	InSyncCount     int `json:"in_sync_count"`
+	MissingCount    int `json:"missing_count"`
+	UnexpectedCount int `json:"unexpected_count"`
+}
+
+type agentStatusBook struct {
+	items map[string]*AgentStatus
+	mutex sync.RWMutex
+}
+
+func newAgentStatusBook() *agentStatusBook {
+	return &agentStatusBook{
+		items: make(map[string]*AgentStatus),
+	}
+}
+
+func (book *agentStatusBook) get(name string) *AgentStatus {
+	status, ok := book.items[name]
+	if !ok {
+		status = &AgentStatus{
+			Name:       name,
+			Configs:    make(map[string]string),
+			InSync:     make([]string, 0),
+			Missing:    make([]string, 0),
+			Unexpected: make([]string, 0),
+		}
+		book.items[name] = status
+	}
+	return status
+}
+
+func (book *agentStatusBook) recordPing(name string, err error) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	status := book.get(name)
+	now := time.Now()
+	status.LastPingTime = &now
+	status.LastPingError = ""
+	if err != nil {
+		status.LastPingError = err.Error()
+	}
+}
+
+func (book *agentStatusBook) recordHeartbeat(name string) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	now := time.Now()
+	book.get(name).LastHeartbeat = &now
+}
+
+func (book *agentStatusBook) recordList(name string, configs map[string]string, err error) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	status := book.get(name)
+	now := time.Now()
+	status.LastListTime = &now
+	status.LastListError = ""
+	if err != nil {
+		status.LastListError = err.Error()
+		return
+	}
+	status.Configs = make(map[string]string, len(configs))
+	for id, md5sum := range configs {
+		status.Configs[id] = md5sum
+	}
+}
+
+func (book *agentStatusBook) recordDiff(name string, inSync []string, missing []string, unexpected []string) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	status := book.get(name)
+	sort.Strings(inSync)
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+	status.InSync = inSync
+	status.Missing = missing
+	status.Unexpected = unexpected
+	status.InSyncCount = len(inSync)
+	status.MissingCount = len(missing)
+	status.UnexpectedCount = len(unexpected)
+}
+
+func (book *agentStatusBook) remove(name string) {
+	book.mutex.Lock()
+	defer book.mutex.Unlock()
+	delete(book.items, name)
+}
+
+func (book *agentStatusBook) snapshot(name string) AgentStatus {
+	book.mutex.RLock()
+	defer book.mutex.RUnlock()
+	status, ok := book.items[name]
+	if !ok {
+		return AgentStatus{
+			Name:       name,
+			Configs:    make(map[string]string),
+			InSync:     make([]string, 0),
+			Missing:    make([]string, 0),
+			Unexpected: make([]string, 0),
+		}
+	}
+	copied := *status
+	copied.Configs = make(map[string]string, len(status.Configs))
+	for id, md5sum := range status.Configs {
+		copied.Configs[id] = md5sum
+	}
+	return copied
+}
+
+/**
+* @brief 上一次diff时已经同步, 期望的md5没有变化, 这一次却不一致的配置,
+*        即bidder上的配置被motherbase之外修改或丢失
+*
+* @param expected 这一次期望的配置
+* @param found 这一次bidder上的配置
+*
+* @return 发生漂移的配置id
+ */
+func (status *AgentStatus) drifted(expected []CacheItemInfo, found map[string]string) []string {
+	inSync := make(map[string]bool, len(status.InSync))
+	for _, id := range status.InSync {
+		inSync[id] = true
+	}
+	drifted := make([]string, 0)
+	for _, info := range expected {
+		if !inSync[info.id] || !strings.EqualFold(status.Configs[info.id], info.md5sum) {
+			continue
+		}
+		if !strings.EqualFold(found[info.id], info.md5sum) {
+			drifted = append(drifted, info.id)
+		}
+	}
+	return drifted
+}
@@ -0,0 +1,112 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAgentStatusEndpoint(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	manager := gateway.Manager
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	defer manager.Quit()
+	serve := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	for id, body := range map[string]string{"agent1": `{"price": 1}`, "agent2": `{"price": 2}`} {
+		if err := gateway.Cache.Replace(id, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bidder := newFakeBidder()
+	bidder.configs["agent1"] = Md5Sum([]byte(`{"price": 1}`))
+	bidder.configs["stale"] = "0123456789abcdef"
+	var instance Configurable = bidder
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.EnableAgent("bidder1", &instance)
+	var idle Configurable = newFakeBidder()
+	manager.NewAvailableAgent("bidder2", &idle, nil)
+
+	manager.status.recordPing("bidder1", errors.New("connection refused"))
+	manager.runRound(nil, manager.enabledSnapshot())
+
+	recorder := serve("/agentstatus")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("agentstatus failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 {
+		t.Fatalf("expect 2 agents, got %s", recorder.Body.String())
+	}
+	for _, key := range []string{"name", "available", "enabled", "last_ping_time", "last_ping_error", "last_list_time",
+		"configs", "in_sync", "missing", "unexpected", "in_sync_count", "missing_count", "unexpected_count"} {
+		if _, ok := raw[0][key]; !ok {
+			t.Fatalf("missing %v in %s", key, recorder.Body.String())
+		}
+	}
+	// 没有探活和diff过的agent返回空数组而不是null
+	for _, key := range []string{"in_sync", "missing", "unexpected"} {
+		if string(raw[1][key]) != "[]" {
+			t.Fatalf("expect empty %v of bidder2, got %s", key, raw[1][key])
+		}
+	}
+	if _, ok := raw[1]["last_ping_time"]; ok {
+		t.Fatalf("bidder2 never pinged: %s", recorder.Body.String())
+	}
+
+	var statusList []AgentStatus
+	if err := json.Unmarshal(recorder.Body.Bytes(), &statusList); err != nil {
+		t.Fatal(err)
+	}
+	status := statusList[0]
+	if status.Name != "bidder1" || !status.Available || !status.Enabled || statusList[1].Enabled {
+		t.Fatalf("unexpected state %+v", statusList)
+	}
+	if status.LastPingError != "connection refused" || len(status.Configs) != 2 {
+		t.Fatalf("unexpected ping or list result %+v", status)
+	}
+	if strings.Join(status.InSync, ",") != "agent1" || strings.Join(status.Missing, ",") != "agent2" || strings.Join(status.Unexpected, ",") != "stale" {
+		t.Fatalf("unexpected diff %+v", status)
+	}
+	if status.InSyncCount != 1 || status.MissingCount != 1 || status.UnexpectedCount != 1 {
+		t.Fatalf("unexpected counts %+v", status)
+	}
+
+	single := AgentStatus{}
+	recorder = serve("/agentstatus?name=bidder1")
+	if err := json.Unmarshal(recorder.Body.Bytes(), &single); err != nil {
+		t.Fatal(err)
+	}
+	if single.Name != "bidder1" || single.MissingCount != 1 {
+		t.Fatalf("unexpected status %+v", single)
+	}
+}
+
+func TestAgentStatusUnknownAgent(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/agentstatus?name=unknown:8611", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("expect 404, got %v %v", recorder.Code, recorder.Body.String())
+	}
+	if _, err := gateway.Manager.GetAgentStatus("unknown:8611"); err == nil {
+		t.Fatal("unknown agent should fail")
+	}
+
+	recorder = httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/agentstatus", nil))
+	if strings.TrimSpace(recorder.Body.String()) != "[]" {
+		t.Fatalf("expect empty list, got %v", recorder.Body.String())
+	}
+}
@@ -0,0 +1,323 @@
+package motherbase
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	AuditDoConfig    = "doconfig"
+	AuditDelete      = "delete"
+	AuditRollback    = "rollback"
+	AuditAgentAdd    = "agent_add"
+	AuditAgentRemove = "agent_remove"
+	AuditPushDo      = "push_doconfig"
+	AuditPushUn      = "push_unconfig"
+)
+
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+)
+
+// 系统内部发起的操作使用的actor
+const (
+	actorDiffer    = "differ"
+	actorHeartbeat = "heartbeat"
+	actorDiscovery = "discovery"
+	actorConfigure = "configure"
+)
+
+/**
+* @brief 一条审计记录, Hash 为前一条记录的 Hash 与本条内容的sha256,
+*        修改或删除任何一条记录都会使之后的校验失败
+ */
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	Id       string    `json:"id,omitempty"`
+	Agent    string    `json:"agent,omitempty"`
+	Before   string    `json:"before_md5,omitempty"`
+	After    string    `json:"after_md5,omitempty"`
+	Revision int64     `json:"revision,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	Hash     string    `json:"hash"`
+	PrevHash string    `json:"prev_hash,omitempty"`
+}
+
+func (entry *AuditEntry) digest() string {
+	unsigned := *entry
+	unsigned.Hash = ""
+	content, _ := json.Marshal(unsigned)
+	sum := sha256.Sum256(append([]byte(entry.PrevHash), content...))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditFilter 查询条件, 空值表示不限制
+type AuditFilter struct {
+	Id    string
+	Agent string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+func (filter *AuditFilter) match(entry *AuditEntry) bool {
+	if len(filter.Id) > 0 && entry.Id != filter.Id {
+		return false
+	}
+	if len(filter.Agent) > 0 && entry.Agent != filter.Agent {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && entry.Time.After(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog 只能追加的审计日志
+type AuditLog interface {
+	Record(entry AuditEntry) error
+	Query(filter AuditFilter) ([]AuditEntry, error)
+}
+
+// FileAuditLog 每条记录一行JSON, 以追加方式写入并fsync;
+// size 为已经完整写入的长度, 查询时不持有锁, 只读取 size 之前的内容
+type FileAuditLog struct {
+	fileName string
+	file     *os.File
+	lastHash string
+	size     int64
+	logger   *logging.Logger
+	mutex    sync.Mutex
+}
+
+/**
+* @brief 打开审计日志并继续之前的hash链, 写入时崩溃留下的不完整的最后一行会被截断
+*
+* @param fileName
+*
+* @return
+ */
+func NewFileAuditLog(fileName string) (*FileAuditLog, error) {
+	auditLog := &FileAuditLog{fileName: fileName, logger: defaultLogger(auditModule)}
+	if err := auditLog.recover(); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	auditLog.file = file
+	return auditLog, nil
+}
+
+// recover 读取最后一条完整的记录, 没有换行结尾或无法解析的最后一行视为写入中断并截断
+func (auditLog *FileAuditLog) recover() error {
+	file, err := os.Open(auditLog.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var size int64
+	for line := 1; ; line++ {
+		content, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(content) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		entry := AuditEntry{}
+		parseErr := json.Unmarshal(bytes.TrimSpace(content), &entry)
+		if err == io.EOF || (parseErr != nil && isLastLine(reader)) {
+			auditLog.logger.Warning(fmt.Sprintf("truncate torn audit entry at %v:%v: %q", auditLog.fileName, line, content))
+			if err := os.Truncate(auditLog.fileName, size); err != nil {
+				return err
+			}
+			break
+		}
+		if parseErr != nil {
+			return errors.New(fmt.Sprintf("invalid audit entry at %v:%v: %v", auditLog.fileName, line, parseErr.Error()))
+		}
+		size += int64(len(content))
+		auditLog.lastHash = entry.Hash
+	}
+	auditLog.size = size
+	return nil
+}
+
+func isLastLine(reader *bufio.Reader) bool {
+	_, err := reader.Peek(1)
+	return err == io.EOF
+}
+
+func (auditLog *FileAuditLog) Close() error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	return auditLog.file.Close()
+}
+
+func (auditLog *FileAuditLog) Record(entry AuditEntry) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	entry.PrevHash = auditLog.lastHash
+	entry.Hash = entry.digest()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := auditLog.file.Write(append(line, '\n')); err != nil {
+		// 去掉写了一半的记录, 之后的记录仍然从完整的行开始
+		auditLog.file.Truncate(auditLog.size)
+		return err
+	}
+	if err := auditLog.file.Sync(); err != nil {
+		return err
+	}
+	auditLog.lastHash = entry.Hash
+	auditLog.size += int64(len(line)) + 1
+	return nil
+}
+
+// committed 返回已经完整写入的长度
+func (auditLog *FileAuditLog) committed() int64 {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	return auditLog.size
+}
+
+// read 读取前 size 字节中的记录, 不需要持有锁, 之后追加的内容不影响结果
+func (auditLog *FileAuditLog) read(size int64) ([]AuditEntry, error) {
+	file, err := os.Open(auditLog.fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]AuditEntry, 0)
+	scanner := bufio.NewScanner(io.LimitReader(file, size))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		entry := AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid audit entry at %v:%v: %v", auditLog.fileName, line, err.Error()))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (auditLog *FileAuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	entries, err := auditLog.read(auditLog.committed())
+	if err != nil {
+		return nil, err
+	}
+	return filterAudit(entries, filter), nil
+}
+
+// Verify 校验hash链, 有记录被修改或删除时返回错误
+func (auditLog *FileAuditLog) Verify() error {
+	entries, err := auditLog.read(auditLog.committed())
+	if err != nil {
+		return err
+	}
+	return verifyAudit(entries)
+}
+
+// MemoryAuditLog 保存在内存中, 用于测试或不需要持久化的场景
+type MemoryAuditLog struct {
+	entries  []AuditEntry
+	lastHash string
+	mutex    sync.Mutex
+}
+
+func NewMemoryAuditLog() *MemoryAuditLog {
+	return &MemoryAuditLog{entries: make([]AuditEntry, 0)}
+}
+
+func (auditLog *MemoryAuditLog) Record(entry AuditEntry) error {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	entry.PrevHash = auditLog.lastHash
+	entry.Hash = entry.digest()
+	auditLog.entries = append(auditLog.entries, entry)
+	auditLog.lastHash = entry.Hash
+	return nil
+}
+
+func (auditLog *MemoryAuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	return filterAudit(auditLog.entries, filter), nil
+}
+
+// filterAudit 按时间顺序返回匹配的记录, Limit 大于0时只返回最新的 Limit 条
+func filterAudit(entries []AuditEntry, filter AuditFilter) []AuditEntry {
+	result := make([]AuditEntry, 0)
+	for index := range entries {
+		if filter.match(&entries[index]) {
+			result = append(result, entries[index])
+		}
+	}
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[len(result)-filter.Limit:]
+	}
+	return result
+}
+
+func verifyAudit(entries []AuditEntry) error {
+	prevHash := ""
+	for index := range entries {
+		entry := &entries[index]
+		if entry.PrevHash != prevHash || entry.digest() != entry.Hash {
+			return errors.New(fmt.Sprintf("audit entry %v has been tampered", index+1))
+		}
+		prevHash = entry.Hash
+	}
+	return nil
+}
+
+// SetAuditLog 设置审计日志, 需要在 Go() 之前调用
+func (manager *AgentManager) SetAuditLog(auditLog AuditLog) {
+	manager.auditLog = auditLog
+}
+
+// audit 记录一条审计日志, 写入失败只输出日志, 不影响操作本身
+func (manager *AgentManager) audit(entry AuditEntry, err error) {
+	if manager.auditLog == nil {
+		return
+	}
+	entry.Time = time.Now()
+	entry.Outcome = AuditSucceeded
+	if err != nil {
+		entry.Outcome = AuditFailed
+		entry.Error = err.Error()
+	}
+	if recordErr := manager.auditLog.Record(entry); recordErr != nil {
+		manager.logger.Error(fmt.Sprintf("fail to record audit %v of %v on %v: %v", entry.Action, entry.Id, entry.Agent, recordErr.Error()))
+	}
+}
+
+func (manager *AgentManager) QueryAudit(filter AuditFilter) ([]AuditEntry, error) {
+	if manager.auditLog == nil {
+		return nil, errors.New("audit log not enabled")
+	}
+	return manager.auditLog.Query(filter)
+}
@@ -0,0 +1,131 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "audit.log")
+
+	auditLog, err := NewFileAuditLog(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Record(AuditEntry{Action: AuditDoConfig, Actor: "alice", Id: "a", After: "m1", Outcome: AuditSucceeded})
+	auditLog.Record(AuditEntry{Action: AuditPushDo, Actor: actorDiffer, Id: "a", Agent: "h:1", After: "m1", Outcome: AuditSucceeded})
+	auditLog.Close()
+
+	// 重新打开后继续之前的hash链
+	if auditLog, err = NewFileAuditLog(fileName); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Record(AuditEntry{Action: AuditDelete, Actor: "bob", Id: "b", Before: "m2", Outcome: AuditSucceeded})
+	defer auditLog.Close()
+	if err := auditLog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := auditLog.Query(AuditFilter{Id: "a"}); len(entries) != 2 {
+		t.Fatalf("expect 2 entries of a, got %v", entries)
+	}
+	if entries, _ := auditLog.Query(AuditFilter{Agent: "h:1"}); len(entries) != 1 || entries[0].Action != AuditPushDo {
+		t.Fatalf("expect push entry of h:1, got %v", entries)
+	}
+	if entries, _ := auditLog.Query(AuditFilter{Limit: 1}); len(entries) != 1 || entries[0].Actor != "bob" {
+		t.Fatalf("expect latest entry, got %v", entries)
+	}
+
+	content, _ := ioutil.ReadFile(fileName)
+	ioutil.WriteFile(fileName, []byte(strings.Replace(string(content), "alice", "mallory", 1)), 0640)
+	if err := auditLog.Verify(); err == nil {
+		t.Fatal("tampered audit log should not pass verification")
+	}
+}
+
+func TestGatewayAudit(t *testing.T) {
+	auditLog := NewMemoryAuditLog()
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithAuditLog(auditLog))
+
+	for _, body := range []string{`{"price": 1}`, `{"price": 2}`} {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(body)))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("doconfig failed: %v %v", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/audit?id=agent1", nil))
+	var entries []AuditEntry
+	if err := json.Unmarshal(recorder.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expect 2 audit entries, got %v", entries)
+	}
+	first, second := entries[0], entries[1]
+	if first.Action != AuditDoConfig || first.Actor != anonymous.Name || first.Before != "" || first.After != Md5Sum([]byte(`{"price": 1}`)) {
+		t.Fatalf("unexpected entry %+v", first)
+	}
+	if second.Before != first.After || second.After != Md5Sum([]byte(`{"price": 2}`)) || second.Revision == 0 {
+		t.Fatalf("unexpected entry %+v", second)
+	}
+	if second.PrevHash != first.Hash {
+		t.Fatal("audit entries are not chained")
+	}
+}
+
+func TestFileAuditLogTornLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "audit.log")
+
+	auditLog, err := NewFileAuditLog(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Record(AuditEntry{Action: AuditDoConfig, Actor: "alice", Id: "a", After: "m1", Outcome: AuditSucceeded})
+	auditLog.Close()
+
+	// 模拟写入最后一条记录时崩溃
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"time":"2015-10-13T10:00:00Z","action":"del`)
+	file.Close()
+
+	if auditLog, err = NewFileAuditLog(fileName); err != nil {
+		t.Fatalf("torn last line should be truncated: %v", err)
+	}
+	defer auditLog.Close()
+	auditLog.Record(AuditEntry{Action: AuditDelete, Actor: "bob", Id: "a", Before: "m1", Outcome: AuditSucceeded})
+	if err := auditLog.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := auditLog.Query(AuditFilter{Id: "a"}); len(entries) != 2 || entries[1].Actor != "bob" {
+		t.Fatalf("expect 2 entries, got %v", entries)
+	}
+
+	// 中间的记录损坏仍然报错
+	content, _ := ioutil.ReadFile(fileName)
+	ioutil.WriteFile(fileName, append([]byte("not json\n"), content...), 0640)
+	if _, err := NewFileAuditLog(fileName); err == nil {
+		t.Fatal("corrupted entry in the middle should fail")
+	}
+}
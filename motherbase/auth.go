@@ -0,0 +1,313 @@
+package motherbase
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoleAgent 只能发送心跳, 不在 read-only < operator < admin 的层级中
+const (
+	RoleAgent    = "agent"
+	RoleReadOnly = "read-only"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleAgent:    0,
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+const (
+	TimestampHeader  = "X-Motherbase-Timestamp"
+	DefaultClockSkew = 5 * time.Minute
+	// MaxSignedBodySize HMAC签名请求的body上限, 签名校验需要把body读入内存
+	MaxSignedBodySize = 16 << 20
+)
+
+// Credential 一个API使用者, Token 用于 "Authorization: Bearer <token>",
+// Secret 用于 "Authorization: HMAC <name>:<signature>" 签名请求, 两者至少有一个
+type Credential struct {
+	Name   string `json:"name" yaml:"name"`
+	Role   string `json:"role" yaml:"role"`
+	Token  string `json:"-" yaml:"token"`
+	Secret string `json:"-" yaml:"secret"`
+}
+
+// String 输出时隐藏token和secret
+func (credential Credential) String() string {
+	return fmt.Sprintf("{%v %v}", credential.Name, credential.Role)
+}
+
+func (credential *Credential) Validate() error {
+	if len(credential.Name) == 0 {
+		return errors.New("empty credential name")
+	}
+	if _, ok := roleLevels[credential.Role]; !ok {
+		return errors.New(fmt.Sprintf("invalid role %v of %v", credential.Role, credential.Name))
+	}
+	if len(credential.Token) == 0 && len(credential.Secret) == 0 {
+		return errors.New("credential " + credential.Name + " has neither token nor secret")
+	}
+	return nil
+}
+
+// Principal 通过认证的调用者
+type Principal struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Allows 判断是否拥有role或更高的权限, RoleAgent 只允许agent和admin
+func (principal *Principal) Allows(role string) bool {
+	if role == RoleAgent {
+		return principal.Role == RoleAgent || principal.Role == RoleAdmin
+	}
+	return roleLevels[principal.Role] >= roleLevels[role]
+}
+
+// anonymous 未配置认证时的调用者, 拥有所有权限
+var anonymous = &Principal{Name: "anonymous", Role: RoleAdmin}
+
+type principalKey struct{}
+
+// PrincipalFrom 返回请求的调用者, 未经过认证的请求返回anonymous
+func PrincipalFrom(req *http.Request) *Principal {
+	if principal, ok := req.Context().Value(principalKey{}).(*Principal); ok {
+		return principal
+	}
+	return anonymous
+}
+
+// Authenticator 校验API token和HMAC签名, 没有任何credential时不做认证;
+// clockSkew 内已经使用过的签名会被拒绝, 防止重放
+type Authenticator struct {
+	credentials []Credential
+	clockSkew   time.Duration
+	mutex       sync.RWMutex
+
+	seen      map[string]time.Time
+	seenMutex sync.Mutex
+}
+
+func NewAuthenticator(credentials []Credential) (*Authenticator, error) {
+	authenticator := &Authenticator{
+		clockSkew: DefaultClockSkew,
+		seen:      make(map[string]time.Time),
+	}
+	if err := authenticator.SetCredentials(credentials); err != nil {
+		return nil, err
+	}
+	return authenticator, nil
+}
+
+// SetCredentials 替换所有credential, 用于重新加载配置
+func (authenticator *Authenticator) SetCredentials(credentials []Credential) error {
+	names := make(map[string]bool)
+	for index := range credentials {
+		if err := credentials[index].Validate(); err != nil {
+			return err
+		}
+		if names[credentials[index].Name] {
+			return errors.New("duplicated credential " + credentials[index].Name)
+		}
+		names[credentials[index].Name] = true
+	}
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+	authenticator.credentials = append([]Credential(nil), credentials...)
+	return nil
+}
+
+func (authenticator *Authenticator) Enabled() bool {
+	authenticator.mutex.RLock()
+	defer authenticator.mutex.RUnlock()
+	return len(authenticator.credentials) > 0
+}
+
+func (authenticator *Authenticator) snapshot() []Credential {
+	authenticator.mutex.RLock()
+	defer authenticator.mutex.RUnlock()
+	return append([]Credential(nil), authenticator.credentials...)
+}
+
+/**
+* @brief 认证请求, HMAC签名的请求会读取并恢复body, body超过 MaxSignedBodySize 时失败;
+*        读取body时不持有锁, 慢速的客户端不会阻塞 SetCredentials
+*
+* @param req
+*
+* @return 认证失败返回错误
+ */
+func (authenticator *Authenticator) Authenticate(req *http.Request) (*Principal, error) {
+	credentials := authenticator.snapshot()
+	if len(credentials) == 0 {
+		return anonymous, nil
+	}
+	authorization := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(authorization, "Bearer "):
+		token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+		for _, credential := range credentials {
+			if len(credential.Token) > 0 && subtle.ConstantTimeCompare([]byte(credential.Token), token) == 1 {
+				return &Principal{Name: credential.Name, Role: credential.Role}, nil
+			}
+		}
+		return nil, errors.New("invalid token")
+	case strings.HasPrefix(authorization, "HMAC "):
+		parts := strings.SplitN(strings.TrimPrefix(authorization, "HMAC "), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid hmac authorization")
+		}
+		for _, credential := range credentials {
+			if credential.Name != parts[0] || len(credential.Secret) == 0 {
+				continue
+			}
+			if err := authenticator.verify(req, credential.Secret, parts[1]); err != nil {
+				return nil, err
+			}
+			return &Principal{Name: credential.Name, Role: credential.Role}, nil
+		}
+		return nil, errors.New("unknown key " + parts[0])
+	}
+	return nil, errors.New("missing authorization")
+}
+
+func (authenticator *Authenticator) verify(req *http.Request, secret string, signature string) error {
+	timestamp, err := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("invalid " + TimestampHeader)
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > authenticator.clockSkew || skew < -authenticator.clockSkew {
+		return errors.New("request timestamp out of range")
+	}
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(nil, req.Body, MaxSignedBodySize)
+	}
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, sign(secret, req, timestamp, body)) {
+		return errors.New("invalid signature")
+	}
+	return authenticator.remember(signature, time.Unix(timestamp, 0).Add(authenticator.clockSkew))
+}
+
+// remember 记录签名直到时间戳超出 clockSkew, 期间再次出现的签名视为重放
+func (authenticator *Authenticator) remember(signature string, expire time.Time) error {
+	authenticator.seenMutex.Lock()
+	defer authenticator.seenMutex.Unlock()
+	now := time.Now()
+	for seen, seenExpire := range authenticator.seen {
+		if now.After(seenExpire) {
+			delete(authenticator.seen, seen)
+		}
+	}
+	if _, ok := authenticator.seen[signature]; ok {
+		return errors.New("replayed request")
+	}
+	authenticator.seen[signature] = expire
+	return nil
+}
+
+// readBody 读取body并放回请求, 之后的handler仍可以读取
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// sign 签名内容: method, 请求路径和参数, 时间戳, body的sha256, 以换行分隔
+func sign(secret string, req *http.Request, timestamp int64, body []byte) []byte {
+	bodySum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(bodySum[:]))
+	return mac.Sum(nil)
+}
+
+// SignRequest 供客户端使用, 为请求加上HMAC签名
+func SignRequest(req *http.Request, name string, secret string) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Authorization", "HMAC "+name+":"+hex.EncodeToString(sign(secret, req, timestamp, body)))
+	return nil
+}
+
+// authorize 认证请求并检查权限, 失败时写入错误响应并返回nil
+func (gateway *AgentGateway) authorize(w http.ResponseWriter, req *http.Request, role string) *http.Request {
+	principal := PrincipalFrom(req)
+	if _, ok := req.Context().Value(principalKey{}).(*Principal); !ok && gateway.auth != nil {
+		var err error
+		if principal, err = gateway.auth.Authenticate(req); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="motherbase"`)
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			gateway.logger.Warning(fmt.Sprintf("unauthorized request %v from %v: %v", req.URL.Path, req.RemoteAddr, err.Error()))
+			return nil
+		}
+		req = req.WithContext(context.WithValue(req.Context(), principalKey{}, principal))
+	}
+	if !principal.Allows(role) {
+		http.Error(w, fmt.Sprintf("forbidden: %v requires role %v", req.URL.Path, role), http.StatusForbidden)
+		gateway.logger.Warning(fmt.Sprintf("forbidden request %v by %v(%v)", req.URL.Path, principal.Name, principal.Role))
+		return nil
+	}
+	return req
+}
+
+// mutatingMethods 修改状态的API只接受的method, 避免预取, 爬虫和跨站GET触发修改
+var mutatingMethods = []string{"POST", "DELETE"}
+
+// handle 注册需要role权限的API, 并统计请求数和延迟; methods 不为空时其余method返回405
+func (gateway *AgentGateway) handle(mux *http.ServeMux, pattern string, role string, handler http.HandlerFunc, methods ...string) {
+	mux.HandleFunc(pattern, gateway.Manager.Metrics().instrument(pattern, func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(req.Method, methods) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, fmt.Sprintf("method %v not allowed on %v", req.Method, req.URL.Path), http.StatusMethodNotAllowed)
+			gateway.logger.Warning(fmt.Sprintf("method %v not allowed on %v from %v", req.Method, req.URL.Path, req.RemoteAddr))
+			return
+		}
+		if req = gateway.authorize(w, req, role); req != nil {
+			handler(w, req)
+		}
+	}))
+}
+
+func allowMethod(method string, methods []string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, allowed := range methods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
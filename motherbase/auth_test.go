@@ -0,0 +1,121 @@
+package motherbase
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorization(t *testing.T) {
+	auth, err := NewAuthenticator([]Credential{
+		{Name: "viewer", Role: RoleReadOnly, Token: "viewer-token"},
+		{Name: "alice", Role: RoleOperator, Secret: "alice-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithAuthenticator(auth))
+	serve := func(req *http.Request) int {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	if code := serve(httptest.NewRequest("GET", "/listconfig", nil)); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without credential, got %v", code)
+	}
+	request := httptest.NewRequest("GET", "/listconfig", nil)
+	request.Header.Set("Authorization", "Bearer viewer-token")
+	if code := serve(request); code != http.StatusOK {
+		t.Fatalf("expect 200 for viewer, got %v", code)
+	}
+	request = httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`))
+	request.Header.Set("Authorization", "Bearer viewer-token")
+	if code := serve(request); code != http.StatusForbidden {
+		t.Fatalf("expect 403 for viewer doconfig, got %v", code)
+	}
+
+	request = httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`))
+	if err := SignRequest(request, "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(request); code != http.StatusOK {
+		t.Fatalf("expect 200 for signed doconfig, got %v", code)
+	}
+	meta, err := gateway.Cache.GetMeta("agent1")
+	if err != nil || meta[authorMetaKey] != "alice" {
+		t.Fatalf("author not recorded: %v %v", meta, err)
+	}
+
+	request = httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 2}`))
+	if err := SignRequest(request, "alice", "wrong-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(request); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 for bad signature, got %v", code)
+	}
+	request = httptest.NewRequest("POST", "/addagent?host=localhost&port=8611", nil)
+	if err := SignRequest(request, "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(request); code != http.StatusForbidden {
+		t.Fatalf("expect 403 for operator addagent, got %v", code)
+	}
+}
+
+func TestAuthenticationLimits(t *testing.T) {
+	auth, err := NewAuthenticator([]Credential{
+		{Name: "viewer", Role: RoleReadOnly, Token: "viewer-token"},
+		{Name: "bidder", Role: RoleAgent, Token: "bidder-token"},
+		{Name: "alice", Role: RoleOperator, Secret: "alice-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithAuthenticator(auth))
+	serve := func(req *http.Request) int {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// 同一个签名只能使用一次
+	request := httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`))
+	if err := SignRequest(request, "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	replayed := httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`))
+	replayed.Header = request.Header.Clone()
+	if code := serve(request); code != http.StatusOK {
+		t.Fatalf("expect 200 for signed doconfig, got %v", code)
+	}
+	if code := serve(replayed); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 for replayed request, got %v", code)
+	}
+
+	request = httptest.NewRequest("POST", "/doconfig?name=agent2", strings.NewReader(strings.Repeat("x", MaxSignedBodySize+1)))
+	if err := SignRequest(request, "alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(request); code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 for oversized body, got %v", code)
+	}
+
+	// agent只能发送心跳, 心跳不接受其他角色
+	request = httptest.NewRequest("POST", "/heartbeat", strings.NewReader("not json"))
+	request.Header.Set("Authorization", "Bearer bidder-token")
+	if code := serve(request); code != http.StatusBadRequest {
+		t.Fatalf("expect heartbeat of agent to be authorized, got %v", code)
+	}
+	request = httptest.NewRequest("GET", "/listconfig", nil)
+	request.Header.Set("Authorization", "Bearer bidder-token")
+	if code := serve(request); code != http.StatusForbidden {
+		t.Fatalf("expect 403 for agent listconfig, got %v", code)
+	}
+	request = httptest.NewRequest("POST", "/heartbeat", strings.NewReader("not json"))
+	request.Header.Set("Authorization", "Bearer viewer-token")
+	if code := serve(request); code != http.StatusForbidden {
+		t.Fatalf("expect 403 for viewer heartbeat, got %v", code)
+	}
+}
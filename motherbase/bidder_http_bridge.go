@@ -1,6 +1,7 @@
 package motherbase
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,32 +12,78 @@ import (
 )
 
 const (
+	// HttpTimeout 请求bidder的默认超时时间
 	HttpTimeout = 3 * time.Second
 )
 
+// BidderHttpBridge 直接构造时 Scheme 默认为http, Timeout 默认为 HttpTimeout
 type BidderHttpBridge struct {
-	Host string
-	Port int
+	Host    string
+	Port    int
+	Scheme  string
+	Timeout time.Duration
+	client  *http.Client
 }
 
 func NewBidderHttpBridge(host string, port int) *BidderHttpBridge {
+	return NewBidderHttpBridgeWithTimeout(host, port, HttpTimeout)
+}
+
+func NewBidderHttpBridgeWithTimeout(host string, port int, timeout time.Duration) *BidderHttpBridge {
 	return &BidderHttpBridge{
-		Host: host,
-		Port: port,
+		Host:    host,
+		Port:    port,
+		Scheme:  "http",
+		Timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// NewBidderHttpsBridge 通过https连接bidder, tlsConfig 中可以设置CA和客户端证书
+func NewBidderHttpsBridge(host string, port int, tlsConfig *tls.Config, timeout time.Duration) *BidderHttpBridge {
+	return &BidderHttpBridge{
+		Host:    host,
+		Port:    port,
+		Scheme:  "https",
+		Timeout: timeout,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+}
+
+func (bridge *BidderHttpBridge) url(path string) string {
+	scheme := bridge.Scheme
+	if len(scheme) == 0 {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%v://%v:%v%v", scheme, bridge.Host, bridge.Port, path)
+}
+
+func (bridge *BidderHttpBridge) do(request *http.Request) (*http.Response, error) {
+	client := bridge.client
+	if client == nil {
+		timeout := bridge.Timeout
+		if timeout <= 0 {
+			timeout = HttpTimeout
+		}
+		client = &http.Client{Timeout: timeout}
 	}
+	return client.Do(request)
 }
 
 func (bridge *BidderHttpBridge) DoConfig(name string, body string) error {
-	url := fmt.Sprintf("http://%v:%v/agent?agent_name=%v&agent_type=linear", bridge.Host, bridge.Port, name)
+	url := bridge.url(fmt.Sprintf("/agent?agent_name=%v&agent_type=linear", name))
 	request, err := http.NewRequest("POST", url, strings.NewReader(body))
 	if err != nil {
 		return err
 	}
-	client := &http.Client{Timeout: HttpTimeout}
-	response, err := client.Do(request)
+	response, err := bridge.do(request)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
@@ -48,16 +95,16 @@ func (bridge *BidderHttpBridge) DoConfig(name string, body string) error {
 }
 
 func (bridge *BidderHttpBridge) UnConfig(name string) error {
-	url := fmt.Sprintf("http://%v:%v/agent?agent_name=%v&agent_type=linear", bridge.Host, bridge.Port, name)
+	url := bridge.url(fmt.Sprintf("/agent?agent_name=%v&agent_type=linear", name))
 	request, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return err
 	}
-	client := &http.Client{Timeout: HttpTimeout}
-	response, err := client.Do(request)
+	response, err := bridge.do(request)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
@@ -69,16 +116,16 @@ func (bridge *BidderHttpBridge) UnConfig(name string) error {
 }
 
 func (bridge *BidderHttpBridge) Ping() error {
-	url := fmt.Sprintf("http://%v:%v/ping", bridge.Host, bridge.Port)
+	url := bridge.url("/ping")
 	request, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	client := &http.Client{Timeout: HttpTimeout}
-	response, err := client.Do(request)
+	response, err := bridge.do(request)
 	if err != nil {
 		return err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
@@ -90,17 +137,17 @@ func (bridge *BidderHttpBridge) Ping() error {
 }
 
 func (bridge *BidderHttpBridge) ListConfig() (map[string]string, error) {
-	url := fmt.Sprintf("http://%v:%v/agents", bridge.Host, bridge.Port)
+	url := bridge.url("/agents")
 	request, err := http.NewRequest("GET", url, nil)
 	items := make(map[string]string)
 	if err != nil {
 		return items, err
 	}
-	client := &http.Client{Timeout: HttpTimeout}
-	response, err := client.Do(request)
+	response, err := bridge.do(request)
 	if err != nil {
 		return items, err
 	}
+	defer response.Body.Close()
 	if response.StatusCode != 200 {
 		body, err := ioutil.ReadAll(response.Body)
 		if err != nil {
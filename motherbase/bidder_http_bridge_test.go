@@ -2,7 +2,12 @@ package motherbase
 
 import (
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestPing(t *testing.T) {
@@ -24,3 +29,34 @@ func TestListConfig(t *testing.T) {
 	fmt.Println(bridge.ListConfig())
 	fmt.Println("done")
 }
+
+func TestBridgeDefaults(t *testing.T) {
+	bridge := BidderHttpBridge{
+		Host: "localhost",
+		Port: 8611,
+	}
+	if url := bridge.url("/ping"); url != "http://localhost:8611/ping" {
+		t.Fatalf("unexpected url %v", url)
+	}
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	host, portString, _ := net.SplitHostPort(server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+	slow := BidderHttpBridge{Host: host, Port: port, Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if err := slow.Ping(); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expect timeout, got %v after %v", err, time.Since(start))
+	}
+	instance, err := NewBridgeWithTLS("", host, port, nil, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout := instance.(*BidderHttpBridge).client.Timeout; timeout != 50*time.Millisecond {
+		t.Fatalf("timeout not passed to bridge: %v", timeout)
+	}
+}
@@ -3,21 +3,20 @@ package motherbase
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"regexp"
+	"io"
+	"reflect"
+	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/yangzhao28/phantom/commonlog"
+	"github.com/op/go-logging"
 )
 
-var cacheLogger = commonlog.NewLogger("cache", "log", commonlog.DEBUG)
-
 func Md5Sum(content []byte) string {
 	md5Ctx := md5.New()
 	md5Ctx.Write(content)
@@ -30,191 +29,426 @@ type CacheItem struct {
 	body       string
 	md5sum     string
 	updateTime int64
+	meta       map[string]string
 }
 
-func parseName(baseName string) (string, string, int64, error) {
-	matcher := regexp.MustCompile(`([a-zA-Z0-9]+)_([0-9a-fA-F]+)_([0-9]+)`)
-	result := matcher.FindStringSubmatch(baseName)
-	if len(result) < 4 {
-		return "", "", 0, errors.New("invalid file name: " + baseName)
-	}
-	updateTime, err := strconv.ParseInt(result[3], 10, 64)
-	if err != nil {
-		return "", "", 0, err
+func (item *CacheItem) info() CacheItemInfo {
+	return CacheItemInfo{
+		id:              item.id,
+		md5sum:          item.md5sum,
+		updateTime:      fmt.Sprintf("%v", time.Unix(item.updateTime, 0)),
+		updateTimestamp: item.updateTime,
+		meta:            item.meta,
 	}
-	return result[1], result[2], updateTime, nil
 }
 
-func fromFile(fileName string) (*CacheItem, error) {
-	baseName := filepath.Base(fileName)
-	id, md5sum, updateTime, err := parseName(baseName)
-	if err != nil {
-		return nil, err
-	}
-	configFile, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
+const (
+	CacheCreated = "create"
+	CacheUpdated = "update"
+	CacheDeleted = "delete"
+)
+
+// CacheEvent 在配置新增、更新或删除后发出
+type CacheEvent struct {
+	Type     string `json:"type"`
+	Id       string `json:"id"`
+	Md5sum   string `json:"md5sum,omitempty"`
+	Revision int64  `json:"revision,omitempty"`
+}
+
+// CacheListener 在持有cache锁时被调用, 不能阻塞也不能再调用cache的方法
+type CacheListener func(event CacheEvent)
+
+const (
+	DefaultMaxRevisions   = 10
+	DefaultMaxRevisionAge = 0
+)
+
+// PersistCache 每个id保留多个revision, revision即更新时间戳,
+// items 中为每个id最新的revision, 持久化由 storage 完成;
+// watchRevision 为watch事件的全局计数, 不持久化, 重启后从0开始,
+// watchEpoch 每次创建cache时生成, 用于识别重启前的resume token
+type PersistCache struct {
+	watchRevision  int64
+	watchEpoch     string
+	items          map[string]*CacheItem
+	revisions      map[string][]*CacheItem
+	storage        Storage
+	maxRevisions   int
+	maxRevisionAge time.Duration
+	listeners      []CacheListener
+	logger         *logging.Logger
+	metrics        *Metrics
+	mutex          sync.RWMutex
+}
+
+func NewPersistCache(persistDirectory string) *PersistCache {
+	return NewPersistCacheWithStorage(NewDirectoryStorage(persistDirectory))
+}
+
+func NewPersistCacheWithStorage(storage Storage) *PersistCache {
+	return &PersistCache{
+		items:          make(map[string]*CacheItem),
+		revisions:      make(map[string][]*CacheItem),
+		storage:        storage,
+		maxRevisions:   DefaultMaxRevisions,
+		maxRevisionAge: DefaultMaxRevisionAge,
+		logger:         defaultLogger(cacheModule),
+		watchEpoch:     strconv.FormatInt(time.Now().UnixNano(), 36),
 	}
-	defer configFile.Close()
-	body, err := ioutil.ReadAll(configFile)
-	if err != nil {
-		return nil, err
+}
+
+// SetLogger 设置cache和底层存储的日志, 需要在使用cache之前调用
+func (cache *PersistCache) SetLogger(logger *logging.Logger) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.logger = logger
+	if storage, ok := cache.storage.(loggerSetter); ok {
+		storage.setLogger(logger)
 	}
-	// 检查MD5
-	if Md5Sum(body) != md5sum {
-		return nil, errors.New("unmatched md5sum")
+}
+
+// WatchRevision 当前的watch revision
+func (cache *PersistCache) WatchRevision() int64 {
+	return atomic.LoadInt64(&cache.watchRevision)
+}
+
+// WatchEpoch watch revision所属的epoch
+func (cache *PersistCache) WatchEpoch() string {
+	return cache.watchEpoch
+}
+
+func (cache *PersistCache) nextWatchRevision() int64 {
+	return atomic.AddInt64(&cache.watchRevision, 1)
+}
+
+// SetMetrics 设置记录cache大小的指标
+func (cache *PersistCache) SetMetrics(metrics *Metrics) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.metrics = metrics
+	cache.updateMetrics()
+}
+
+// updateMetrics 更新cache大小, 调用前需要加锁
+func (cache *PersistCache) updateMetrics() {
+	revisions, bytes := 0, 0
+	for name, item := range cache.items {
+		revisions += len(cache.revisions[name])
+		bytes += len(item.body)
 	}
-	return &CacheItem{
-		id:         id,
-		body:       string(body),
-		md5sum:     md5sum,
-		updateTime: updateTime,
-	}, nil
+	cache.metrics.observeCache(len(cache.items), revisions, bytes)
 }
 
-func (item *CacheItem) GetFileName() string {
-	return item.id + "_" + item.md5sum + "_" + strconv.FormatInt(item.updateTime, 10)
+func (cache *PersistCache) Watch(listener CacheListener) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.listeners = append(cache.listeners, listener)
 }
 
-func (item *CacheItem) toFile(directory string) error {
-	fileName := item.GetFileName()
-	fullPath := filepath.Join(directory, fileName)
-	configFile, err := os.Create(fullPath)
-	if err != nil {
-		return err
+func (cache *PersistCache) notify(event CacheEvent) {
+	for _, listener := range cache.listeners {
+		listener(event)
 	}
-	defer configFile.Close()
-	configFile.WriteString(item.body)
-	return nil
 }
 
-type PersistCache struct {
-	items            map[string]*CacheItem
-	persistDirectory string
-	mutex            sync.RWMutex
+/**
+* @brief 设置revision保留策略, 0表示不限制, 最新的revision总会保留
+*
+* @param maxRevisions 每个id最多保留的revision数量
+* @param maxAge 超过此时长的revision会被删除
+ */
+func (cache *PersistCache) SetRetention(maxRevisions int, maxAge time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.maxRevisions = maxRevisions
+	cache.maxRevisionAge = maxAge
 }
 
-func NewPersistCache(persistDirectory string) *PersistCache {
-	return &PersistCache{
-		items:            make(map[string]*CacheItem),
-		persistDirectory: persistDirectory,
+// expired 返回超出保留策略的下标, timestamps 需按升序排列
+func (cache *PersistCache) expired(timestamps []int64) []int {
+	result := make([]int, 0)
+	now := time.Now()
+	for index := 0; index < len(timestamps)-1; index++ {
+		if cache.maxRevisions > 0 && len(timestamps)-index > cache.maxRevisions {
+			result = append(result, index)
+			continue
+		}
+		if cache.maxRevisionAge > 0 && now.Sub(time.Unix(timestamps[index], 0)) > cache.maxRevisionAge {
+			result = append(result, index)
+		}
 	}
+	return result
+}
+
+func (cache *PersistCache) prune(name string) {
+	history := cache.revisions[name]
+	timestamps := make([]int64, len(history))
+	for index, item := range history {
+		timestamps[index] = item.updateTime
+	}
+	toDelete := make(map[int]bool)
+	for _, index := range cache.expired(timestamps) {
+		toDelete[index] = true
+	}
+	if len(toDelete) == 0 {
+		return
+	}
+	kept := make([]*CacheItem, 0, len(history)-len(toDelete))
+	for index, item := range history {
+		if !toDelete[index] {
+			kept = append(kept, item)
+			continue
+		}
+		if err := cache.storage.Remove(item.id, item.updateTime); err != nil {
+			cache.logger.Warning(err.Error())
+			kept = append(kept, item)
+			continue
+		}
+		cache.logger.Debug(fmt.Sprintf("expired revision -> %v %v", item.id, item.updateTime))
+	}
+	cache.revisions[name] = kept
 }
 
 func (cache *PersistCache) Get(name string) (string, error) {
 	cache.mutex.RLock()
 	defer cache.mutex.RUnlock()
 	if item, ok := cache.items[name]; ok {
-		cacheLogger.Debug(name + " found")
+		cache.logger.Debug(name + " found")
 		return item.body, nil
 	} else {
-		cacheLogger.Debug(name + " not found")
+		cache.logger.Debug(name + " not found")
 		return "", errors.New(name + " not exist")
 	}
 }
 
-func (cache *PersistCache) save(name string, body string) error {
-	item := &CacheItem{
+func (cache *PersistCache) GetInfo(name string) (CacheItemInfo, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	item, ok := cache.items[name]
+	if !ok {
+		return CacheItemInfo{}, errors.New(name + " not exist")
+	}
+	return item.info(), nil
+}
+
+// GetMeta 返回当前revision的元信息
+func (cache *PersistCache) GetMeta(name string) (map[string]string, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	item, ok := cache.items[name]
+	if !ok {
+		return nil, errors.New(name + " not exist")
+	}
+	return item.copy().meta, nil
+}
+
+func (cache *PersistCache) findRevision(name string, revision int64) (*CacheItem, error) {
+	for _, item := range cache.revisions[name] {
+		if item.updateTime == revision {
+			return item, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("%v revision %v not exist", name, revision))
+}
+
+func (cache *PersistCache) GetRevision(name string, revision int64) (string, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	item, err := cache.findRevision(name, revision)
+	if err != nil {
+		return "", err
+	}
+	return item.body, nil
+}
+
+// ListRevisions 按时间升序返回所有revision, 最后一个为当前生效的配置
+func (cache *PersistCache) ListRevisions(name string) ([]CacheItemInfo, error) {
+	cache.mutex.RLock()
+	defer cache.mutex.RUnlock()
+	history, ok := cache.revisions[name]
+	if !ok {
+		return nil, errors.New(name + " not exist")
+	}
+	itemList := make([]CacheItemInfo, 0, len(history))
+	for _, item := range history {
+		itemList = append(itemList, item.info())
+	}
+	return itemList, nil
+}
+
+func (cache *PersistCache) save(name string, body string, meta map[string]string) error {
+	updateTime := time.Now().Unix()
+	// revision以秒为单位, 保证同一id的revision单调递增
+	if history := cache.revisions[name]; len(history) > 0 {
+		if last := history[len(history)-1].updateTime; updateTime <= last {
+			updateTime = last + 1
+		}
+	}
+	item := (&CacheItem{
 		id:         name,
 		body:       body,
 		md5sum:     Md5Sum([]byte(body)),
-		updateTime: time.Now().Unix(),
-	}
-	err := item.toFile(cache.persistDirectory)
+		updateTime: updateTime,
+		meta:       meta,
+	}).copy()
+	err := cache.storage.Save(item)
 	if err != nil {
 		return err
 	}
+	eventType := CacheUpdated
+	if _, ok := cache.items[name]; !ok {
+		eventType = CacheCreated
+	}
 	cache.items[name] = item
+	cache.revisions[name] = append(cache.revisions[name], item)
+	cache.prune(name)
+	cache.updateMetrics()
+	cache.notify(CacheEvent{
+		Type:     eventType,
+		Id:       name,
+		Md5sum:   item.md5sum,
+		Revision: item.updateTime,
+	})
 	return nil
 }
 
 func (cache *PersistCache) Save(name string, body string) error {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
-	return cache.save(name, body)
+	return cache.save(name, body, nil)
 }
 
 func (cache *PersistCache) remove(name string) error {
-	if item, ok := cache.items[name]; ok {
-		fullFileName := filepath.Join(cache.persistDirectory, item.GetFileName())
-		if file, err := os.Open(fullFileName); err == nil {
-			file.Close()
-			err := os.Remove(fullFileName)
-			if err != nil {
-				return err
-			}
+	for _, item := range cache.revisions[name] {
+		if err := cache.storage.Remove(item.id, item.updateTime); err != nil {
+			return err
 		}
-		delete(cache.items, name)
+	}
+	_, existed := cache.items[name]
+	delete(cache.revisions, name)
+	delete(cache.items, name)
+	cache.updateMetrics()
+	if existed {
+		cache.notify(CacheEvent{Type: CacheDeleted, Id: name})
 	}
 	return nil
 }
 
+// Remove 删除id及其所有revision
 func (cache *PersistCache) Remove(name string) error {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
 	return cache.remove(name)
 }
 
+// Replace 保存新的revision, 旧的revision按保留策略保留, 内容未变化时不产生新revision
 func (cache *PersistCache) Replace(name string, body string) error {
+	return cache.ReplaceWithMeta(name, body, nil)
+}
+
+func (cache *PersistCache) ReplaceWithMeta(name string, body string, meta map[string]string) error {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
-	if err := cache.remove(name); err != nil {
-		return err
+	if item, ok := cache.items[name]; ok && item.md5sum == Md5Sum([]byte(body)) && sameMeta(item.meta, meta) {
+		cache.logger.Debug(name + " unchanged")
+		return nil
 	}
-	return cache.save(name, body)
+	return cache.save(name, body, meta)
 }
 
-func (cache *PersistCache) Clean() error {
+// sameMeta 比较meta, 忽略修改者, 同样的内容由不同的人提交不产生新的revision
+func sameMeta(left map[string]string, right map[string]string) bool {
+	return reflect.DeepEqual(withoutAuthor(left), withoutAuthor(right))
+}
+
+func withoutAuthor(meta map[string]string) map[string]string {
+	stripped := make(map[string]string, len(meta))
+	for key, value := range meta {
+		if key != authorMetaKey {
+			stripped[key] = value
+		}
+	}
+	return stripped
+}
+
+// Rollback 以指定revision的内容生成一个新的revision, 由Differ同步到各agent
+func (cache *PersistCache) Rollback(name string, revision int64) error {
+	return cache.RollbackBy(name, revision, "")
+}
+
+// RollbackBy 同 Rollback, 新的revision记录author为修改者
+func (cache *PersistCache) RollbackBy(name string, revision int64, author string) error {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
-	fullPath, err := filepath.Abs(cache.persistDirectory)
+	item, err := cache.findRevision(name, revision)
 	if err != nil {
 		return err
 	}
-	files, err := ioutil.ReadDir(fullPath)
+	if current, ok := cache.items[name]; ok && current.md5sum == item.md5sum && sameMeta(current.meta, item.meta) {
+		cache.logger.Debug(fmt.Sprintf("%v revision %v is current", name, revision))
+		return nil
+	}
+	meta := withoutAuthor(item.meta)
+	if len(author) > 0 {
+		meta[authorMetaKey] = author
+	}
+	return cache.save(name, item.body, meta)
+}
+
+// Clean 按保留策略删除storage中过期的revision
+func (cache *PersistCache) Clean() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cleaner, ok := cache.storage.(storageCleaner); ok {
+		if err := cleaner.Clean(); err != nil {
+			return err
+		}
+	}
+	itemList, err := cache.storage.List()
 	if err != nil {
 		return err
 	}
-	toDelete := make([]string, 0)
-	type temp struct {
-		FileName  string
-		Timestamp int64
-	}
-	filter := make(map[string]temp)
-	// find old file to delete
-	for _, fileInfo := range files {
-		if !fileInfo.IsDir() {
-			id, _, updateTime, err := parseName(fileInfo.Name())
-			if err != nil || fileInfo.Size() == 0 {
-				toDelete = append(toDelete, fileInfo.Name())
-			}
-			value, ok := filter[id]
-			if ok {
-				if value.Timestamp > updateTime {
-					toDelete = append(toDelete, fileInfo.Name())
-					continue
-				} else {
-					toDelete = append(toDelete, value.FileName)
-				}
-			}
-			filter[id] = temp{
-				FileName:  fileInfo.Name(),
-				Timestamp: updateTime,
-			}
-		}
+	filter := make(map[string][]int64)
+	for _, info := range itemList {
+		filter[info.id] = append(filter[info.id], info.updateTimestamp)
 	}
-	// delete
-	for _, fileName := range toDelete {
-		os.Remove(fileName)
+	for id, timestamps := range filter {
+		sort.Slice(timestamps, func(i, j int) bool {
+			return timestamps[i] < timestamps[j]
+		})
+		for _, index := range cache.expired(timestamps) {
+			cache.logger.Debug(fmt.Sprintf("clean -> %v %v", id, timestamps[index]))
+			cache.storage.Remove(id, timestamps[index])
+		}
 	}
 	return nil
 }
 
+// Quarantine 列出storage中损坏或孤立的数据
+func (cache *PersistCache) Quarantine() ([]QuarantineEntry, error) {
+	if quarantine, ok := cache.storage.(storageQuarantine); ok {
+		return quarantine.Quarantine()
+	}
+	return make([]QuarantineEntry, 0), nil
+}
+
 type CacheItemInfo struct {
 	id              string
 	md5sum          string
 	updateTime      string
 	updateTimestamp int64
+	meta            map[string]string
+}
+
+func (info CacheItemInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Id              string            `json:"id"`
+		Md5sum          string            `json:"md5sum"`
+		UpdateTime      string            `json:"update_time"`
+		UpdateTimestamp int64             `json:"update_timestamp"`
+		Meta            map[string]string `json:"meta,omitempty"`
+	}{info.id, info.md5sum, info.updateTime, info.updateTimestamp, info.meta})
 }
 
 func (cache *PersistCache) List() ([]CacheItemInfo, error) {
@@ -222,13 +456,8 @@ func (cache *PersistCache) List() ([]CacheItemInfo, error) {
 	defer cache.mutex.RUnlock()
 	itemList := make([]CacheItemInfo, 0)
 	for _, value := range cache.items {
-		itemList = append(itemList, CacheItemInfo{
-			id:              value.id,
-			md5sum:          value.md5sum,
-			updateTime:      fmt.Sprintf("%v", time.Unix(value.updateTime, 0)),
-			updateTimestamp: value.updateTime,
-		})
-		cacheLogger.Debug("  list -- " + value.id)
+		itemList = append(itemList, value.info())
+		cache.logger.Debug("  list -- " + value.id)
 	}
 	return itemList, nil
 }
@@ -236,31 +465,34 @@ func (cache *PersistCache) List() ([]CacheItemInfo, error) {
 func (cache *PersistCache) Reload() error {
 	cache.mutex.Lock()
 	defer cache.mutex.Unlock()
-	fullPath, err := filepath.Abs(cache.persistDirectory)
+	items, err := cache.storage.Reload()
 	if err != nil {
-		cacheLogger.Warning(err.Error())
+		cache.logger.Warning(err.Error())
 		return err
 	}
-	cacheLogger.Notice(fmt.Sprintf("reload from %s", fullPath))
-	files, err := ioutil.ReadDir(fullPath)
-	if err != nil {
-		cacheLogger.Warning(err.Error())
-		return err
+	revisions := make(map[string][]*CacheItem)
+	for _, item := range items {
+		revisions[item.id] = append(revisions[item.id], item)
 	}
-	count := 0
-	for _, fileInfo := range files {
-		if !fileInfo.IsDir() {
-			fullFileName := filepath.Join(fullPath, fileInfo.Name())
-			item, err := fromFile(fullFileName)
-			if err == nil {
-				cache.items[item.id] = item
-				count++
-				cacheLogger.Debug(fmt.Sprintf("loaded -> file:%v", fullFileName))
-			} else {
-				cacheLogger.Debug(fmt.Sprintf("ignore -> file:%v error:%v", fullFileName, err.Error()))
-			}
-		}
+	cache.revisions = revisions
+	cache.items = make(map[string]*CacheItem)
+	for id, history := range revisions {
+		sort.Slice(history, func(i, j int) bool {
+			return history[i].updateTime < history[j].updateTime
+		})
+		cache.items[id] = history[len(history)-1]
+	}
+	cache.updateMetrics()
+	cache.logger.Notice(fmt.Sprintf("%v revision(s) loaded, totally %v item(s) now", len(items), len(cache.items)))
+	return nil
+}
+
+// Close 关闭底层存储, 之后不能再写入; 目录存储每次写入都已fsync, 无需额外刷盘
+func (cache *PersistCache) Close() error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if closer, ok := cache.storage.(io.Closer); ok {
+		return closer.Close()
 	}
-	cacheLogger.Notice(fmt.Sprintf("%v item(s) loaded, totally %v now", count, len(cache.items)))
 	return nil
 }
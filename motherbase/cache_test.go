@@ -0,0 +1,68 @@
+package motherbase
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestCache(t *testing.T) (*PersistCache, string, func()) {
+	directory, err := ioutil.TempDir("", "motherbase-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewPersistCache(directory), directory, func() { os.RemoveAll(directory) }
+}
+
+func TestRevisionRollback(t *testing.T) {
+	cache, directory, cleanup := newTestCache(t)
+	defer cleanup()
+
+	if err := cache.Replace("agent1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Replace("agent1", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := cache.ListRevisions("agent1")
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("expect 2 revisions, got %v %v", revisions, err)
+	}
+	if err := cache.Rollback("agent1", revisions[0].updateTimestamp); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := cache.Get("agent1"); body != "v1" {
+		t.Fatalf("expect v1 after rollback, got %v", body)
+	}
+
+	reloaded := NewPersistCache(directory)
+	if err := reloaded.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := reloaded.Get("agent1"); body != "v1" {
+		t.Fatalf("expect v1 after reload, got %v", body)
+	}
+	if revisions, _ := reloaded.ListRevisions("agent1"); len(revisions) != 3 {
+		t.Fatalf("expect 3 revisions after reload, got %v", len(revisions))
+	}
+}
+
+func TestRevisionRetention(t *testing.T) {
+	cache, directory, cleanup := newTestCache(t)
+	defer cleanup()
+	cache.SetRetention(2, 0)
+
+	for _, body := range []string{"v1", "v2", "v3"} {
+		if err := cache.Replace("agent1", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revisions, _ := cache.ListRevisions("agent1")
+	if len(revisions) != 2 {
+		t.Fatalf("expect 2 revisions, got %v", len(revisions))
+	}
+	files, _ := ioutil.ReadDir(directory)
+	if len(files) != 2 {
+		t.Fatalf("expect 2 files, got %v", len(files))
+	}
+}
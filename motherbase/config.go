@@ -0,0 +1,459 @@
+package motherbase
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/yangzhao28/phantom/commonlog"
+	"gopkg.in/yaml.v2"
+)
+
+const configureEnvPrefix = "MOTHERBASE_"
+
+// Storage 的可选值
+const (
+	StorageDirectory = "directory"
+	StorageBolt      = "bolt"
+	StorageMemory    = "memory"
+)
+
+const boltFileName = "configs.db"
+
+/**
+* @brief motherbase的启动配置, 优先级: 命令行参数 > 环境变量 > 配置文件 > 默认值
+*        DetectorInterval, DifferInterval, Agents, Credentials, Webhooks 和配置校验规则
+*        (SchemaFile, MaxBidPrice) 可以通过SIGHUP重新加载, MaxBidPrice 为0时不限制,
+*        Credentials 为空时API不做认证, 设置 TLS 时API使用https, 证书文件修改后自动生效,
+*        AuditFile 为空时审计日志写入 LogDir 下的 audit.log,
+*        Storage 选择配置的存储: directory 和 bolt 保存在 PersistDir 下, memory 不持久化,
+*        DiscoveryFiles 和 DiscoveryDNS 在启动时添加为discovery source, 每 DiscoveryInterval 秒查询一次;
+*        revision保留, 健康阈值, 推送重试和心跳超时也可以重新加载, 推送并发只在启动时生效,
+*        MaxRevisions 和 MaxRevisionAge 为0时不限制
+ */
+type Configure struct {
+	Listen             string            `yaml:"listen"`
+	PersistDir         string            `yaml:"persist_dir"`
+	Storage            string            `yaml:"storage"`
+	LogDir             string            `yaml:"log_dir"`
+	LogLevel           string            `yaml:"log_level"`
+	AuditFile          string            `yaml:"audit_file"`
+	DetectorInterval   int               `yaml:"detector_interval"`
+	DifferInterval     int               `yaml:"differ_interval"`
+	HttpTimeout        int               `yaml:"http_timeout"`
+	ShutdownTimeout    int               `yaml:"shutdown_timeout"`
+	Agents             []DiscoveredAgent `yaml:"agents"`
+	Credentials        []Credential      `yaml:"credentials"`
+	Webhooks           []Webhook         `yaml:"webhooks"`
+	SchemaFile         string            `yaml:"schema_file"`
+	MaxBidPrice        float64           `yaml:"max_bid_price"`
+	BidPriceField      string            `yaml:"bid_price_field"`
+	TLS                *TLSFiles         `yaml:"tls"`
+	BridgeTLS          *TLSFiles         `yaml:"bridge_tls"`
+	DiscoveryInterval  int               `yaml:"discovery_interval"`
+	DiscoveryFiles     []string          `yaml:"discovery_files"`
+	DiscoveryDNS       []DNSDiscovery    `yaml:"discovery_dns"`
+	MaxRevisions       int               `yaml:"max_revisions"`
+	MaxRevisionAge     int               `yaml:"max_revision_age"`
+	FailureThreshold   int               `yaml:"failure_threshold"`
+	SuccessThreshold   int               `yaml:"success_threshold"`
+	MaxProbeBackoff    int               `yaml:"max_probe_backoff"`
+	PushMaxAttempts    int               `yaml:"push_max_attempts"`
+	PushBaseBackoff    int               `yaml:"push_base_backoff"`
+	PushMaxBackoff     int               `yaml:"push_max_backoff"`
+	HeartbeatInterval  int               `yaml:"heartbeat_interval"`
+	HeartbeatMaxMissed int               `yaml:"heartbeat_max_missed"`
+	PushWorkers        int               `yaml:"push_workers"`
+	AgentPushLimit     int               `yaml:"agent_push_limit"`
+	DiffLimit          int               `yaml:"diff_limit"`
+
+	fileName string
+	args     []string
+}
+
+func DefaultConfigure() *Configure {
+	return &Configure{
+		Listen:           ":12345",
+		PersistDir:       DefaultPersistDir,
+		Storage:          StorageDirectory,
+		LogDir:           "log",
+		LogLevel:         "DEBUG",
+		DetectorInterval: int(DefaultDetectorInterval / time.Second),
+		DifferInterval:   int(DefaultDifferInterval / time.Second),
+		HttpTimeout:      3,
+		ShutdownTimeout:  10,
+		Agents:           []DiscoveredAgent{{Host: "localhost", Port: 8611}},
+		BidPriceField:    "price",
+
+		DiscoveryInterval:  int(DefaultDiscoveryInterval / time.Second),
+		MaxRevisions:       DefaultMaxRevisions,
+		MaxRevisionAge:     int(DefaultMaxRevisionAge / time.Second),
+		FailureThreshold:   DefaultFailureThreshold,
+		SuccessThreshold:   DefaultSuccessThreshold,
+		MaxProbeBackoff:    int(DefaultMaxProbeBackoff / time.Second),
+		PushMaxAttempts:    DefaultPushMaxAttempts,
+		PushBaseBackoff:    int(DefaultPushBaseBackoff / time.Second),
+		PushMaxBackoff:     int(DefaultPushMaxBackoff / time.Second),
+		HeartbeatInterval:  int(DefaultHeartbeatInterval / time.Second),
+		HeartbeatMaxMissed: DefaultHeartbeatMaxMissed,
+		PushWorkers:        DefaultPushWorkers,
+		AgentPushLimit:     DefaultAgentPushLimit,
+		DiffLimit:          DefaultDiffLimit,
+	}
+}
+
+// configureOption 一个可以由命令行参数和环境变量覆盖的配置项
+type configureOption struct {
+	name  string
+	usage string
+	set   func(configure *Configure, value string) error
+}
+
+func intOption(name string, usage string, field func(configure *Configure) *int) configureOption {
+	return configureOption{name, usage, func(configure *Configure, value string) error {
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid %v: %v", name, value))
+		}
+		*field(configure) = number
+		return nil
+	}}
+}
+
+func stringOption(name string, usage string, field func(configure *Configure) *string) configureOption {
+	return configureOption{name, usage, func(configure *Configure, value string) error {
+		*field(configure) = value
+		return nil
+	}}
+}
+
+var configureOptions = []configureOption{
+	stringOption("listen", "address for server to listen on", func(c *Configure) *string { return &c.Listen }),
+	stringOption("persist_dir", "directory to persist agent configs", func(c *Configure) *string { return &c.PersistDir }),
+	stringOption("storage", "storage of agent configs: directory, bolt or memory", func(c *Configure) *string { return &c.Storage }),
+	stringOption("log_dir", "directory of log files", func(c *Configure) *string { return &c.LogDir }),
+	stringOption("audit_file", "append-only audit log, default <log_dir>/audit.log", func(c *Configure) *string { return &c.AuditFile }),
+	stringOption("schema_file", "json schema of agent configs", func(c *Configure) *string { return &c.SchemaFile }),
+	stringOption("log_level", "log level: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL", func(c *Configure) *string { return &c.LogLevel }),
+	intOption("detector_interval", "interval between agent pings (second)", func(c *Configure) *int { return &c.DetectorInterval }),
+	intOption("differ_interval", "interval between full reconciliations (second)", func(c *Configure) *int { return &c.DifferInterval }),
+	intOption("http_timeout", "timeout of requests to bidders (second)", func(c *Configure) *int { return &c.HttpTimeout }),
+	intOption("shutdown_timeout", "maximum duration to wait for shutdown (second)", func(c *Configure) *int { return &c.ShutdownTimeout }),
+	intOption("discovery_interval", "interval between agent discoveries (second)", func(c *Configure) *int { return &c.DiscoveryInterval }),
+	intOption("max_revisions", "revisions kept for each config, 0 for unlimited", func(c *Configure) *int { return &c.MaxRevisions }),
+	intOption("max_revision_age", "maximum age of kept revisions (second), 0 for unlimited", func(c *Configure) *int { return &c.MaxRevisionAge }),
+	intOption("failure_threshold", "consecutive failed pings before an agent is down", func(c *Configure) *int { return &c.FailureThreshold }),
+	intOption("success_threshold", "consecutive successful pings before an agent recovers", func(c *Configure) *int { return &c.SuccessThreshold }),
+	intOption("max_probe_backoff", "maximum interval between pings of a down agent (second)", func(c *Configure) *int { return &c.MaxProbeBackoff }),
+	intOption("push_max_attempts", "attempts before a push goes to dead letter", func(c *Configure) *int { return &c.PushMaxAttempts }),
+	intOption("push_base_backoff", "backoff after the first failed push (second)", func(c *Configure) *int { return &c.PushBaseBackoff }),
+	intOption("push_max_backoff", "maximum backoff between push retries (second)", func(c *Configure) *int { return &c.PushMaxBackoff }),
+	intOption("heartbeat_interval", "expected interval of bidder heartbeats (second)", func(c *Configure) *int { return &c.HeartbeatInterval }),
+	intOption("heartbeat_max_missed", "missed heartbeats before a registered bidder is removed", func(c *Configure) *int { return &c.HeartbeatMaxMissed }),
+	intOption("push_workers", "number of push workers", func(c *Configure) *int { return &c.PushWorkers }),
+	intOption("agent_push_limit", "concurrent pushes to one agent", func(c *Configure) *int { return &c.AgentPushLimit }),
+	intOption("diff_limit", "agents diffed at the same time", func(c *Configure) *int { return &c.DiffLimit }),
+	{"discovery_files", "inventory files of bidders separated by comma", func(configure *Configure, value string) error {
+		configure.DiscoveryFiles = make([]string, 0)
+		for _, fileName := range strings.Split(value, ",") {
+			if fileName = strings.TrimSpace(fileName); len(fileName) > 0 {
+				configure.DiscoveryFiles = append(configure.DiscoveryFiles, fileName)
+			}
+		}
+		return nil
+	}},
+	{"agents", "initial bidders, host:port separated by comma", func(configure *Configure, value string) error {
+		agents, err := parseAgentList(value)
+		if err != nil {
+			return err
+		}
+		configure.Agents = agents
+		return nil
+	}},
+}
+
+func parseAgentList(value string) ([]DiscoveredAgent, error) {
+	agents := make([]DiscoveredAgent, 0)
+	for _, address := range strings.Split(value, ",") {
+		address = strings.TrimSpace(address)
+		if len(address) == 0 {
+			continue
+		}
+		host, portString, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.New("invalid agent address " + address)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, errors.New("invalid agent address " + address)
+		}
+		agents = append(agents, DiscoveredAgent{Host: host, Port: port})
+	}
+	return agents, nil
+}
+
+/**
+* @brief 从命令行参数加载配置, -config 指定配置文件, 环境变量 MOTHERBASE_<NAME> 覆盖配置文件
+*
+* @param args 不包括程序名的命令行参数
+*
+* @return
+ */
+func LoadConfigure(args []string) (*Configure, error) {
+	flagSet := flag.NewFlagSet("motherbase", flag.ContinueOnError)
+	fileName := flagSet.String("config", os.Getenv(configureEnvPrefix+"CONFIG"), "configure file (yaml)")
+	for _, option := range configureOptions {
+		flagSet.String(option.name, "", option.usage)
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return nil, err
+	}
+
+	configure := DefaultConfigure()
+	if len(*fileName) > 0 {
+		content, err := ioutil.ReadFile(*fileName)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(content, configure); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid configure file %v: %v", *fileName, err.Error()))
+		}
+	}
+	for _, option := range configureOptions {
+		if value, ok := os.LookupEnv(configureEnvPrefix + strings.ToUpper(option.name)); ok {
+			if err := option.set(configure, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var err error
+	flagSet.Visit(func(visited *flag.Flag) {
+		for _, option := range configureOptions {
+			if option.name == visited.Name && err == nil {
+				err = option.set(configure, visited.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := configure.Validate(); err != nil {
+		return nil, err
+	}
+	configure.fileName = *fileName
+	configure.args = args
+	return configure, nil
+}
+
+// Reload 以启动时的参数重新加载配置, 用于SIGHUP
+func (configure *Configure) Reload() (*Configure, error) {
+	return LoadConfigure(configure.args)
+}
+
+func (configure *Configure) Validate() error {
+	if _, _, err := net.SplitHostPort(configure.Listen); err != nil {
+		return errors.New("invalid listen address " + configure.Listen)
+	}
+	if len(configure.PersistDir) == 0 {
+		return errors.New("empty persist dir")
+	}
+	switch configure.Storage {
+	case StorageDirectory, StorageBolt, StorageMemory:
+	default:
+		return errors.New(fmt.Sprintf("invalid storage %v, should be %v, %v or %v",
+			configure.Storage, StorageDirectory, StorageBolt, StorageMemory))
+	}
+	if _, err := commonlog.ParseLevel(configure.LogLevel); err != nil {
+		return err
+	}
+	if configure.DetectorInterval <= 0 || configure.DifferInterval <= 0 {
+		return errors.New("detector and differ interval should be positive")
+	}
+	if configure.HttpTimeout <= 0 || configure.ShutdownTimeout <= 0 {
+		return errors.New("http and shutdown timeout should be positive")
+	}
+	if configure.TLS != nil {
+		if len(configure.TLS.CertFile) == 0 || len(configure.TLS.KeyFile) == 0 {
+			return errors.New("tls requires cert_file and key_file")
+		}
+	}
+	if configure.BridgeTLS != nil {
+		if err := configure.BridgeTLS.Validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, agent := range configure.Agents {
+		if len(agent.Host) == 0 || agent.Port <= 0 || agent.Port > 65535 {
+			return errors.New(fmt.Sprintf("invalid agent %v:%v", agent.Host, agent.Port))
+		}
+		if agent.TLS != nil {
+			if err := agent.TLS.Validate(); err != nil {
+				return errors.New(fmt.Sprintf("agent %v: %v", agent.Name(), err.Error()))
+			}
+		}
+		if names[agent.Name()] {
+			return errors.New("duplicated agent " + agent.Name())
+		}
+		names[agent.Name()] = true
+	}
+	if configure.DiscoveryInterval <= 0 {
+		return errors.New("discovery interval should be positive")
+	}
+	for _, fileName := range configure.DiscoveryFiles {
+		if len(fileName) == 0 {
+			return errors.New("empty discovery file")
+		}
+	}
+	for i := range configure.DiscoveryDNS {
+		if err := configure.DiscoveryDNS[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if configure.MaxRevisions < 0 || configure.MaxRevisionAge < 0 {
+		return errors.New("revision retention should not be negative")
+	}
+	healthPolicy := configure.healthPolicy()
+	if err := healthPolicy.Validate(); err != nil {
+		return err
+	}
+	retryPolicy := configure.retryPolicy()
+	if err := retryPolicy.Validate(); err != nil {
+		return err
+	}
+	if configure.HeartbeatInterval <= 0 || configure.HeartbeatMaxMissed <= 0 {
+		return errors.New("heartbeat interval and max missed should be positive")
+	}
+	if configure.PushWorkers <= 0 || configure.AgentPushLimit <= 0 || configure.DiffLimit <= 0 {
+		return errors.New("concurrency limits should be positive")
+	}
+	if _, err := NewAuthenticator(configure.Credentials); err != nil {
+		return err
+	}
+	if configure.MaxBidPrice < 0 {
+		return errors.New("max_bid_price should not be negative")
+	}
+	if configure.MaxBidPrice > 0 && len(configure.BidPriceField) == 0 {
+		return errors.New("bid_price_field is required by max_bid_price")
+	}
+	if _, err := configure.schema(); err != nil {
+		return err
+	}
+	return validateWebhooks(configure.Webhooks)
+}
+
+// schema 加载 SchemaFile, 未设置时返回nil
+func (configure *Configure) schema() (*JSONSchema, error) {
+	if len(configure.SchemaFile) == 0 {
+		return nil, nil
+	}
+	return LoadJSONSchema(configure.SchemaFile)
+}
+
+// maxBidPrice 出价上限校验, 未设置时返回nil
+func (configure *Configure) maxBidPrice() ConfigValidator {
+	if configure.MaxBidPrice <= 0 {
+		return nil
+	}
+	return MaxBidPrice(configure.BidPriceField, configure.MaxBidPrice)
+}
+
+// Print 输出所有配置项, 格式同redirector
+func (configure *Configure) Print(logger *logging.Logger) {
+	logger.Notice("configure: " + configure.fileName)
+	configureValue := reflect.ValueOf(*configure)
+	configureType := reflect.TypeOf(*configure)
+	for i := 0; i < configureValue.NumField(); i++ {
+		if len(configureType.Field(i).PkgPath) > 0 {
+			continue
+		}
+		logger.Notice(fmt.Sprintf("\t%v:\t%v", configureType.Field(i).Name, configureValue.Field(i)))
+	}
+}
+
+func (configure *Configure) detectorInterval() time.Duration {
+	return time.Duration(configure.DetectorInterval) * time.Second
+}
+
+func (configure *Configure) differInterval() time.Duration {
+	return time.Duration(configure.DifferInterval) * time.Second
+}
+
+func (configure *Configure) discoveryInterval() time.Duration {
+	return time.Duration(configure.DiscoveryInterval) * time.Second
+}
+
+func (configure *Configure) maxRevisionAge() time.Duration {
+	return time.Duration(configure.MaxRevisionAge) * time.Second
+}
+
+func (configure *Configure) heartbeatInterval() time.Duration {
+	return time.Duration(configure.HeartbeatInterval) * time.Second
+}
+
+func (configure *Configure) healthPolicy() HealthPolicy {
+	return HealthPolicy{
+		FailureThreshold: configure.FailureThreshold,
+		SuccessThreshold: configure.SuccessThreshold,
+		MaxBackoff:       time.Duration(configure.MaxProbeBackoff) * time.Second,
+	}
+}
+
+func (configure *Configure) retryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: configure.PushMaxAttempts,
+		BaseBackoff: time.Duration(configure.PushBaseBackoff) * time.Second,
+		MaxBackoff:  time.Duration(configure.PushMaxBackoff) * time.Second,
+	}
+}
+
+// discoverySources 按配置创建discovery source
+func (configure *Configure) discoverySources() []DiscoverySource {
+	sources := make([]DiscoverySource, 0, len(configure.DiscoveryFiles)+len(configure.DiscoveryDNS))
+	for _, fileName := range configure.DiscoveryFiles {
+		sources = append(sources, NewFileSource(fileName))
+	}
+	for _, dns := range configure.DiscoveryDNS {
+		sources = append(sources, NewDNSSource(dns.Service, dns.Proto, dns.Domain, dns.Server, dns.Labels, configure.httpTimeout()))
+	}
+	return sources
+}
+
+func (configure *Configure) httpTimeout() time.Duration {
+	return time.Duration(configure.HttpTimeout) * time.Second
+}
+
+func (configure *Configure) shutdownTimeout() time.Duration {
+	return time.Duration(configure.ShutdownTimeout) * time.Second
+}
+
+// storage 按 Storage 创建配置的存储, bolt 数据库文件为 PersistDir 下的 boltFileName
+func (configure *Configure) storage() (Storage, error) {
+	switch configure.Storage {
+	case StorageBolt:
+		if err := os.MkdirAll(configure.PersistDir, 0755); err != nil {
+			return nil, err
+		}
+		return NewBoltStorage(filepath.Join(configure.PersistDir, boltFileName))
+	case StorageMemory:
+		return NewMemoryStorage(), nil
+	default:
+		return NewDirectoryStorage(configure.PersistDir), nil
+	}
+}
+
+func (configure *Configure) auditFile() string {
+	if len(configure.AuditFile) > 0 {
+		return configure.AuditFile
+	}
+	return filepath.Join(configure.LogDir, "audit.log")
+}
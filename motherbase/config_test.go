@@ -0,0 +1,231 @@
+package motherbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "motherbase.yaml")
+	content := `
+listen: ":9000"
+persist_dir: /data/save
+detector_interval: 5
+agents:
+  - host: 10.0.0.1
+    port: 8611
+    labels:
+      region: us
+`
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("MOTHERBASE_DETECTOR_INTERVAL", "7")
+	os.Setenv("MOTHERBASE_LISTEN", ":9001")
+	defer os.Unsetenv("MOTHERBASE_DETECTOR_INTERVAL")
+	defer os.Unsetenv("MOTHERBASE_LISTEN")
+
+	configure, err := LoadConfigure([]string{"-config", fileName, "-listen", ":9002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure.Listen != ":9002" || configure.PersistDir != "/data/save" || configure.DetectorInterval != 7 {
+		t.Fatalf("unexpected configure: %+v", configure)
+	}
+	if configure.DifferInterval != 15 || configure.LogDir != "log" {
+		t.Fatalf("defaults not kept: %+v", configure)
+	}
+	if len(configure.Agents) != 1 || configure.Agents[0].Labels["region"] != "us" {
+		t.Fatalf("unexpected agents: %+v", configure.Agents)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte("differ_interval: 30\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := configure.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.DifferInterval != 30 || reloaded.Listen != ":9002" {
+		t.Fatalf("unexpected reloaded configure: %+v", reloaded)
+	}
+
+	invalid := [][]string{
+		{"-detector_interval", "0"},
+		{"-log_level", "VERBOSE"},
+		{"-agents", "localhost:8611,localhost:8611"},
+		{"-listen", "12345"},
+	}
+	for _, args := range invalid {
+		if _, err := LoadConfigure(append([]string{"-config", ""}, args...)); err == nil {
+			t.Fatalf("expect error for %v", args)
+		}
+	}
+}
+
+func TestDiscoveryConfigure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "motherbase.yaml")
+	content := `
+persist_dir: ` + filepath.Join(directory, "save") + `
+log_dir: ` + filepath.Join(directory, "log") + `
+discovery_interval: 60
+discovery_files: [` + filepath.Join(directory, "bidders.yaml") + `]
+discovery_dns:
+  - service: bidder
+    proto: tcp
+    domain: example.com
+    server: 127.0.0.1:53
+    labels: {pool: adx}
+`
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configure, err := LoadConfigure([]string{"-config", fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure.DiscoveryInterval != 60 || len(configure.DiscoveryFiles) != 1 || len(configure.DiscoveryDNS) != 1 {
+		t.Fatalf("unexpected configure: %+v", configure)
+	}
+	server, err := NewServer(configure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusList := server.Gateway.Manager.ListDiscovery()
+	if len(statusList) != 2 || statusList[1].Source != "dns:_bidder._tcp.example.com" {
+		t.Fatalf("discovery sources not added: %+v", statusList)
+	}
+	if interval := server.Gateway.Manager.discoveryInterval(); interval != time.Minute {
+		t.Fatalf("expect 1m, got %v", interval)
+	}
+
+	invalid := [][]string{
+		{"-discovery_interval", "0"},
+	}
+	for _, args := range invalid {
+		if _, err := LoadConfigure(append([]string{"-config", ""}, args...)); err == nil {
+			t.Fatalf("expect error for %v", args)
+		}
+	}
+	configure.DiscoveryDNS[0].Proto = "sctp"
+	if err := configure.Validate(); err == nil {
+		t.Fatal("expect error for invalid dns proto")
+	}
+}
+
+func TestPolicyConfigure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	configure, err := LoadConfigure([]string{
+		"-persist_dir", filepath.Join(directory, "save"),
+		"-log_dir", filepath.Join(directory, "log"),
+		"-agents", "",
+		"-max_revisions", "3",
+		"-max_revision_age", "3600",
+		"-failure_threshold", "5",
+		"-push_max_attempts", "7",
+		"-push_base_backoff", "2",
+		"-heartbeat_interval", "20",
+		"-push_workers", "8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(configure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Apply(configure)
+	manager := server.Gateway.Manager
+	if cache := server.Gateway.Cache; cache.maxRevisions != 3 || cache.maxRevisionAge != time.Hour {
+		t.Fatalf("unexpected retention %v %v", cache.maxRevisions, cache.maxRevisionAge)
+	}
+	if policy := manager.health.policy; policy.FailureThreshold != 5 || policy.SuccessThreshold != DefaultSuccessThreshold {
+		t.Fatalf("unexpected health policy %+v", policy)
+	}
+	if policy := manager.pushes.policy; policy.MaxAttempts != 7 || policy.BaseBackoff != 2*time.Second || policy.MaxBackoff != DefaultPushMaxBackoff {
+		t.Fatalf("unexpected retry policy %+v", policy)
+	}
+	if interval := manager.heartbeat.getInterval(); interval != 20*time.Second {
+		t.Fatalf("unexpected heartbeat interval %v", interval)
+	}
+	if manager.pushWorkers != 8 || manager.agentPushLimit != DefaultAgentPushLimit {
+		t.Fatalf("unexpected concurrency %v %v", manager.pushWorkers, manager.agentPushLimit)
+	}
+
+	invalid := [][]string{
+		{"-max_revisions", "-1"},
+		{"-success_threshold", "0"},
+		{"-push_base_backoff", "600"},
+		{"-heartbeat_max_missed", "0"},
+		{"-agent_push_limit", "0"},
+	}
+	for _, args := range invalid {
+		if _, err := LoadConfigure(append([]string{"-config", ""}, args...)); err == nil {
+			t.Fatalf("expect error for %v", args)
+		}
+	}
+}
+
+func TestStorageConfigure(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-configure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "motherbase.yaml")
+	content := "storage: bolt\npersist_dir: " + filepath.Join(directory, "save") + "\n"
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configure, err := LoadConfigure([]string{"-config", fileName, "-log_dir", filepath.Join(directory, "log"), "-agents", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(configure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := server.Gateway.Cache
+	if _, ok := cache.storage.(*BoltStorage); !ok {
+		t.Fatalf("expect bolt storage, got %T", cache.storage)
+	}
+	if err := cache.Replace("agent1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "save", boltFileName)); err != nil {
+		t.Fatalf("bolt file not created: %v", err)
+	}
+
+	configure, err = LoadConfigure([]string{"-config", "", "-storage", StorageMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storage, err := configure.storage(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := storage.(*MemoryStorage); !ok {
+		t.Fatalf("expect memory storage, got %T", storage)
+	}
+	if _, err := LoadConfigure([]string{"-config", "", "-storage", "mysql"}); err == nil {
+		t.Fatal("expect error for unknown storage")
+	}
+}
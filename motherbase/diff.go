@@ -0,0 +1,327 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	ChangeAdd     = "add"
+	ChangeRemove  = "remove"
+	ChangeReplace = "replace"
+)
+
+// JSONChange 配置中一处变化, Path 形如 $.deals[0].price
+type JSONChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+/**
+* @brief 配置变化的预览: 与 BaseRevision 的结构差异, 以及Differ会推送的agent;
+*        BaseRevision 为0表示这是一个新配置
+ */
+type ConfigPreview struct {
+	Id           string       `json:"id"`
+	BaseRevision int64        `json:"base_revision,omitempty"`
+	BaseMd5sum   string       `json:"base_md5sum,omitempty"`
+	Md5sum       string       `json:"md5sum"`
+	Changes      []JSONChange `json:"changes"`
+	DoConfig     []string     `json:"doconfig"`
+	UnConfig     []string     `json:"unconfig"`
+}
+
+// NotFoundError 预览或删除的配置、revision不存在
+type NotFoundError struct {
+	message string
+}
+
+func (err *NotFoundError) Error() string {
+	return err.message
+}
+
+func notFound(err error) error {
+	return &NotFoundError{message: err.Error()}
+}
+
+// errorStatus 预览或删除失败的状态码: 配置或revision不存在为404, 其他为500; 参数错误在此之前返回400
+func errorStatus(err error) int {
+	if _, ok := err.(*NotFoundError); ok {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// diffJSON 比较两个 json.Unmarshal 得到的值, object按key, array按下标比较
+func diffJSON(old interface{}, new interface{}, path string) []JSONChange {
+	changes := make([]JSONChange, 0)
+	switch oldValue := old.(type) {
+	case map[string]interface{}:
+		if newValue, ok := new.(map[string]interface{}); ok {
+			names := make([]string, 0, len(oldValue)+len(newValue))
+			for name := range oldValue {
+				names = append(names, name)
+			}
+			for name := range newValue {
+				if _, ok := oldValue[name]; !ok {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				before, inOld := oldValue[name]
+				after, inNew := newValue[name]
+				switch {
+				case !inNew:
+					changes = append(changes, JSONChange{Path: path + "." + name, Op: ChangeRemove, Old: before})
+				case !inOld:
+					changes = append(changes, JSONChange{Path: path + "." + name, Op: ChangeAdd, New: after})
+				default:
+					changes = append(changes, diffJSON(before, after, path+"."+name)...)
+				}
+			}
+			return changes
+		}
+	case []interface{}:
+		if newValue, ok := new.([]interface{}); ok {
+			for index := 0; index < len(oldValue) || index < len(newValue); index++ {
+				itemPath := fmt.Sprintf("%v[%v]", path, index)
+				switch {
+				case index >= len(newValue):
+					changes = append(changes, JSONChange{Path: itemPath, Op: ChangeRemove, Old: oldValue[index]})
+				case index >= len(oldValue):
+					changes = append(changes, JSONChange{Path: itemPath, Op: ChangeAdd, New: newValue[index]})
+				default:
+					changes = append(changes, diffJSON(oldValue[index], newValue[index], itemPath)...)
+				}
+			}
+			return changes
+		}
+	}
+	if !reflect.DeepEqual(old, new) {
+		changes = append(changes, JSONChange{Path: path, Op: ChangeReplace, Old: old, New: new})
+	}
+	return changes
+}
+
+// diffDocuments 比较两个配置, 不是合法JSON时(如校验之前保存的配置)整体替换
+func diffDocuments(base string, exists bool, proposed string) []JSONChange {
+	newDocument, newErr := decodeDocument(proposed)
+	if !exists {
+		if newErr != nil {
+			return []JSONChange{{Path: "$", Op: ChangeAdd, New: proposed}}
+		}
+		return []JSONChange{{Path: "$", Op: ChangeAdd, New: newDocument}}
+	}
+	oldDocument, oldErr := decodeDocument(base)
+	if oldErr != nil || newErr != nil {
+		if base == proposed {
+			return make([]JSONChange, 0)
+		}
+		return []JSONChange{{Path: "$", Op: ChangeReplace, Old: base, New: proposed}}
+	}
+	return diffJSON(oldDocument, newDocument, "$")
+}
+
+/**
+* @brief 按Differ的期望状态计算, proposed 替换当前配置后哪些agent会收到推送;
+*        只考虑参与diff的agent, 以它们最近一次上报的配置为准, 不考虑rollout的分批
+*
+* @param proposed 替换后的配置
+*
+* @return 会收到DoConfig和UnConfig的agent, 读取配置列表失败时返回错误
+ */
+func (manager *AgentManager) previewPush(proposed CacheItemInfo) ([]string, []string, error) {
+	doConfig := make([]string, 0)
+	unConfig := make([]string, 0)
+	activatedAgents, err := manager.cache.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	hypothetical := []CacheItemInfo{proposed}
+	for _, info := range activatedAgents {
+		if info.id != proposed.id {
+			hypothetical = append(hypothetical, info)
+		}
+	}
+	for name := range manager.enabledSnapshot() {
+		wanted := false
+		for _, info := range desiredConfigs(hypothetical, manager.GetLabels(name)) {
+			if info.id == proposed.id {
+				wanted = true
+				break
+			}
+		}
+		md5sum, present := manager.status.snapshot(name).Configs[proposed.id]
+		switch {
+		case wanted && !strings.EqualFold(md5sum, proposed.md5sum):
+			doConfig = append(doConfig, name)
+		case !wanted && present:
+			unConfig = append(unConfig, name)
+		}
+	}
+	sort.Strings(doConfig)
+	sort.Strings(unConfig)
+	return doConfig, unConfig, nil
+}
+
+/**
+* @brief 预览用 config 替换配置的结果, 不保存也不推送
+*
+* @param id
+* @param config 替换后的配置
+* @param selector 替换后的selector
+* @param baseRevision 比较的revision, 0表示当前最新的revision
+*
+* @return 配置或revision不存在时返回 *NotFoundError
+ */
+func (gateway *AgentGateway) PreviewConfig(id string, config string, selector map[string]string, baseRevision int64) (*ConfigPreview, error) {
+	preview := &ConfigPreview{Id: id, Md5sum: Md5Sum([]byte(config))}
+	var base string
+	var err error
+	if baseRevision > 0 {
+		if base, err = gateway.Cache.GetRevision(id, baseRevision); err != nil {
+			return nil, notFound(err)
+		}
+		preview.BaseRevision = baseRevision
+	} else if info, infoErr := gateway.Cache.GetInfo(id); infoErr == nil {
+		if base, err = gateway.Cache.GetRevision(id, info.updateTimestamp); err != nil {
+			return nil, notFound(err)
+		}
+		preview.BaseRevision = info.updateTimestamp
+	}
+	if preview.BaseRevision > 0 {
+		preview.BaseMd5sum = Md5Sum([]byte(base))
+	}
+	preview.Changes = diffDocuments(base, preview.BaseRevision > 0, config)
+
+	meta := make(map[string]string)
+	if len(selector) > 0 {
+		meta[selectorMetaKey] = FormatLabels(selector)
+	}
+	if preview.DoConfig, preview.UnConfig, err = gateway.Manager.previewPush(CacheItemInfo{id: id, md5sum: preview.Md5sum, meta: meta}); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// PreviewRollback 预览回滚到 revision 的结果
+func (gateway *AgentGateway) PreviewRollback(id string, revision int64) (*ConfigPreview, error) {
+	config, err := gateway.Cache.GetRevision(id, revision)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	revisions, err := gateway.Cache.ListRevisions(id)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	var selector map[string]string
+	for _, info := range revisions {
+		if info.updateTimestamp == revision {
+			if selector, err = info.selector(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return gateway.PreviewConfig(id, config, selector, 0)
+}
+
+func (gateway *AgentGateway) writePreview(w http.ResponseWriter, preview *ConfigPreview) {
+	body, err := json.Marshal(preview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// dryRunConfig 校验配置并返回预览, 用于 /doconfig?dry_run=true
+func (gateway *AgentGateway) dryRunConfig(w http.ResponseWriter, req *http.Request, name string, config string, selector map[string]string) {
+	if err := gateway.Validator.Validate(name, config); err != nil {
+		if validationError, ok := err.(*ValidationError); ok {
+			writeValidationError(w, validationError)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		gateway.logger.Warning("dry run: " + err.Error())
+		return
+	}
+	preview, err := gateway.PreviewConfig(name, config, selector, 0)
+	if err != nil {
+		http.Error(w, "dry run failed: "+err.Error(), errorStatus(err))
+		gateway.logger.Warning("dry run failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("doConfig dry run done: name -- %v, changes -- %v, by -- %v", name, len(preview.Changes), PrincipalFrom(req).Name))
+	gateway.writePreview(w, preview)
+}
+
+/**
+* @brief eg: GET /diff?name=xxxxx&rev=1444735040 预览回滚到rev的变化;
+*        POST /diff?name=xxxxx&rev=1444735040&selector=region%3Dus 预览用body替换rev的变化,
+*        POST时rev可以省略, 表示与最新的revision比较; 都不会保存或推送
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) diffConfig(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive diff request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	revision, hasRevision, err := parseRevision(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	var preview *ConfigPreview
+	if req.Method == "POST" {
+		var selector map[string]string
+		var body []byte
+		if selector, err = ParseLabels(req.URL.Query().Get("selector")); err != nil {
+			http.Error(w, "invalid 'selector': "+err.Error(), http.StatusBadRequest)
+			gateway.logger.Warning("invalid 'selector': " + err.Error())
+			return
+		}
+		if req.ContentLength == 0 {
+			http.Error(w, "missing post 'body' for config "+name, http.StatusBadRequest)
+			gateway.logger.Warning("missing 'body'")
+			return
+		}
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			http.Error(w, "can't read body: "+err.Error(), http.StatusInternalServerError)
+			gateway.logger.Warning("can't read body: " + err.Error())
+			return
+		}
+		preview, err = gateway.PreviewConfig(name, string(body), selector, revision)
+	} else {
+		if !hasRevision {
+			http.Error(w, "missing 'rev'", http.StatusBadRequest)
+			gateway.logger.Warning("missing 'rev'")
+			return
+		}
+		preview, err = gateway.PreviewRollback(name, revision)
+	}
+	if err != nil {
+		http.Error(w, "diff failed: "+err.Error(), errorStatus(err))
+		gateway.logger.Warning("diff failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("diff request done: name -- %v, revision -- %v, changes -- %v, by -- %v", name, revision, len(preview.Changes), PrincipalFrom(req).Name))
+	gateway.writePreview(w, preview)
+}
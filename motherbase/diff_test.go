@@ -0,0 +1,124 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiffJSON(t *testing.T) {
+	changes := diffDocuments(`{"price": 1, "deals": [{"id": "d-1"}, {"id": "d-2"}], "currency": "USD"}`, true,
+		`{"price": 2, "deals": [{"id": "d-1", "price": 3}], "region": "us"}`)
+	paths := make([]string, 0)
+	for _, change := range changes {
+		paths = append(paths, change.Op+" "+change.Path)
+	}
+	expect := "remove $.currency,add $.deals[0].price,remove $.deals[1],replace $.price,add $.region"
+	if strings.Join(paths, ",") != expect {
+		t.Fatalf("expect %v, got %v", expect, paths)
+	}
+	if changes := diffDocuments("not json", true, "not json"); len(changes) != 0 {
+		t.Fatalf("unexpected changes %v", changes)
+	}
+}
+
+func TestConfigPreview(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	manager := gateway.Manager
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	defer manager.Quit()
+
+	bidder := newFakeBidder()
+	var instance Configurable = bidder
+	manager.NewAvailableAgent("bidder1", &instance, map[string]string{"region": "us"})
+	manager.EnableAgent("bidder1", &instance)
+	if err := gateway.NewConfig("agent1", `{"price": 1}`, nil, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	manager.runRound(nil, manager.enabledSnapshot())
+	manager.runRound(nil, manager.enabledSnapshot())
+	info, err := gateway.Cache.GetInfo("agent1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preview := func(req *http.Request) ConfigPreview {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, req)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%v: %v %v", req.URL, recorder.Code, recorder.Body.String())
+		}
+		result := ConfigPreview{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := preview(httptest.NewRequest("POST", "/doconfig?name=agent1&dry_run=true", strings.NewReader(`{"price": 2}`)))
+	if result.BaseRevision != info.updateTimestamp || len(result.Changes) != 1 || result.Changes[0].Path != "$.price" {
+		t.Fatalf("unexpected preview %+v", result)
+	}
+	if len(result.DoConfig) != 1 || result.DoConfig[0] != "bidder1" || len(result.UnConfig) != 0 {
+		t.Fatalf("unexpected push plan %+v", result)
+	}
+	if config, _ := gateway.Cache.Get("agent1"); config != `{"price": 1}` {
+		t.Fatalf("dry run should not save, got %v", config)
+	}
+
+	result = preview(httptest.NewRequest("POST", "/doconfig?name=agent1&dry_run=1&selector=region%3Deu", strings.NewReader(`{"price": 1}`)))
+	if len(result.Changes) != 0 || len(result.DoConfig) != 0 || len(result.UnConfig) != 1 {
+		t.Fatalf("selector should unconfig bidder1, got %+v", result)
+	}
+
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/doconfig?name=agent1&dry_run=true", strings.NewReader(`{"price":`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("malformed dry run: expect 400, got %v", recorder.Code)
+	}
+
+	if err := gateway.NewConfig("agent1", `{"price": 3}`, nil, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	result = preview(httptest.NewRequest("GET", fmt.Sprintf("/diff?name=agent1&rev=%v", info.updateTimestamp), nil))
+	if len(result.Changes) != 1 || result.Changes[0].Old != float64(3) || result.Changes[0].New != float64(1) {
+		t.Fatalf("unexpected rollback preview %+v", result)
+	}
+	if len(result.DoConfig) != 0 {
+		t.Fatalf("bidder1 already has revision %v, got %+v", info.updateTimestamp, result)
+	}
+
+	result = preview(httptest.NewRequest("POST", fmt.Sprintf("/diff?name=agent1&rev=%v", info.updateTimestamp), strings.NewReader(`{"price": 1, "currency": "USD"}`)))
+	if result.BaseRevision != info.updateTimestamp || len(result.Changes) != 1 || result.Changes[0].Op != ChangeAdd {
+		t.Fatalf("unexpected preview %+v", result)
+	}
+
+	for _, expect := range []struct {
+		method string
+		url    string
+		body   string
+		code   int
+	}{
+		{"GET", "/diff?name=agent1&rev=1", "", http.StatusNotFound},
+		{"GET", "/diff?name=agent2&rev=1", "", http.StatusNotFound},
+		{"POST", "/diff?name=agent1&rev=1", `{"price": 1}`, http.StatusNotFound},
+		{"GET", "/diff?name=agent1", "", http.StatusBadRequest},
+		{"GET", "/diff?name=agent1&rev=abc", "", http.StatusBadRequest},
+		{"POST", "/diff?name=agent1", "", http.StatusBadRequest},
+		{"POST", "/diff?name=agent1&selector=region", `{"price": 1}`, http.StatusBadRequest},
+	} {
+		recorder = httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest(expect.method, expect.url, strings.NewReader(expect.body)))
+		if recorder.Code != expect.code {
+			t.Fatalf("%v %v: expect %v, got %v", expect.method, expect.url, expect.code, recorder.Code)
+		}
+	}
+	if code := errorStatus(errors.New("storage unavailable")); code != http.StatusInternalServerError {
+		t.Fatalf("unexpected error: expect 500, got %v", code)
+	}
+}
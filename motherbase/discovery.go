@@ -0,0 +1,341 @@
+package motherbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const DefaultDiscoveryInterval = 30 * time.Second
+
+type DiscoveredAgent struct {
+	Host   string            `json:"host" yaml:"host"`
+	Port   int               `json:"port" yaml:"port"`
+	Bridge string            `json:"bridge,omitempty" yaml:"bridge"`
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels"`
+	TLS    *TLSFiles         `json:"tls,omitempty" yaml:"tls"`
+}
+
+func (agent *DiscoveredAgent) Name() string {
+	return AgentName(agent.Host, agent.Port)
+}
+
+// DiscoverySource 提供一组agent, 多个source的结果合并后同步到AgentManager
+type DiscoverySource interface {
+	Name() string
+	Discover() ([]DiscoveredAgent, error)
+}
+
+// FileSource 从YAML或JSON格式的清单文件中读取agent, 文件修改后重新读取, eg:
+//   - host: 10.0.0.1
+//     port: 8611
+//     labels: {region: us}
+//   - address: 10.0.0.2:8611
+type FileSource struct {
+	fileName string
+	modTime  time.Time
+	agents   []DiscoveredAgent
+}
+
+func NewFileSource(fileName string) *FileSource {
+	return &FileSource{
+		fileName: fileName,
+	}
+}
+
+func (source *FileSource) Name() string {
+	return "file:" + source.fileName
+}
+
+func (source *FileSource) Discover() ([]DiscoveredAgent, error) {
+	fileInfo, err := os.Stat(source.fileName)
+	if err != nil {
+		return nil, err
+	}
+	if source.agents != nil && fileInfo.ModTime().Equal(source.modTime) {
+		return source.agents, nil
+	}
+	content, err := ioutil.ReadFile(source.fileName)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]struct {
+		DiscoveredAgent `yaml:",inline"`
+		Address         string `yaml:"address"`
+	}, 0)
+	if err := yaml.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	agents := make([]DiscoveredAgent, 0, len(entries))
+	for _, entry := range entries {
+		agent := entry.DiscoveredAgent
+		if len(entry.Address) > 0 {
+			host, port, err := net.SplitHostPort(entry.Address)
+			if err != nil {
+				return nil, err
+			}
+			agent.Host = host
+			if agent.Port, err = strconv.Atoi(port); err != nil {
+				return nil, errors.New("invalid port in address " + entry.Address)
+			}
+		}
+		if len(agent.Host) == 0 || agent.Port <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid entry in %v: %+v", source.fileName, entry))
+		}
+		agents = append(agents, agent)
+	}
+	source.agents = agents
+	source.modTime = fileInfo.ModTime()
+	return agents, nil
+}
+
+// DNSSource 通过SRV记录发现agent, 查询超时为 timeout, server 为空时使用系统resolver,
+// 否则向指定的DNS服务器(如测试用的本地stub)查询
+type DNSSource struct {
+	service  string
+	proto    string
+	domain   string
+	labels   map[string]string
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+func NewDNSSource(service string, proto string, domain string, server string, labels map[string]string, timeout time.Duration) *DNSSource {
+	resolver := net.DefaultResolver
+	if len(server) > 0 {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				dialer := net.Dialer{Timeout: timeout}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &DNSSource{
+		service:  service,
+		proto:    proto,
+		domain:   domain,
+		labels:   labels,
+		timeout:  timeout,
+		resolver: resolver,
+	}
+}
+
+func (source *DNSSource) Name() string {
+	return fmt.Sprintf("dns:_%v._%v.%v", source.service, source.proto, source.domain)
+}
+
+func (source *DNSSource) Discover() ([]DiscoveredAgent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), source.timeout)
+	defer cancel()
+	_, records, err := source.resolver.LookupSRV(ctx, source.service, source.proto, source.domain)
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]DiscoveredAgent, 0, len(records))
+	for _, record := range records {
+		agents = append(agents, DiscoveredAgent{
+			Host:   strings.TrimSuffix(record.Target, "."),
+			Port:   int(record.Port),
+			Labels: source.labels,
+		})
+	}
+	return agents, nil
+}
+
+// DNSDiscovery 为配置文件中的一个SRV查询, 查询 _service._proto.domain
+type DNSDiscovery struct {
+	Service string            `yaml:"service"`
+	Proto   string            `yaml:"proto"`
+	Domain  string            `yaml:"domain"`
+	Server  string            `yaml:"server"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+func (dns *DNSDiscovery) Validate() error {
+	if len(dns.Service) == 0 || len(dns.Domain) == 0 {
+		return errors.New("dns discovery requires service and domain")
+	}
+	if dns.Proto != "tcp" && dns.Proto != "udp" {
+		return errors.New("dns discovery proto should be tcp or udp: " + dns.Proto)
+	}
+	if len(dns.Server) > 0 {
+		if _, _, err := net.SplitHostPort(dns.Server); err != nil {
+			return errors.New("invalid dns server " + dns.Server)
+		}
+	}
+	return nil
+}
+
+type DiscoveryStatus struct {
+	Source    string            `json:"source"`
+	Agents    []DiscoveredAgent `json:"agents"`
+	LastTime  *time.Time        `json:"last_time,omitempty"`
+	LastError string            `json:"last_error,omitempty"`
+}
+
+// discovery 记录每个source发现的agent, agent从所有source中消失后才会被删除,
+// 手工添加或心跳注册的agent不受影响
+type discovery struct {
+	interval time.Duration
+	sources  []DiscoverySource
+	status   map[string]*DiscoveryStatus
+	owned    map[string]map[string]DiscoveredAgent
+	// discovered 为上一轮由discovery添加并仍然存在的agent
+	discovered map[string]DiscoveredAgent
+	mutex      sync.Mutex
+}
+
+func newDiscovery() *discovery {
+	return &discovery{
+		interval: DefaultDiscoveryInterval,
+		sources:  make([]DiscoverySource, 0),
+		status:   make(map[string]*DiscoveryStatus),
+		owned:    make(map[string]map[string]DiscoveredAgent),
+
+		discovered: make(map[string]DiscoveredAgent),
+	}
+}
+
+func (manager *AgentManager) AddDiscoverySource(source DiscoverySource) {
+	manager.discovery.mutex.Lock()
+	defer manager.discovery.mutex.Unlock()
+	manager.discovery.sources = append(manager.discovery.sources, source)
+	manager.discovery.status[source.Name()] = &DiscoveryStatus{
+		Source: source.Name(),
+		Agents: make([]DiscoveredAgent, 0),
+	}
+}
+
+func (manager *AgentManager) SetDiscoveryInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("discovery interval should be positive")
+	}
+	manager.discovery.mutex.Lock()
+	defer manager.discovery.mutex.Unlock()
+	manager.discovery.interval = interval
+	return nil
+}
+
+func (manager *AgentManager) ListDiscovery() []DiscoveryStatus {
+	manager.discovery.mutex.Lock()
+	defer manager.discovery.mutex.Unlock()
+	statusList := make([]DiscoveryStatus, 0, len(manager.discovery.sources))
+	for _, source := range manager.discovery.sources {
+		statusList = append(statusList, *manager.discovery.status[source.Name()])
+	}
+	return statusList
+}
+
+// Discover 查询所有source并同步agent, 查询失败的source保留上一次的结果
+func (manager *AgentManager) Discover() {
+	manager.discovery.mutex.Lock()
+	sources := make([]DiscoverySource, len(manager.discovery.sources))
+	copy(sources, manager.discovery.sources)
+	manager.discovery.mutex.Unlock()
+
+	for _, source := range sources {
+		agents, err := source.Discover()
+		now := time.Now()
+		manager.discovery.mutex.Lock()
+		status := manager.discovery.status[source.Name()]
+		status.LastTime = &now
+		status.LastError = ""
+		if err != nil {
+			status.LastError = err.Error()
+			manager.discovery.mutex.Unlock()
+			manager.logger.Warning(fmt.Sprintf("discovery from %v failed: %v", source.Name(), err.Error()))
+			continue
+		}
+		status.Agents = agents
+		found := make(map[string]DiscoveredAgent, len(agents))
+		for _, agent := range agents {
+			found[agent.Name()] = agent
+		}
+		manager.discovery.owned[source.Name()] = found
+		manager.discovery.mutex.Unlock()
+	}
+
+	manager.discovery.mutex.Lock()
+	wanted := make(map[string]DiscoveredAgent)
+	for _, found := range manager.discovery.owned {
+		for name, agent := range found {
+			wanted[name] = agent
+		}
+	}
+	previous := manager.discovery.discovered
+	manager.discovery.mutex.Unlock()
+
+	// discovered 只记录由discovery添加的agent, 其他方式添加的同名agent不会被修改或删除
+	discovered := make(map[string]DiscoveredAgent)
+	names := make([]string, 0, len(wanted))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		agent := wanted[name]
+		_, owned := previous[name]
+		if manager.HasAgent(name) {
+			if owned {
+				manager.SetLabels(name, agent.Labels)
+				discovered[name] = agent
+			}
+			continue
+		}
+		instance, err := manager.newBridge(&agent)
+		if err != nil {
+			manager.logger.Warning(fmt.Sprintf("discovered agent %v: %v", name, err.Error()))
+			continue
+		}
+		manager.logger.Info("agent discovered: " + name)
+		manager.AddAgentWithLabels(name, &instance, agent.Labels)
+		manager.audit(AuditEntry{Action: AuditAgentAdd, Actor: actorDiscovery, Agent: name}, nil)
+		discovered[name] = agent
+	}
+	for name := range previous {
+		if _, ok := wanted[name]; !ok && manager.HasAgent(name) {
+			manager.logger.Info("agent disappeared from discovery: " + name)
+			manager.RemoveAgent(name, nil)
+			manager.audit(AuditEntry{Action: AuditAgentRemove, Actor: actorDiscovery, Agent: name}, nil)
+		}
+	}
+
+	manager.discovery.mutex.Lock()
+	manager.discovery.discovered = discovered
+	manager.discovery.mutex.Unlock()
+}
+
+func (manager *AgentManager) DiscoveryMonitor() {
+	manager.logger.Debug("enter discovery monitor")
+	defer manager.logger.Debug("leave discovery monitor")
+	defer manager.syncer.Done()
+
+	manager.Discover()
+	timer := time.NewTimer(manager.discoveryInterval())
+	for {
+		select {
+		case <-timer.C:
+			manager.Discover()
+			timer.Reset(manager.discoveryInterval())
+		case <-manager.quit:
+			return
+		}
+	}
+}
+
+func (manager *AgentManager) discoveryInterval() time.Duration {
+	manager.discovery.mutex.Lock()
+	defer manager.discovery.mutex.Unlock()
+	return manager.discovery.interval
+}
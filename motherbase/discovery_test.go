@@ -0,0 +1,161 @@
+package motherbase
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	fileName := filepath.Join(directory, "bidders.yaml")
+	inventory := `
+- host: 10.0.0.1
+  port: 8611
+  labels:
+    region: us
+- address: 10.0.0.2:8612
+`
+	if err := ioutil.WriteFile(fileName, []byte(inventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agents, err := NewFileSource(fileName).Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 || agents[0].Labels["region"] != "us" || agents[1].Name() != "10.0.0.2:8612" {
+		t.Fatalf("unexpected agents: %+v", agents)
+	}
+}
+
+// startDNSStub 启动一个本地UDP DNS服务, 对所有查询返回 target:port 的SRV记录
+func startDNSStub(t *testing.T, target string, port uint16) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			length, address, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if response := srvResponse(buffer[:length], target, port); response != nil {
+				conn.WriteTo(response, address)
+			}
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// srvResponse 复制查询的id和question, 追加一条SRV应答
+func srvResponse(query []byte, target string, port uint16) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	response := append([]byte{}, query[:2]...)
+	response = append(response, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0)
+	response = append(response, query[12:end]...)
+
+	rdata := []byte{0, 10, 0, 5, byte(port >> 8), byte(port)}
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		rdata = append(rdata, byte(len(label)))
+		rdata = append(rdata, label...)
+	}
+	rdata = append(rdata, 0)
+	// name 指向question, type SRV, class IN, ttl 60
+	response = append(response, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(response, rdata...)
+}
+
+func TestDNSSource(t *testing.T) {
+	server, stop := startDNSStub(t, "bidder1.example.com.", 8611)
+	defer stop()
+	source := NewDNSSource("bidder", "tcp", "example.com", server, map[string]string{"pool": "adx"}, HttpTimeout)
+	if name := source.Name(); name != "dns:_bidder._tcp.example.com" {
+		t.Fatalf("unexpected name %v", name)
+	}
+	agents, err := source.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Name() != "bidder1.example.com:8611" || agents[0].Labels["pool"] != "adx" {
+		t.Fatalf("unexpected agents: %+v", agents)
+	}
+}
+
+func TestDiscoveryKeepsStaticAgent(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	gateway, auditLog := startHeartbeatGateway(t, time.Hour)
+	manager := gateway.Manager
+	defer manager.Quit()
+
+	var instance Configurable = newFakeBidder()
+	manager.AddAgentWithLabels("10.0.0.1:8611", &instance, map[string]string{"region": "eu"})
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("static agent not added")
+	}
+
+	fileName := filepath.Join(directory, "bidders.yaml")
+	inventory := `
+- host: 10.0.0.1
+  port: 8611
+  labels:
+    region: us
+- host: 10.0.0.2
+  port: 8611
+`
+	if err := ioutil.WriteFile(fileName, []byte(inventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manager.AddDiscoverySource(NewFileSource(fileName))
+	manager.Discover()
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.2:8611") }) {
+		t.Fatal("discovered agent not added")
+	}
+	if labels := manager.GetLabels("10.0.0.1:8611"); labels["region"] != "eu" {
+		t.Fatalf("static agent relabeled: %v", labels)
+	}
+
+	if err := ioutil.WriteFile(fileName, []byte("[]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(time.Minute)
+	if err := os.Chtimes(fileName, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	manager.Discover()
+	if !waitFor(func() bool { return !manager.HasAgent("10.0.0.2:8611") }) {
+		t.Fatal("discovered agent not removed")
+	}
+	if !manager.HasAgent("10.0.0.1:8611") {
+		t.Fatal("static agent removed by discovery")
+	}
+	if labels := manager.GetLabels("10.0.0.1:8611"); labels["region"] != "eu" {
+		t.Fatalf("static agent relabeled: %v", labels)
+	}
+	if actions := auditActions(t, auditLog, "10.0.0.1:8611"); actions != "" {
+		t.Fatalf("unexpected discovery audit for static agent: %v", actions)
+	}
+}
@@ -1,41 +1,383 @@
 package motherbase
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/yangzhao28/phantom/commonlog"
+)
+
+const DefaultPersistDir = "save"
 
 type AgentGateway struct {
-	Cache   *PersistCache
-	Manager *AgentManager
+	Cache     *PersistCache
+	Manager   *AgentManager
+	Validator *Validator
+	logger    *logging.Logger
+	auth      *Authenticator
+	mux       *http.ServeMux
+	stopped   chan struct{}
+
+	// 配置文件中的agent, 重新加载配置时只删除这些agent
+	configured      map[string]bool
+	configuredMutex sync.Mutex
+}
+
+type gatewayOptions struct {
+	storage       Storage
+	cache         *PersistCache
+	manager       *AgentManager
+	auditLog      AuditLog
+	validator     *Validator
+	auth          *Authenticator
+	httpLogger    *logging.Logger
+	managerLogger *logging.Logger
+	cacheLogger   *logging.Logger
+}
+
+type GatewayOption func(options *gatewayOptions)
+
+// WithPersistDir 使用目录存储配置, 默认为 DefaultPersistDir
+func WithPersistDir(directory string) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.storage = NewDirectoryStorage(directory)
+	}
+}
+
+func WithStorage(storage Storage) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.storage = storage
+	}
+}
+
+// WithCache 使用已有的cache, 忽略 WithStorage 和 WithPersistDir
+func WithCache(cache *PersistCache) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.cache = cache
+	}
+}
+
+// WithManager 使用已有的manager, 未指定cache时使用manager的cache
+func WithManager(manager *AgentManager) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.manager = manager
+	}
+}
+
+// WithValidator 使用已有的配置校验, 默认只校验JSON格式
+func WithValidator(validator *Validator) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.validator = validator
+	}
+}
+
+// WithAuditLog 记录配置修改, agent变化和推送的审计日志
+func WithAuditLog(auditLog AuditLog) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.auditLog = auditLog
+	}
+}
+
+// WithAuthenticator 对API做认证和权限检查, 默认不认证
+func WithAuthenticator(auth *Authenticator) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.auth = auth
+	}
+}
+
+// WithLoggers 分别指定http, manager和cache的日志
+func WithLoggers(httpLogger *logging.Logger, managerLogger *logging.Logger, cacheLogger *logging.Logger) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.httpLogger = httpLogger
+		options.managerLogger = managerLogger
+		options.cacheLogger = cacheLogger
+	}
 }
 
-func NewAgentGateway() *AgentGateway {
-	cache := NewPersistCache("save")
-	manager := NewAgentManager(cache)
+// WithLogDir 在logDir下为http, manager和cache创建日志文件
+func WithLogDir(logDir string, level logging.Level) GatewayOption {
+	return func(options *gatewayOptions) {
+		options.httpLogger = commonlog.NewLogger(httpModule, logDir, level)
+		options.managerLogger = commonlog.NewLogger(managerModule, logDir, level)
+		options.cacheLogger = commonlog.NewLogger(cacheModule, logDir, level)
+	}
+}
 
-	return &AgentGateway{
-		Cache:   cache,
-		Manager: manager,
+/**
+* @brief 创建gateway, 默认使用 DefaultPersistDir 目录存储, 日志只输出到控制台
+*
+* @param options
+*
+* @return
+ */
+func NewAgentGateway(options ...GatewayOption) *AgentGateway {
+	gatewayOptions := &gatewayOptions{}
+	for _, option := range options {
+		option(gatewayOptions)
+	}
+	cache := gatewayOptions.cache
+	if cache == nil && gatewayOptions.manager != nil {
+		cache = gatewayOptions.manager.cache
+	}
+	if cache == nil {
+		storage := gatewayOptions.storage
+		if storage == nil {
+			storage = NewDirectoryStorage(DefaultPersistDir)
+		}
+		cache = NewPersistCacheWithStorage(storage)
+	}
+	if gatewayOptions.cacheLogger != nil {
+		cache.SetLogger(gatewayOptions.cacheLogger)
 	}
+	manager := gatewayOptions.manager
+	if manager == nil {
+		manager = NewAgentManager(cache)
+	}
+	if gatewayOptions.managerLogger != nil {
+		manager.SetLogger(gatewayOptions.managerLogger)
+	}
+	if gatewayOptions.auditLog != nil {
+		manager.SetAuditLog(gatewayOptions.auditLog)
+	}
+	logger := gatewayOptions.httpLogger
+	if logger == nil {
+		logger = defaultLogger(httpModule)
+	}
+
+	validator := gatewayOptions.validator
+	if validator == nil {
+		validator = NewValidator()
+	}
+	gateway := &AgentGateway{
+		Cache:      cache,
+		Manager:    manager,
+		Validator:  validator,
+		logger:     logger,
+		auth:       gatewayOptions.auth,
+		stopped:    make(chan struct{}),
+		configured: make(map[string]bool),
+	}
+	gateway.mux = gateway.routes()
+	return gateway
+}
+
+// Handler 返回gateway的所有API
+func (gateway *AgentGateway) Handler() http.Handler {
+	return gateway.mux
+}
+
+func AgentName(host string, port int) string {
+	return fmt.Sprintf("%v:%v", host, port)
 }
 
-func (gateway *AgentGateway) NewAgent(host string, port int) error {
-	var agent Configurable
-	agent = NewBidderHttpBridge(host, port)
-	name := fmt.Sprintf("%v:%v", host, port)
-	gateway.Manager.AddAgent(name, &agent)
+// NewAgent 添加agent, bridgeType 为空时使用http, 同名agent已存在时返回 *ConflictError
+func (gateway *AgentGateway) NewAgent(host string, port int, bridgeType string, labels map[string]string, actor string) error {
+	if len(host) == 0 {
+		return errors.New("empty host")
+	}
+	if port <= 0 || port > 65535 {
+		return errors.New(fmt.Sprintf("invalid port %v", port))
+	}
+	name := AgentName(host, port)
+	agent, err := gateway.Manager.newBridge(&DiscoveredAgent{Host: host, Port: port, Bridge: bridgeType})
+	if err != nil {
+		return err
+	}
+	if err := gateway.Manager.CreateAgent(name, &agent, labels); err != nil {
+		return err
+	}
+	gateway.Manager.audit(AuditEntry{Action: AuditAgentAdd, Actor: actor, Agent: name}, nil)
+	gateway.logger.Info(fmt.Sprintf("agent %v added by %v", name, actor))
 	return nil
 }
 
-func (gateway *AgentGateway) NewConfig(id string, config string) error {
-	if err := gateway.Cache.Replace(id, config); err != nil {
+func (gateway *AgentGateway) Heartbeat(heartbeat *Heartbeat, actor string) error {
+	if len(heartbeat.Host) == 0 {
+		return errors.New("empty host")
+	}
+	if heartbeat.Port <= 0 || heartbeat.Port > 65535 {
+		return errors.New(fmt.Sprintf("invalid port %v", heartbeat.Port))
+	}
+	agent, err := gateway.Manager.newBridge(&DiscoveredAgent{Host: heartbeat.Host, Port: heartbeat.Port, Bridge: heartbeat.Bridge})
+	if err != nil {
 		return err
 	}
+	name := AgentName(heartbeat.Host, heartbeat.Port)
+	if gateway.Manager.Heartbeat(name, &agent, heartbeat.Labels) {
+		gateway.Manager.audit(AuditEntry{Action: AuditAgentAdd, Actor: actor, Agent: name}, nil)
+	}
+	gateway.logger.Debug(fmt.Sprintf("heartbeat of %v by %v", name, actor))
 	return nil
 }
 
+func (gateway *AgentGateway) RemoveAgent(name string, actor string) error {
+	if !gateway.Manager.HasAgent(name) {
+		return errors.New("agent " + name + " not exist")
+	}
+	gateway.Manager.RemoveAgent(name, nil)
+	gateway.Manager.audit(AuditEntry{Action: AuditAgentRemove, Actor: actor, Agent: name}, nil)
+	gateway.logger.Info(fmt.Sprintf("agent %v removed by %v", name, actor))
+	return nil
+}
+
+/**
+* @brief 同步配置文件中的agent: 添加新的agent, 更新标签, 删除配置中已移除的agent,
+*        心跳和discovery添加的agent不受影响
+*
+* @param agents
+*
+* @return 第一个添加失败的错误, 其余agent仍会继续同步
+ */
+func (gateway *AgentGateway) SyncAgents(agents []DiscoveredAgent) error {
+	gateway.configuredMutex.Lock()
+	defer gateway.configuredMutex.Unlock()
+	var firstErr error
+	configured := make(map[string]bool)
+	for _, agent := range agents {
+		name := agent.Name()
+		configured[name] = true
+		if gateway.Manager.HasAgent(name) {
+			gateway.Manager.SetLabels(name, agent.Labels)
+			continue
+		}
+		bridge, err := gateway.Manager.newBridge(&agent)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		gateway.Manager.AddAgentWithLabels(name, &bridge, agent.Labels)
+		gateway.Manager.audit(AuditEntry{Action: AuditAgentAdd, Actor: actorConfigure, Agent: name}, nil)
+	}
+	for name := range gateway.configured {
+		if !configured[name] {
+			gateway.Manager.RemoveAgent(name, nil)
+			gateway.Manager.audit(AuditEntry{Action: AuditAgentRemove, Actor: actorConfigure, Agent: name}, nil)
+		}
+	}
+	gateway.configured = configured
+	return firstErr
+}
+
+// NewConfig 保存配置, selector 为空时配置会推送到所有agent, actor 记录为该revision的修改者
+func (gateway *AgentGateway) NewConfig(id string, config string, selector map[string]string, actor string) error {
+	meta := map[string]string{authorMetaKey: actor}
+	if len(selector) > 0 {
+		meta[selectorMetaKey] = FormatLabels(selector)
+	}
+	entry := AuditEntry{Action: AuditDoConfig, Actor: actor, Id: id, Before: gateway.currentMd5(id), After: Md5Sum([]byte(config))}
+	if err := gateway.Validator.Validate(id, config); err != nil {
+		gateway.Manager.audit(entry, err)
+		return err
+	}
+	if err := gateway.Cache.ReplaceWithMeta(id, config, meta); err != nil {
+		gateway.Manager.audit(entry, err)
+		return err
+	}
+	gateway.auditSaved(entry)
+	gateway.logger.Info(fmt.Sprintf("config %v saved by %v", id, actor))
+	return gateway.Manager.StartRollout(id)
+}
+
+func (gateway *AgentGateway) Rollback(id string, revision int64, actor string) error {
+	entry := AuditEntry{Action: AuditRollback, Actor: actor, Id: id, Before: gateway.currentMd5(id)}
+	if err := gateway.Cache.RollbackBy(id, revision, actor); err != nil {
+		gateway.Manager.audit(entry, err)
+		return err
+	}
+	gateway.auditSaved(entry)
+	gateway.logger.Info(fmt.Sprintf("config %v rolled back to %v by %v", id, revision, actor))
+	return gateway.Manager.StartRollout(id)
+}
+
+func (gateway *AgentGateway) currentMd5(id string) string {
+	if info, err := gateway.Cache.GetInfo(id); err == nil {
+		return info.md5sum
+	}
+	return ""
+}
+
+// auditSaved 记录保存成功后的md5和revision
+func (gateway *AgentGateway) auditSaved(entry AuditEntry) {
+	if info, err := gateway.Cache.GetInfo(entry.Id); err == nil {
+		entry.After = info.md5sum
+		entry.Revision = info.updateTimestamp
+	}
+	gateway.Manager.audit(entry, nil)
+}
+
+type DeleteResult struct {
+	Name         string            `json:"name"`
+	Acknowledged []string          `json:"acknowledged"`
+	Failed       map[string]string `json:"failed"`
+}
+
+// DeleteConfig 从cache中删除配置, 并在所有enable的agent上立即UnConfig,
+// 失败的agent由Differ在下一轮继续清理
+func (gateway *AgentGateway) DeleteConfig(id string, actor string) (*DeleteResult, error) {
+	if _, err := gateway.Cache.Get(id); err != nil {
+		return nil, notFound(err)
+	}
+	entry := AuditEntry{Action: AuditDelete, Actor: actor, Id: id, Before: gateway.currentMd5(id)}
+	if err := gateway.Cache.Remove(id); err != nil {
+		gateway.Manager.audit(entry, err)
+		return nil, err
+	}
+	gateway.Manager.audit(entry, nil)
+	gateway.logger.Info(fmt.Sprintf("config %v deleted by %v", id, actor))
+	gateway.Manager.CancelRollout(id)
+	result := &DeleteResult{
+		Name:         id,
+		Acknowledged: make([]string, 0),
+		Failed:       make(map[string]string),
+	}
+	for name, err := range gateway.Manager.UnConfigAll(id) {
+		gateway.Manager.audit(AuditEntry{Action: AuditPushUn, Actor: actor, Id: id, Agent: name, Before: entry.Before}, err)
+		if err != nil {
+			result.Failed[name] = err.Error()
+		} else {
+			result.Acknowledged = append(result.Acknowledged, name)
+		}
+	}
+	sort.Strings(result.Acknowledged)
+	return result, nil
+}
+
 func (gateway *AgentGateway) Quit() {
 	gateway.Manager.Quit()
 }
 
+// Go 阻塞运行agent manager, Quit 之后等所有推送结束才返回
 func (gateway *AgentGateway) Go() {
+	defer close(gateway.stopped)
 	gateway.Manager.Go()
 }
+
+/**
+* @brief 停止agent manager, 等待进行中的推送完成后关闭cache
+*
+* @param timeout 等待manager退出的最长时间
+*
+* @return 超时返回错误, 此时cache不会被关闭
+ */
+func (gateway *AgentGateway) Shutdown(timeout time.Duration) error {
+	gateway.Quit()
+	select {
+	case <-gateway.stopped:
+	case <-time.After(timeout):
+		return errors.New(fmt.Sprintf("agent manager not stopped in %v", timeout))
+	}
+	if closer, ok := gateway.Manager.auditLog.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return gateway.Cache.Close()
+}
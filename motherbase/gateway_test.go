@@ -0,0 +1,234 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTwoGatewaysInOneProcess(t *testing.T) {
+	first := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	second := NewAgentGateway(WithStorage(NewMemoryStorage()))
+
+	request := httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`))
+	recorder := httptest.NewRecorder()
+	first.Handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("doconfig failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+
+	for _, expect := range []struct {
+		gateway *AgentGateway
+		count   int
+	}{{first, 1}, {second, 0}} {
+		recorder := httptest.NewRecorder()
+		expect.gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/listconfig", nil))
+		var items []map[string]interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &items); err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != expect.count {
+			t.Fatalf("expect %v config(s), got %v", expect.count, items)
+		}
+	}
+}
+
+func TestAgentEndpoints(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	manager := gateway.Manager
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.syncer.Add(1)
+	go manager.Controller()
+	defer manager.Quit()
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		return recorder
+	}
+
+	for _, target := range []string{"/addagent?host=localhost&port=8611", "/removeagent?name=localhost:8611", "/deleteconfig?name=agent1", "/rollback?name=agent1&rev=1"} {
+		recorder := serve("GET", target)
+		if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != "POST, DELETE" {
+			t.Fatalf("GET %v: expect 405, got %v %v", target, recorder.Code, recorder.Header())
+		}
+	}
+	if manager.HasAgent("localhost:8611") {
+		t.Fatal("GET should not add agent")
+	}
+
+	for target, code := range map[string]int{
+		"/addagent?port=8611":                              http.StatusBadRequest,
+		"/addagent?host=localhost&port=x":                  http.StatusBadRequest,
+		"/addagent?host=localhost&port=8611&labels=region": http.StatusBadRequest,
+		"/addagent?host=localhost&port=0":                  http.StatusBadRequest,
+		"/addagent?host=localhost&port=8611&bridge=ftp":    http.StatusBadRequest,
+	} {
+		if recorder := serve("POST", target); recorder.Code != code {
+			t.Fatalf("%v: expect %v, got %v %v", target, code, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	if recorder := serve("POST", "/addagent?host=localhost&port=8611&labels=region%3Dus"); recorder.Code != http.StatusOK {
+		t.Fatalf("addagent failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+	waitFor(func() bool { return manager.HasAgent("localhost:8611") })
+	if recorder := serve("POST", "/addagent?host=localhost&port=8611"); recorder.Code != http.StatusConflict {
+		t.Fatalf("duplicated agent: expect 409, got %v", recorder.Code)
+	}
+
+	var agents []AgentInfo
+	if err := json.Unmarshal(serve("GET", "/listagent").Body.Bytes(), &agents); err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Name != "localhost:8611" || agents[0].Bridge != "http" || agents[0].Labels["region"] != "us" || agents[0].Enabled {
+		t.Fatalf("unexpected agents %+v", agents)
+	}
+	info := AgentInfo{}
+	if err := json.Unmarshal(serve("GET", "/getagent?name=localhost:8611").Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Host != "localhost" || info.Port != 8611 || !info.Available {
+		t.Fatalf("unexpected agent %+v", info)
+	}
+
+	if recorder := serve("DELETE", "/removeagent?name=localhost:8611"); recorder.Code != http.StatusOK {
+		t.Fatalf("removeagent failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+	waitFor(func() bool { return !manager.HasAgent("localhost:8611") })
+	if recorder := serve("GET", "/getagent?name=localhost:8611"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("removed agent: expect 404, got %v", recorder.Code)
+	}
+	if recorder := serve("POST", "/removeagent?name=localhost:8611"); recorder.Code != http.StatusNotFound {
+		t.Fatalf("remove unknown agent: expect 404, got %v", recorder.Code)
+	}
+}
+
+func TestDeleteConfig(t *testing.T) {
+	auditLog := NewMemoryAuditLog()
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithAuditLog(auditLog))
+	manager := gateway.Manager
+	if err := gateway.NewConfig("agent1", `{"price": 1}`, nil, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	md5sum := Md5Sum([]byte(`{"price": 1}`))
+	bidders := make(map[string]*fakeBidder)
+	for _, name := range []string{"bidder1", "bidder2", "bidder3"} {
+		bidder := newFakeBidder()
+		bidder.configs["agent1"] = md5sum
+		bidders[name] = bidder
+		var instance Configurable = bidder
+		manager.NewAvailableAgent(name, &instance, nil)
+		if name != "bidder3" {
+			manager.EnableAgent(name, &instance)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("DELETE", "/deleteconfig?name=agent1", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("deleteconfig failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+	result := DeleteResult{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(result.Acknowledged, ",") != "bidder1,bidder2" || len(result.Failed) != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if _, err := gateway.Cache.Get("agent1"); err == nil {
+		t.Fatal("config should be removed from cache")
+	}
+	for name, bidder := range bidders {
+		_, exists := bidder.configs["agent1"]
+		if exists != (name == "bidder3") {
+			t.Fatalf("%v: unexpected configs %v", name, bidder.configs)
+		}
+	}
+
+	entries, err := auditLog.Query(AuditFilter{Id: "agent1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]string, 0)
+	for _, entry := range entries[1:] {
+		actions = append(actions, entry.Action+" "+entry.Agent+" "+entry.Outcome)
+		if entry.Actor != anonymous.Name || entry.Before != md5sum {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+	}
+	sort.Strings(actions[1:])
+	expect := "delete  succeeded,push_unconfig bidder1 succeeded,push_unconfig bidder2 succeeded"
+	if strings.Join(actions, ",") != expect {
+		t.Fatalf("expect audit %v, got %v", expect, actions)
+	}
+
+	recorder = httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/deleteconfig?name=agent1", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("delete unknown config: expect 404, got %v", recorder.Code)
+	}
+}
+
+// failingRemoveStorage 删除时返回存储错误
+type failingRemoveStorage struct {
+	Storage
+}
+
+func (storage *failingRemoveStorage) Remove(id string, revision int64) error {
+	return errors.New("disk unavailable")
+}
+
+func TestDeleteConfigStorageFailure(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(&failingRemoveStorage{NewMemoryStorage()}))
+	if err := gateway.NewConfig("agent1", `{"price": 1}`, nil, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("DELETE", "/deleteconfig?name=agent1", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Fatalf("storage failure: expect 500, got %v %v", recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("DELETE", "/deleteconfig?name=agent2", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("delete unknown config: expect 404, got %v", recorder.Code)
+	}
+}
+
+func TestAddAgentConflict(t *testing.T) {
+	gateway, auditLog := startHeartbeatGateway(t, time.Hour)
+	defer gateway.Manager.Quit()
+	serve := func(target string) int {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", target, nil))
+		return recorder.Code
+	}
+
+	codes := make(chan int, 8)
+	waitForDone := sync.WaitGroup{}
+	for i := 0; i < cap(codes); i++ {
+		waitForDone.Add(1)
+		go func() {
+			defer waitForDone.Done()
+			codes <- serve("/addagent?host=10.0.0.1&port=8611")
+		}()
+	}
+	waitForDone.Wait()
+	close(codes)
+	count := make(map[int]int)
+	for code := range codes {
+		count[code]++
+	}
+	if count[http.StatusOK] != 1 || count[http.StatusConflict] != cap(codes)-1 {
+		t.Fatalf("expect one add and conflicts, got %v", count)
+	}
+	if actions := auditActions(t, auditLog, "10.0.0.1:8611"); actions != AuditAgentAdd+"/"+anonymous.Name {
+		t.Fatalf("expect one add audit, got %v", actions)
+	}
+}
@@ -0,0 +1,230 @@
+package motherbase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	HealthHealthy    = "healthy"
+	HealthSuspect    = "suspect"
+	HealthDown       = "down"
+	HealthRecovering = "recovering"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultSuccessThreshold = 2
+	DefaultMaxProbeBackoff  = 5 * time.Minute
+)
+
+// HealthPolicy 连续失败 FailureThreshold 次进入down, 连续成功 SuccessThreshold 次恢复healthy,
+// down的agent探活间隔指数增长, 最大为 MaxBackoff
+type HealthPolicy struct {
+	FailureThreshold int
+	SuccessThreshold int
+	MaxBackoff       time.Duration
+}
+
+func (policy *HealthPolicy) Validate() error {
+	if policy.FailureThreshold <= 0 || policy.SuccessThreshold <= 0 {
+		return errors.New("health thresholds should be positive")
+	}
+	if policy.MaxBackoff < 0 {
+		return errors.New("max probe backoff should not be negative")
+	}
+	return nil
+}
+
+type HealthEvent struct {
+	Agent string    `json:"agent"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+type agentHealth struct {
+	state     string
+	failures  int
+	successes int
+	downCount int
+	nextProbe time.Time
+}
+
+// healthTracker 维护每个agent的健康状态机, healthy和suspect的agent参与diff
+type healthTracker struct {
+	policy      HealthPolicy
+	agents      map[string]*agentHealth
+	subscribers map[int]chan HealthEvent
+	nextId      int
+	logger      *logging.Logger
+	mutex       sync.Mutex
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		policy: HealthPolicy{
+			FailureThreshold: DefaultFailureThreshold,
+			SuccessThreshold: DefaultSuccessThreshold,
+			MaxBackoff:       DefaultMaxProbeBackoff,
+		},
+		agents:      make(map[string]*agentHealth),
+		subscribers: make(map[int]chan HealthEvent),
+		logger:      defaultLogger(managerModule),
+	}
+}
+
+func (tracker *healthTracker) setPolicy(policy HealthPolicy) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.policy = policy
+}
+
+// get 新agent处于recovering且只差一次成功, 首次探活成功即可参与diff
+func (tracker *healthTracker) get(name string) *agentHealth {
+	health, ok := tracker.agents[name]
+	if !ok {
+		health = &agentHealth{
+			state:     HealthRecovering,
+			successes: tracker.policy.SuccessThreshold - 1,
+		}
+		tracker.agents[name] = health
+	}
+	return health
+}
+
+func (tracker *healthTracker) shouldProbe(name string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return !time.Now().Before(tracker.get(name).nextProbe)
+}
+
+/**
+* @brief 根据一次探活结果推进状态机
+*
+* @param name
+* @param err 探活结果
+* @param round 探活周期, 用于计算down状态下的退避时间
+*
+* @return 是否应参与diff
+ */
+func (tracker *healthTracker) observe(name string, err error, round time.Duration) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	health := tracker.get(name)
+	from := health.state
+	if err == nil {
+		health.failures = 0
+		health.successes++
+		switch health.state {
+		case HealthSuspect:
+			health.state = HealthHealthy
+		case HealthDown, HealthRecovering:
+			health.state = HealthRecovering
+			if health.successes >= tracker.policy.SuccessThreshold {
+				health.state = HealthHealthy
+			}
+		}
+		if health.state != HealthDown {
+			health.downCount = 0
+			health.nextProbe = time.Time{}
+		}
+	} else {
+		health.successes = 0
+		health.failures++
+		switch health.state {
+		case HealthHealthy, HealthSuspect:
+			health.state = HealthSuspect
+			if health.failures >= tracker.policy.FailureThreshold {
+				health.state = HealthDown
+			}
+		case HealthRecovering:
+			health.state = HealthDown
+		}
+		if health.state == HealthDown {
+			backoff := round << uint(health.downCount)
+			if backoff > tracker.policy.MaxBackoff || backoff <= 0 {
+				backoff = tracker.policy.MaxBackoff
+			}
+			if health.downCount < 30 {
+				health.downCount++
+			}
+			health.nextProbe = time.Now().Add(backoff)
+		}
+	}
+	if from != health.state {
+		event := HealthEvent{
+			Agent: name,
+			From:  from,
+			To:    health.state,
+			Time:  time.Now(),
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		tracker.logger.Info(fmt.Sprintf("agent %v health %v -> %v", name, from, health.state))
+		tracker.publish(event)
+	}
+	return health.state == HealthHealthy || health.state == HealthSuspect
+}
+
+// publish 不阻塞, 订阅者处理不及时时丢弃事件
+func (tracker *healthTracker) publish(event HealthEvent) {
+	for _, subscriber := range tracker.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			tracker.logger.Warning(fmt.Sprintf("health event dropped: %v %v -> %v", event.Agent, event.From, event.To))
+		}
+	}
+}
+
+func (tracker *healthTracker) subscribe() (<-chan HealthEvent, func()) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	id := tracker.nextId
+	tracker.nextId++
+	subscriber := make(chan HealthEvent, 64)
+	tracker.subscribers[id] = subscriber
+	return subscriber, func() {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+		if _, ok := tracker.subscribers[id]; ok {
+			delete(tracker.subscribers, id)
+			close(subscriber)
+		}
+	}
+}
+
+func (tracker *healthTracker) state(name string) string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if health, ok := tracker.agents[name]; ok {
+		return health.state
+	}
+	return ""
+}
+
+func (tracker *healthTracker) forget(name string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.agents, name)
+}
+
+func (manager *AgentManager) SetHealthPolicy(policy HealthPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	manager.health.setPolicy(policy)
+	return nil
+}
+
+// SubscribeHealth 订阅agent健康状态变化, 不再需要时调用返回的函数取消订阅
+func (manager *AgentManager) SubscribeHealth() (<-chan HealthEvent, func()) {
+	return manager.health.subscribe()
+}
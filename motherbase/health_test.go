@@ -0,0 +1,42 @@
+package motherbase
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthStateMachine(t *testing.T) {
+	tracker := newHealthTracker()
+	tracker.setPolicy(HealthPolicy{FailureThreshold: 2, SuccessThreshold: 2, MaxBackoff: time.Minute})
+	events, cancel := tracker.subscribe()
+	defer cancel()
+	failure := errors.New("timeout")
+
+	if !tracker.observe("a", nil, time.Second) || tracker.state("a") != HealthHealthy {
+		t.Fatalf("first success should be healthy, got %v", tracker.state("a"))
+	}
+	if !tracker.observe("a", failure, time.Second) || tracker.state("a") != HealthSuspect {
+		t.Fatalf("one failure should be suspect, got %v", tracker.state("a"))
+	}
+	if tracker.observe("a", failure, time.Second) || tracker.state("a") != HealthDown {
+		t.Fatalf("two failures should be down, got %v", tracker.state("a"))
+	}
+	if tracker.shouldProbe("a") {
+		t.Fatal("down agent should back off")
+	}
+	if tracker.observe("a", nil, time.Second) || tracker.state("a") != HealthRecovering {
+		t.Fatalf("one success should be recovering, got %v", tracker.state("a"))
+	}
+	if !tracker.observe("a", nil, time.Second) || tracker.state("a") != HealthHealthy {
+		t.Fatalf("two successes should be healthy, got %v", tracker.state("a"))
+	}
+
+	expected := []string{HealthHealthy, HealthSuspect, HealthDown, HealthRecovering, HealthHealthy}
+	for _, state := range expected {
+		event := <-events
+		if event.To != state {
+			t.Fatalf("expect event to %v, got %v", state, event.To)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package motherbase
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHeartbeatInterval  = 10 * time.Second
+	DefaultHeartbeatMaxMissed = 3
+)
+
+// Heartbeat 为bidder主动上报的注册信息
+type Heartbeat struct {
+	Host   string            `json:"host"`
+	Port   int               `json:"port"`
+	Bridge string            `json:"bridge"`
+	Labels map[string]string `json:"labels"`
+}
+
+// heartbeatTracker 记录通过心跳注册的agent最后一次心跳的时间,
+// 静态添加的agent不受心跳超时影响
+type heartbeatTracker struct {
+	interval  time.Duration
+	maxMissed int
+	lastSeen  map[string]time.Time
+	mutex     sync.Mutex
+}
+
+func newHeartbeatTracker() *heartbeatTracker {
+	return &heartbeatTracker{
+		interval:  DefaultHeartbeatInterval,
+		maxMissed: DefaultHeartbeatMaxMissed,
+		lastSeen:  make(map[string]time.Time),
+	}
+}
+
+func (tracker *heartbeatTracker) setPolicy(interval time.Duration, maxMissed int) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.interval = interval
+	tracker.maxMissed = maxMissed
+}
+
+func (tracker *heartbeatTracker) getInterval() time.Duration {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.interval
+}
+
+// beat 记录心跳, 返回是否为首次心跳
+func (tracker *heartbeatTracker) beat(name string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	_, ok := tracker.lastSeen[name]
+	tracker.lastSeen[name] = time.Now()
+	return !ok
+}
+
+// tracking 判断agent是否由心跳注册
+func (tracker *heartbeatTracker) tracking(name string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	_, ok := tracker.lastSeen[name]
+	return ok
+}
+
+func (tracker *heartbeatTracker) forget(name string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.lastSeen, name)
+}
+
+// expired 返回连续 maxMissed 个周期没有心跳的agent并停止跟踪
+func (tracker *heartbeatTracker) expired() []string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	deadline := time.Now().Add(-tracker.interval * time.Duration(tracker.maxMissed))
+	names := make([]string, 0)
+	for name, lastSeen := range tracker.lastSeen {
+		if lastSeen.Before(deadline) {
+			names = append(names, name)
+			delete(tracker.lastSeen, name)
+		}
+	}
+	return names
+}
+
+func NewBridge(bridgeType string, host string, port int) (Configurable, error) {
+	return NewBridgeWithTLS(bridgeType, host, port, nil, HttpTimeout)
+}
+
+// NewBridgeWithTLS 创建bridge, "https" 类型使用 tlsConfig, 为nil时使用系统CA
+func NewBridgeWithTLS(bridgeType string, host string, port int, tlsConfig *tls.Config, timeout time.Duration) (Configurable, error) {
+	switch bridgeType {
+	case "", "http":
+		return NewBidderHttpBridgeWithTimeout(host, port, timeout), nil
+	case "https":
+		return NewBidderHttpsBridge(host, port, tlsConfig, timeout), nil
+	default:
+		return nil, errors.New("unsupported bridge type: " + bridgeType)
+	}
+}
+
+// SetBridgeTLS 设置https bridge默认的TLS配置, agent自带 TLS 时使用agent的配置
+func (manager *AgentManager) SetBridgeTLS(tlsConfig *tls.Config) {
+	manager.bridgeMutex.Lock()
+	defer manager.bridgeMutex.Unlock()
+	manager.bridgeTLS = tlsConfig
+}
+
+// SetBridgeTimeout 设置之后创建的bridge请求bidder的超时时间
+func (manager *AgentManager) SetBridgeTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("bridge timeout should be positive")
+	}
+	manager.bridgeMutex.Lock()
+	defer manager.bridgeMutex.Unlock()
+	manager.bridgeTimeout = timeout
+	return nil
+}
+
+func (manager *AgentManager) newBridge(agent *DiscoveredAgent) (Configurable, error) {
+	manager.bridgeMutex.Lock()
+	tlsConfig := manager.bridgeTLS
+	timeout := manager.bridgeTimeout
+	manager.bridgeMutex.Unlock()
+	if agent.TLS != nil {
+		var err error
+		if tlsConfig, err = NewClientTLSConfig(*agent.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return NewBridgeWithTLS(agent.Bridge, agent.Host, agent.Port, tlsConfig, timeout)
+}
+
+func (manager *AgentManager) SetHeartbeatPolicy(interval time.Duration, maxMissed int) error {
+	if interval <= 0 || maxMissed <= 0 {
+		return errors.New("heartbeat interval and max missed should be positive")
+	}
+	manager.heartbeat.setPolicy(interval, maxMissed)
+	return nil
+}
+
+/**
+* @brief 处理agent心跳, 首次心跳时添加agent, 之后更新标签;
+*        已经静态添加或由discovery发现的agent只记录心跳时间, 不会因心跳超时被删除
+*
+* @param name
+* @param instance
+* @param labels
+*
+* @return 本次心跳是否注册了agent
+ */
+func (manager *AgentManager) Heartbeat(name string, instance *Configurable, labels map[string]string) bool {
+	manager.status.recordHeartbeat(name)
+	if manager.HasAgent(name) && !manager.heartbeat.tracking(name) {
+		manager.logger.Debug("heartbeat of static agent " + name)
+		return false
+	}
+	if manager.heartbeat.beat(name) {
+		manager.logger.Info("agent registered by heartbeat: " + name)
+		manager.AddAgentWithLabels(name, instance, labels)
+		return true
+	}
+	manager.SetLabels(name, labels)
+	return false
+}
+
+func (manager *AgentManager) HeartbeatMonitor() {
+	manager.logger.Debug("enter heartbeat monitor")
+	defer manager.logger.Debug("leave heartbeat monitor")
+	defer manager.syncer.Done()
+
+	timer := time.NewTimer(manager.heartbeat.getInterval())
+	for {
+		select {
+		case <-timer.C:
+			for _, name := range manager.heartbeat.expired() {
+				manager.logger.Warning(fmt.Sprintf("agent %v missed heartbeats, set unavailable", name))
+				manager.RemoveAgent(name, nil)
+				manager.audit(AuditEntry{Action: AuditAgentRemove, Actor: actorHeartbeat, Agent: name}, nil)
+			}
+			timer.Reset(manager.heartbeat.getInterval())
+		case <-manager.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package motherbase
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHeartbeatGateway 启动处理agent事件和心跳超时的routine
+func startHeartbeatGateway(t *testing.T, interval time.Duration) (*AgentGateway, *MemoryAuditLog) {
+	auditLog := NewMemoryAuditLog()
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithAuditLog(auditLog))
+	manager := gateway.Manager
+	if err := manager.SetHeartbeatPolicy(interval, 2); err != nil {
+		t.Fatal(err)
+	}
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.syncer.Add(2)
+	go manager.Controller()
+	go manager.HeartbeatMonitor()
+	return gateway, auditLog
+}
+
+func sendHeartbeat(t *testing.T, gateway *AgentGateway, body string) {
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/heartbeat", strings.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("heartbeat failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+}
+
+func auditActions(t *testing.T, auditLog *MemoryAuditLog, agent string) string {
+	entries, err := auditLog.Query(AuditFilter{Agent: agent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		actions = append(actions, entry.Action+"/"+entry.Actor)
+	}
+	return strings.Join(actions, ",")
+}
+
+func waitFor(condition func() bool) bool {
+	for retry := 0; retry < 200; retry++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestHeartbeatRegistration(t *testing.T) {
+	gateway, auditLog := startHeartbeatGateway(t, time.Hour)
+	manager := gateway.Manager
+	defer manager.Quit()
+
+	sendHeartbeat(t, gateway, `{"host": "10.0.0.1", "port": 8611, "labels": {"region": "us"}}`)
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("agent not registered by heartbeat")
+	}
+	sendHeartbeat(t, gateway, `{"host": "10.0.0.1", "port": 8611, "labels": {"region": "eu"}}`)
+	if labels := manager.GetLabels("10.0.0.1:8611"); labels["region"] != "eu" {
+		t.Fatalf("labels not updated: %v", labels)
+	}
+	if actions := auditActions(t, auditLog, "10.0.0.1:8611"); actions != AuditAgentAdd+"/"+anonymous.Name {
+		t.Fatalf("expect one agent_add, got %v", actions)
+	}
+	status, err := manager.GetAgentStatus("10.0.0.1:8611")
+	if err != nil || status.LastHeartbeat == nil {
+		t.Fatalf("heartbeat not recorded: %+v %v", status, err)
+	}
+
+	for _, body := range []string{`{"port": 8611}`, `{"host": "10.0.0.1", "port": 0}`, `{"host": "10.0.0.1", "port": 8611, "bridge": "ftp"}`, `not json`} {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/heartbeat", strings.NewReader(body)))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expect 400, got %v", body, recorder.Code)
+		}
+	}
+}
+
+func TestHeartbeatExpiry(t *testing.T) {
+	gateway, auditLog := startHeartbeatGateway(t, 10*time.Millisecond)
+	manager := gateway.Manager
+	defer manager.Quit()
+
+	sendHeartbeat(t, gateway, `{"host": "10.0.0.1", "port": 8611}`)
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("agent not registered by heartbeat")
+	}
+	if !waitFor(func() bool { return !manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("agent should expire after missed heartbeats")
+	}
+	expect := AuditAgentAdd + "/" + anonymous.Name + "," + AuditAgentRemove + "/" + actorHeartbeat
+	if actions := auditActions(t, auditLog, "10.0.0.1:8611"); actions != expect {
+		t.Fatalf("expect %v, got %v", expect, actions)
+	}
+
+	// 超时删除之后的心跳重新注册
+	sendHeartbeat(t, gateway, `{"host": "10.0.0.1", "port": 8611}`)
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("agent not registered again")
+	}
+}
+
+func TestHeartbeatOfStaticAgent(t *testing.T) {
+	gateway, auditLog := startHeartbeatGateway(t, 10*time.Millisecond)
+	manager := gateway.Manager
+	defer manager.Quit()
+
+	if err := gateway.NewAgent("10.0.0.1", 8611, "", map[string]string{"region": "us"}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return manager.HasAgent("10.0.0.1:8611") }) {
+		t.Fatal("static agent not added")
+	}
+	sendHeartbeat(t, gateway, `{"host": "10.0.0.1", "port": 8611, "labels": {"region": "eu"}}`)
+
+	// 等待超过心跳超时, 静态agent不应被删除
+	time.Sleep(100 * time.Millisecond)
+	if !manager.HasAgent("10.0.0.1:8611") {
+		t.Fatal("static agent should not expire")
+	}
+	if labels := manager.GetLabels("10.0.0.1:8611"); labels["region"] != "us" {
+		t.Fatalf("heartbeat should not change labels of static agent: %v", labels)
+	}
+	if actions := auditActions(t, auditLog, "10.0.0.1:8611"); actions != AuditAgentAdd+"/alice" {
+		t.Fatalf("expect only the static agent_add, got %v", actions)
+	}
+	status, _ := manager.GetAgentStatus("10.0.0.1:8611")
+	if status.LastHeartbeat == nil {
+		t.Fatal("heartbeat of static agent should still be recorded")
+	}
+}
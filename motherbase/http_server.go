@@ -2,107 +2,702 @@ package motherbase
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-
-	"github.com/yangzhao28/phantom/commonlog"
+	"strconv"
+	"time"
 )
 
-var httpLogger = commonlog.NewLogger("httpserver", "log", commonlog.DEBUG)
-
-var manager = NewAgentGateway()
-
-func ListConfig(w http.ResponseWriter, req *http.Request) {
-	httpLogger.Debug("receive getconfig request from", req.Host)
-	itemList, err := manager.Cache.List()
+func (gateway *AgentGateway) listConfig(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive getconfig request from", req.Host)
+	// 先取resume token再list, 客户端从这个位置开始watch不会漏掉变化
+	token := gateway.Manager.WatchToken()
+	itemList, err := gateway.Cache.List()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		httpLogger.Warning(err.Error())
+		gateway.logger.Warning(err.Error())
 		return
 	}
 	body, err := json.Marshal(itemList)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		httpLogger.Warning(err.Error())
+		gateway.logger.Warning(err.Error())
 		return
 	}
+	w.Header().Set(RevisionHeader, token)
 	w.Write(body)
 }
 
-func GetConfig(w http.ResponseWriter, req *http.Request) {
-	httpLogger.Debug("receive getconfig request from", req.Host)
+func parseRevision(req *http.Request) (int64, bool, error) {
+	value := req.URL.Query().Get("rev")
+	if len(value) == 0 {
+		return 0, false, nil
+	}
+	revision, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("invalid 'rev'")
+	}
+	return revision, true, nil
+}
+
+/**
+* @brief eg: /getconfig?name=xxxxx or /getconfig?name=xxxxx&rev=1444735040
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) getConfig(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive getconfig request from", req.Host)
 	name := req.URL.Query().Get("name")
 	if len(name) == 0 {
 		http.Error(w, "missing 'name'", http.StatusBadRequest)
-		httpLogger.Warning("missing 'name'")
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	revision, hasRevision, err := parseRevision(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning(err.Error())
 		return
 	}
-	body, err := manager.Cache.Get(name)
+	var body string
+	if hasRevision {
+		body, err = gateway.Cache.GetRevision(name, revision)
+	} else {
+		body, err = gateway.Cache.Get(name)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
-		httpLogger.Warning(err.Error())
+		gateway.logger.Warning(err.Error())
 		return
 	}
 	io.WriteString(w, body)
 }
 
 /**
-* @brief eg: /doconfig?name=xxxxx
+* @brief eg: /listrevision?name=xxxxx
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) listRevision(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive listrevision request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	itemList, err := gateway.Cache.ListRevisions(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	body, err := json.Marshal(itemList)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+/**
+* @brief eg: POST /rollback?name=xxxxx&rev=1444735040
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) rollback(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive rollback request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	revision, hasRevision, err := parseRevision(req)
+	if err != nil || !hasRevision {
+		http.Error(w, "missing or invalid 'rev'", http.StatusBadRequest)
+		gateway.logger.Warning("missing or invalid 'rev'")
+		return
+	}
+	if err := gateway.Rollback(name, revision, PrincipalFrom(req).Name); err != nil {
+		http.Error(w, "rollback failed: "+err.Error(), http.StatusNotFound)
+		gateway.logger.Warning("rollback failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("rollback request done: name -- %v, revision -- %v, by -- %v", name, revision, PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
+
+/**
+* @brief eg: POST /doconfig?name=xxxxx or POST /doconfig?name=xxxxx&selector=region%3Dus,pool%3Dadx,
+*        带selector时只推送到标签匹配的agent; body 需要通过校验,
+*        不是合法JSON时返回400, 不符合schema或校验规则时返回422及字段错误;
+*        带 dry_run=true 时只校验并返回预览(同 /diff), 不保存也不推送
 *
 * @param http.ResponseWriter
 * @param http.Request
 *
 * @return
  */
-func DoConfig(w http.ResponseWriter, req *http.Request) {
-	httpLogger.Debug("receive doconfig request from", req.Host)
+func (gateway *AgentGateway) doConfig(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive doconfig request from", req.Host)
 	name := req.URL.Query().Get("name")
 	if len(name) == 0 {
 		http.Error(w, "missing 'name'", http.StatusBadRequest)
-		httpLogger.Warning("missing 'name'")
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	selector, err := ParseLabels(req.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, "invalid 'selector': "+err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning("invalid 'selector': " + err.Error())
 		return
 	}
 	if req.ContentLength == 0 {
 		http.Error(w, "missing post 'body' for config "+name, http.StatusBadRequest)
-		httpLogger.Warning("missing 'body'")
+		gateway.logger.Warning("missing 'body'")
 		return
 	}
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		http.Error(w, "can't read body: "+err.Error(), http.StatusInternalServerError)
-		httpLogger.Warning("can't read body: " + err.Error())
+		gateway.logger.Warning("can't read body: " + err.Error())
+		return
+	}
+	if dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run")); dryRun {
+		gateway.dryRunConfig(w, req, name, string(body), selector)
 		return
 	}
-	if err := manager.NewConfig(name, string(body)); err != nil {
+	if err := gateway.NewConfig(name, string(body), selector, PrincipalFrom(req).Name); err != nil {
+		if validationError, ok := err.(*ValidationError); ok {
+			writeValidationError(w, validationError)
+			gateway.logger.Warning(err.Error())
+			return
+		}
 		http.Error(w, "save failed: "+err.Error(), http.StatusInternalServerError)
-		httpLogger.Warning("save failed: " + err.Error())
+		gateway.logger.Warning("save failed: " + err.Error())
+		return
+	}
+	gateway.logger.Debug(fmt.Sprintf("name: %v, body: %s", name, body))
+	gateway.logger.Info(fmt.Sprintf("doConfig request done: name -- %v, body length -- %v, by -- %v", name, len(body), PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
+
+/**
+* @brief eg: POST /deleteconfig?name=xxxxx or DELETE /deleteconfig?name=xxxxx
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) deleteConfig(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive deleteconfig request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	result, err := gateway.DeleteConfig(name, PrincipalFrom(req).Name)
+	if err != nil {
+		http.Error(w, "delete failed: "+err.Error(), errorStatus(err))
+		gateway.logger.Warning("delete failed: " + err.Error())
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("deleteConfig request done: name -- %v, acknowledged -- %v, failed -- %v, by -- %v",
+		name, len(result.Acknowledged), len(result.Failed), PrincipalFrom(req).Name))
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) quarantine(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive quarantine request from", req.Host)
+	entries, err := gateway.Cache.Quarantine()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+/**
+* @brief GET 返回当前rollout策略, POST 设置策略,
+*        eg: {"canary_count": 1, "waves": [25, 50, 100], "pause_seconds": 60, "wave_timeout_seconds": 600}
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) rolloutPolicy(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive rolloutpolicy request from", req.Host)
+	if req.Method == "POST" {
+		if req = gateway.authorize(w, req, RoleOperator); req == nil {
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "can't read body: "+err.Error(), http.StatusInternalServerError)
+			gateway.logger.Warning("can't read body: " + err.Error())
+			return
+		}
+		policy := RolloutPolicy{}
+		if err := json.Unmarshal(body, &policy); err != nil {
+			http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+			gateway.logger.Warning("invalid policy: " + err.Error())
+			return
+		}
+		if err := gateway.Manager.SetRolloutPolicy(policy); err != nil {
+			http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+			gateway.logger.Warning("invalid policy: " + err.Error())
+			return
+		}
+		gateway.logger.Info(fmt.Sprintf("rolloutPolicy request done: %s, by -- %v", body, PrincipalFrom(req).Name))
+	}
+	body, err := json.Marshal(gateway.Manager.GetRolloutPolicy())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) listRollout(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive listrollout request from", req.Host)
+	body, err := json.Marshal(gateway.Manager.ListRollouts())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+/**
+* @brief eg: POST /resumerollout?name=xxxxx, 继续被停止的rollout
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) resumeRollout(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive resumerollout request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	if err := gateway.Manager.ResumeRollout(name); err != nil {
+		http.Error(w, "resume failed: "+err.Error(), http.StatusConflict)
+		gateway.logger.Warning("resume failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("resumeRollout request done: name -- %v, by -- %v", name, PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
+
+/**
+* @brief eg: POST /promoterollout?name=xxxxx, 跳过剩余批次推送到所有agent
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) promoteRollout(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive promoterollout request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	if err := gateway.Manager.PromoteRollout(name); err != nil {
+		http.Error(w, "promote failed: "+err.Error(), http.StatusNotFound)
+		gateway.logger.Warning("promote failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("promoteRollout request done: name -- %v, by -- %v", name, PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
+
+/**
+* @brief 列出等待重试和已放弃(dead letter)的推送
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) listPush(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive listpush request from", req.Host)
+	pending, dead := gateway.Manager.ListPushes()
+	body, err := json.Marshal(map[string][]PushOperation{
+		"pending": pending,
+		"dead":    dead,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) lastRound(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive lastround request from", req.Host)
+	body, err := json.Marshal(gateway.Manager.LastRound())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) pushHistory(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive pushhistory request from", req.Host)
+	body, err := json.Marshal(gateway.Manager.PushHistory())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
 		return
 	}
-	httpLogger.Debug(fmt.Sprintf("name: %v, body: %s", name, body))
-	httpLogger.Info(fmt.Sprintf("doConfig request done: name -- %v, body length -- %v", name, len(body)))
+	w.Write(body)
+}
+
+/**
+* @brief eg: POST /requeuepush?agent=host:port&name=xxxxx, 重试dead letter中的推送
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) requeuePush(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive requeuepush request from", req.Host)
+	agent := req.URL.Query().Get("agent")
+	name := req.URL.Query().Get("name")
+	if len(agent) == 0 || len(name) == 0 {
+		http.Error(w, "missing 'agent' or 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'agent' or 'name'")
+		return
+	}
+	if err := gateway.Manager.RequeuePush(agent, name); err != nil {
+		http.Error(w, "requeue failed: "+err.Error(), http.StatusNotFound)
+		gateway.logger.Warning("requeue failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("requeuePush request done: agent -- %v, name -- %v, by -- %v", agent, name, PrincipalFrom(req).Name))
 	io.WriteString(w, "done.\n")
 }
 
-func CreateServer() {
-	go manager.Go()
+/**
+* @brief eg: POST /addagent?host=xxxxx&port=8611&labels=region%3Dus,pool%3Dadx&bridge=https,
+*        bridge 默认为http, https使用配置中的 bridge_tls; 参数错误返回400, agent已存在返回409
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) addAgent(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive addagent request from", req.Host)
+	host := req.URL.Query().Get("host")
+	if len(host) == 0 {
+		http.Error(w, "missing 'host'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'host'")
+		return
+	}
+	port, err := strconv.Atoi(req.URL.Query().Get("port"))
+	if err != nil {
+		http.Error(w, "invalid 'port'", http.StatusBadRequest)
+		gateway.logger.Warning("invalid 'port'")
+		return
+	}
+	labels, err := ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		http.Error(w, "invalid 'labels': "+err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning("invalid 'labels': " + err.Error())
+		return
+	}
+	if err := gateway.NewAgent(host, port, req.URL.Query().Get("bridge"), labels, PrincipalFrom(req).Name); err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*ConflictError); ok {
+			status = http.StatusConflict
+		} else if err == errManagerQuit {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "add agent failed: "+err.Error(), status)
+		gateway.logger.Warning("add agent failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("addAgent request done: name -- %v, by -- %v", AgentName(host, port), PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
 
-	manager.NewAgent("localhost", 8611)
+/**
+* @brief eg: /listdiscovery, 返回每个discovery source发现的agent和最近一次的错误
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) listDiscovery(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive listdiscovery request from", req.Host)
+	body, err := json.Marshal(gateway.Manager.ListDiscovery())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
 
-	if err := manager.Cache.Clean(); err != nil {
-		httpLogger.Warning("something wrong when clean save files")
+/**
+* @brief bidder定时POST心跳, 首次心跳时注册,
+*        eg: POST /heartbeat {"host": "10.0.0.1", "port": 8611, "bridge": "http", "labels": {"region": "us"}}
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) heartbeat(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive heartbeat request from", req.Host)
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "can't read body: "+err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning("can't read body: " + err.Error())
+		return
 	}
-	if err := manager.Cache.Reload(); err != nil {
-		httpLogger.Warning("something wrong when clean save files")
+	heartbeat := &Heartbeat{}
+	if err := json.Unmarshal(body, heartbeat); err != nil {
+		http.Error(w, "invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning("invalid heartbeat: " + err.Error())
+		return
+	}
+	if err := gateway.Heartbeat(heartbeat, PrincipalFrom(req).Name); err != nil {
+		http.Error(w, "invalid heartbeat: "+err.Error(), http.StatusBadRequest)
+		gateway.logger.Warning("invalid heartbeat: " + err.Error())
+		return
 	}
-	http.HandleFunc("/listconfig", ListConfig)
-	http.HandleFunc("/getconfig", GetConfig)
-	http.HandleFunc("/doconfig", DoConfig)
-	httpLogger.Notice("port: 12345")
-	err := http.ListenAndServe(":12345", nil)
+	io.WriteString(w, "done.\n")
+}
+
+/**
+* @brief eg: POST /removeagent?name=host:port
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) removeAgent(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive removeagent request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	if err := gateway.RemoveAgent(name, PrincipalFrom(req).Name); err != nil {
+		http.Error(w, "remove agent failed: "+err.Error(), http.StatusNotFound)
+		gateway.logger.Warning("remove agent failed: " + err.Error())
+		return
+	}
+	gateway.logger.Info(fmt.Sprintf("removeAgent request done: name -- %v, by -- %v", name, PrincipalFrom(req).Name))
+	io.WriteString(w, "done.\n")
+}
+
+func (gateway *AgentGateway) listAgent(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive listagent request from", req.Host)
+	token := gateway.Manager.WatchToken()
+	body, err := json.Marshal(gateway.Manager.ListAgents())
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Header().Set(RevisionHeader, token)
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) getAgent(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive getagent request from", req.Host)
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		http.Error(w, "missing 'name'", http.StatusBadRequest)
+		gateway.logger.Warning("missing 'name'")
+		return
+	}
+	info, err := gateway.Manager.GetAgent(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
 	}
+	w.Write(body)
+}
+
+/**
+* @brief eg: /agentstatus or /agentstatus?name=host:port
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) agentStatus(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive agentstatus request from", req.Host)
+	var result interface{}
+	name := req.URL.Query().Get("name")
+	if len(name) == 0 {
+		result = gateway.Manager.ListAgentStatus()
+	} else {
+		status, err := gateway.Manager.GetAgentStatus(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			gateway.logger.Warning(err.Error())
+			return
+		}
+		result = status
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+/**
+* @brief eg: /audit?id=xxxxx&agent=host:port&since=1500000000&until=1500003600&limit=100,
+*        since/until 为unix时间(秒), 所有参数都可以省略
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) queryAudit(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive audit request from", req.Host)
+	query := req.URL.Query()
+	filter := AuditFilter{
+		Id:    query.Get("id"),
+		Agent: query.Get("agent"),
+	}
+	for key, value := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if len(query.Get(key)) == 0 {
+			continue
+		}
+		seconds, err := strconv.ParseInt(query.Get(key), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid '"+key+"'", http.StatusBadRequest)
+			gateway.logger.Warning("invalid '" + key + "'")
+			return
+		}
+		*value = time.Unix(seconds, 0)
+	}
+	if len(query.Get("limit")) > 0 {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid 'limit'", http.StatusBadRequest)
+			gateway.logger.Warning("invalid 'limit'")
+			return
+		}
+		filter.Limit = limit
+	}
+	entries, err := gateway.Manager.QueryAudit(filter)
+	if err != nil {
+		http.Error(w, "query audit failed: "+err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning("query audit failed: " + err.Error())
+		return
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Write(body)
+}
+
+// metrics 以Prometheus文本格式输出运行指标
+func (gateway *AgentGateway) metrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := gateway.Manager.Metrics().Expose(w); err != nil {
+		gateway.logger.Warning("write metrics: " + err.Error())
+	}
+}
+
+// routes 注册所有API, 查询需要 RoleReadOnly, 修改配置需要 RoleOperator, 管理agent需要 RoleAdmin,
+// 心跳需要 RoleAgent 或 RoleAdmin;
+// 修改状态的API只接受POST和DELETE
+func (gateway *AgentGateway) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	gateway.handle(mux, "/listconfig", RoleReadOnly, gateway.listConfig)
+	gateway.handle(mux, "/getconfig", RoleReadOnly, gateway.getConfig)
+	gateway.handle(mux, "/doconfig", RoleOperator, gateway.doConfig, mutatingMethods...)
+	gateway.handle(mux, "/deleteconfig", RoleOperator, gateway.deleteConfig, mutatingMethods...)
+	gateway.handle(mux, "/listrevision", RoleReadOnly, gateway.listRevision)
+	gateway.handle(mux, "/rollback", RoleOperator, gateway.rollback, mutatingMethods...)
+	gateway.handle(mux, "/quarantine", RoleReadOnly, gateway.quarantine)
+	gateway.handle(mux, "/rolloutpolicy", RoleReadOnly, gateway.rolloutPolicy)
+	gateway.handle(mux, "/listrollout", RoleReadOnly, gateway.listRollout)
+	gateway.handle(mux, "/resumerollout", RoleOperator, gateway.resumeRollout, mutatingMethods...)
+	gateway.handle(mux, "/promoterollout", RoleOperator, gateway.promoteRollout, mutatingMethods...)
+	gateway.handle(mux, "/listpush", RoleReadOnly, gateway.listPush)
+	gateway.handle(mux, "/pushhistory", RoleReadOnly, gateway.pushHistory)
+	gateway.handle(mux, "/requeuepush", RoleOperator, gateway.requeuePush, mutatingMethods...)
+	gateway.handle(mux, "/lastround", RoleReadOnly, gateway.lastRound)
+	gateway.handle(mux, "/addagent", RoleAdmin, gateway.addAgent, mutatingMethods...)
+	gateway.handle(mux, "/removeagent", RoleAdmin, gateway.removeAgent, mutatingMethods...)
+	gateway.handle(mux, "/listagent", RoleReadOnly, gateway.listAgent)
+	gateway.handle(mux, "/getagent", RoleReadOnly, gateway.getAgent)
+	gateway.handle(mux, "/heartbeat", RoleAgent, gateway.heartbeat, mutatingMethods...)
+	gateway.handle(mux, "/listdiscovery", RoleReadOnly, gateway.listDiscovery)
+	gateway.handle(mux, "/agentstatus", RoleReadOnly, gateway.agentStatus)
+	gateway.handle(mux, "/audit", RoleReadOnly, gateway.queryAudit)
+	gateway.handle(mux, "/metrics", RoleReadOnly, gateway.metrics)
+	gateway.handle(mux, "/watch", RoleReadOnly, gateway.watch)
+	gateway.handle(mux, "/diff", RoleReadOnly, gateway.diffConfig)
+	return mux
 }
@@ -0,0 +1,72 @@
+package motherbase
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	selectorMetaKey = "selector"
+	authorMetaKey   = "author"
+)
+
+// ParseLabels 解析 "key=value,key=value" 格式的标签或选择器, 同一个key不能出现两次
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if len(strings.TrimSpace(value)) == 0 {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid label: " + pair)
+		}
+		key := strings.TrimSpace(parts[0])
+		if len(key) == 0 {
+			return nil, errors.New("empty label key: " + pair)
+		}
+		if _, ok := labels[key]; ok {
+			return nil, errors.New("duplicated label key: " + key)
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// FormatLabels 按key排序输出, 结果可作为meta保存并比较
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+labels[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// MatchLabels 选择器中的每个标签都与agent标签相同时匹配, 空选择器匹配所有agent
+func MatchLabels(selector map[string]string, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selector 返回配置的选择器, 格式错误时视为不匹配任何agent
+func (info CacheItemInfo) selector() (map[string]string, error) {
+	return ParseLabels(info.meta[selectorMetaKey])
+}
+
+func (info CacheItemInfo) matches(labels map[string]string) bool {
+	selector, err := info.selector()
+	if err != nil {
+		return false
+	}
+	return MatchLabels(selector, labels)
+}
@@ -0,0 +1,88 @@
+package motherbase
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	for _, expect := range []struct {
+		value  string
+		labels map[string]string
+		valid  bool
+	}{
+		{"", map[string]string{}, true},
+		{"   ", map[string]string{}, true},
+		{"region=us", map[string]string{"region": "us"}, true},
+		{" region = us , pool=adx ", map[string]string{"region": "us", "pool": "adx"}, true},
+		{"region=", map[string]string{"region": ""}, true},
+		{"version=a=b", map[string]string{"version": "a=b"}, true},
+		{"region=us,region=eu", nil, false},
+		{"region=us,region=us", nil, false},
+		{"region", nil, false},
+		{"region=us,pool", nil, false},
+		{"region=us,", nil, false},
+		{"=us", nil, false},
+		{" =us", nil, false},
+	} {
+		labels, err := ParseLabels(expect.value)
+		if (err == nil) != expect.valid {
+			t.Fatalf("%q: expect valid %v, got %v", expect.value, expect.valid, err)
+		}
+		if expect.valid && !reflect.DeepEqual(labels, expect.labels) {
+			t.Fatalf("%q: expect %v, got %v", expect.value, expect.labels, labels)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	for _, expect := range []struct {
+		labels map[string]string
+		value  string
+	}{
+		{nil, ""},
+		{map[string]string{}, ""},
+		{map[string]string{"region": "us"}, "region=us"},
+		{map[string]string{"region": "us", "pool": "adx", "az": ""}, "az=,pool=adx,region=us"},
+	} {
+		value := FormatLabels(expect.labels)
+		if value != expect.value {
+			t.Fatalf("%v: expect %q, got %q", expect.labels, expect.value, value)
+		}
+		parsed, err := ParseLabels(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed) != len(expect.labels) || (len(parsed) > 0 && !reflect.DeepEqual(parsed, expect.labels)) {
+			t.Fatalf("%v: round trip got %v", expect.labels, parsed)
+		}
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := map[string]string{"region": "us", "pool": "adx"}
+	for _, expect := range []struct {
+		selector map[string]string
+		match    bool
+	}{
+		{nil, true},
+		{map[string]string{}, true},
+		{map[string]string{"region": "us"}, true},
+		{map[string]string{"region": "us", "pool": "adx"}, true},
+		{map[string]string{"region": "eu"}, false},
+		{map[string]string{"region": "us", "zone": "a"}, false},
+		{map[string]string{"zone": ""}, true},
+	} {
+		if MatchLabels(expect.selector, labels) != expect.match {
+			t.Fatalf("%v: expect match %v", expect.selector, expect.match)
+		}
+	}
+	if MatchLabels(map[string]string{"region": "us"}, nil) {
+		t.Fatal("agent without labels should not match a selector")
+	}
+
+	info := CacheItemInfo{meta: map[string]string{selectorMetaKey: "region=us,region=eu"}}
+	if info.matches(labels) {
+		t.Fatal("invalid selector should match no agent")
+	}
+}
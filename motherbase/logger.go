@@ -0,0 +1,23 @@
+package motherbase
+
+import (
+	"github.com/op/go-logging"
+	"github.com/yangzhao28/phantom/commonlog"
+)
+
+const (
+	managerModule = "AgentManager"
+	cacheModule   = "cache"
+	httpModule    = "httpserver"
+	auditModule   = "audit"
+)
+
+// defaultLogger 未指定日志时只输出到控制台, 不在导入包时创建日志文件
+func defaultLogger(module string) *logging.Logger {
+	return commonlog.NewConsoleLogger(module, commonlog.DEBUG)
+}
+
+// loggerSetter 由需要替换日志的存储实现
+type loggerSetter interface {
+	setLogger(logger *logging.Logger)
+}
@@ -0,0 +1,350 @@
+package motherbase
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+var (
+	defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	roundDurationBuckets  = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// metricSeries 一组label值对应的数据, 直方图使用 buckets/sum/count
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	buckets     []uint64
+	sum         float64
+	count       uint64
+}
+
+// metricFamily 同名的一组metric
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	bounds     []float64
+	series     map[string]*metricSeries
+	mutex      sync.Mutex
+}
+
+func newMetricFamily(name string, help string, kind string, bounds []float64, labelNames ...string) *metricFamily {
+	return &metricFamily{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		bounds:     bounds,
+		series:     make(map[string]*metricSeries),
+	}
+}
+
+// get 返回label值对应的数据, 不存在时创建, 调用前需要加锁
+func (family *metricFamily) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(family.labelNames) {
+		panic(fmt.Sprintf("metric %v expects %v label(s), got %v", family.name, len(family.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if family.kind == metricHistogram {
+			series.buckets = make([]uint64, len(family.bounds))
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+func (family *metricFamily) add(value float64, labelValues []string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	family.get(labelValues).value += value
+}
+
+func (family *metricFamily) set(value float64, labelValues []string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	family.get(labelValues).value = value
+}
+
+func (family *metricFamily) observe(value float64, labelValues []string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	series := family.get(labelValues)
+	for index, bound := range family.bounds {
+		if value <= bound {
+			series.buckets[index]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+// remove 删除label name的值为value的所有数据
+func (family *metricFamily) remove(name string, value string) {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	for index, labelName := range family.labelNames {
+		if labelName != name {
+			continue
+		}
+		for key, series := range family.series {
+			if series.labelValues[index] == value {
+				delete(family.series, key)
+			}
+		}
+	}
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for index, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, labelEscaper.Replace(values[index])))
+	}
+	if len(extraName) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// write 按Prometheus文本格式输出, series按label排序保证输出稳定
+func (family *metricFamily) write(w io.Writer) error {
+	family.mutex.Lock()
+	defer family.mutex.Unlock()
+	if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", family.name, family.help, family.name, family.kind); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := family.series[key]
+		var err error
+		if family.kind != metricHistogram {
+			_, err = fmt.Fprintf(w, "%v%v %v\n", family.name, formatLabels(family.labelNames, series.labelValues, "", ""), formatFloat(series.value))
+		} else {
+			for index, bound := range family.bounds {
+				if _, err = fmt.Fprintf(w, "%v_bucket%v %v\n", family.name, formatLabels(family.labelNames, series.labelValues, "le", formatFloat(bound)), series.buckets[index]); err != nil {
+					return err
+				}
+			}
+			labels := formatLabels(family.labelNames, series.labelValues, "", "")
+			_, err = fmt.Fprintf(w, "%v_bucket%v %v\n%v_sum%v %v\n%v_count%v %v\n",
+				family.name, formatLabels(family.labelNames, series.labelValues, "le", "+Inf"), series.count,
+				family.name, labels, formatFloat(series.sum),
+				family.name, labels, series.count)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+* @brief motherbase的运行指标, 每个gateway一份, 由 /metrics 以Prometheus文本格式输出;
+*        nil 的 *Metrics 可以直接调用, 不记录任何数据
+ */
+type Metrics struct {
+	pingDuration        *metricFamily
+	pingFailures        *metricFamily
+	differRoundDuration *metricFamily
+	differRounds        *metricFamily
+	pushes              *metricFamily
+	pushFailures        *metricFamily
+	cacheConfigs        *metricFamily
+	cacheRevisions      *metricFamily
+	cacheBytes          *metricFamily
+	httpRequests        *metricFamily
+	httpDuration        *metricFamily
+
+	// removed 已经删除的agent, 删除前开始的ping和推送完成后不再记录
+	removed map[string]bool
+	mutex   sync.RWMutex
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		pingDuration:        newMetricFamily("motherbase_ping_duration_seconds", "Latency of pings to bidders.", metricHistogram, defaultLatencyBuckets, "agent"),
+		pingFailures:        newMetricFamily("motherbase_ping_failures_total", "Number of failed pings to bidders.", metricCounter, nil, "agent"),
+		differRoundDuration: newMetricFamily("motherbase_differ_round_duration_seconds", "Duration of differ rounds, including pushes.", metricHistogram, roundDurationBuckets),
+		differRounds:        newMetricFamily("motherbase_differ_rounds_total", "Number of differ rounds.", metricCounter, nil),
+		pushes:              newMetricFamily("motherbase_pushes_total", "Number of configs pushed to bidders.", metricCounter, nil, "agent", "action"),
+		pushFailures:        newMetricFamily("motherbase_push_failures_total", "Number of failed pushes to bidders.", metricCounter, nil, "agent", "action"),
+		cacheConfigs:        newMetricFamily("motherbase_cache_configs", "Number of configs in cache.", metricGauge, nil),
+		cacheRevisions:      newMetricFamily("motherbase_cache_revisions", "Number of revisions kept in cache.", metricGauge, nil),
+		cacheBytes:          newMetricFamily("motherbase_cache_bytes", "Total size of the latest revision of all configs.", metricGauge, nil),
+		httpRequests:        newMetricFamily("motherbase_http_requests_total", "Number of API requests.", metricCounter, nil, "handler", "code"),
+		httpDuration:        newMetricFamily("motherbase_http_request_duration_seconds", "Latency of API requests.", metricHistogram, defaultLatencyBuckets, "handler"),
+		removed:             make(map[string]bool),
+	}
+}
+
+func (metrics *Metrics) families() []*metricFamily {
+	return []*metricFamily{
+		metrics.pingDuration,
+		metrics.pingFailures,
+		metrics.differRoundDuration,
+		metrics.differRounds,
+		metrics.pushes,
+		metrics.pushFailures,
+		metrics.cacheConfigs,
+		metrics.cacheRevisions,
+		metrics.cacheBytes,
+		metrics.httpRequests,
+		metrics.httpDuration,
+	}
+}
+
+// Expose 以Prometheus文本格式输出所有指标
+func (metrics *Metrics) Expose(w io.Writer) error {
+	if metrics == nil {
+		return nil
+	}
+	for _, family := range metrics.families() {
+		if err := family.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (metrics *Metrics) observePing(agent string, duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.RLock()
+	defer metrics.mutex.RUnlock()
+	if metrics.removed[agent] {
+		return
+	}
+	metrics.pingDuration.observe(duration.Seconds(), []string{agent})
+	if err != nil {
+		metrics.pingFailures.add(1, []string{agent})
+	} else {
+		metrics.pingFailures.add(0, []string{agent})
+	}
+}
+
+// forgetAgent 删除agent的所有数据, 避免删除的agent一直保留在输出中
+func (metrics *Metrics) forgetAgent(agent string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.removed[agent] = true
+	for _, family := range metrics.families() {
+		family.remove("agent", agent)
+	}
+}
+
+// addAgent 重新添加同名agent后恢复记录
+func (metrics *Metrics) addAgent(agent string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	delete(metrics.removed, agent)
+}
+
+func (metrics *Metrics) observeRound(duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.differRoundDuration.observe(duration.Seconds(), nil)
+	metrics.differRounds.add(1, nil)
+}
+
+func (metrics *Metrics) observePush(agent string, action string, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.mutex.RLock()
+	defer metrics.mutex.RUnlock()
+	if metrics.removed[agent] {
+		return
+	}
+	metrics.pushes.add(1, []string{agent, action})
+	if err != nil {
+		metrics.pushFailures.add(1, []string{agent, action})
+	} else {
+		metrics.pushFailures.add(0, []string{agent, action})
+	}
+}
+
+func (metrics *Metrics) observeCache(configs int, revisions int, bytes int) {
+	if metrics == nil {
+		return
+	}
+	metrics.cacheConfigs.set(float64(configs), nil)
+	metrics.cacheRevisions.set(float64(revisions), nil)
+	metrics.cacheBytes.set(float64(bytes), nil)
+}
+
+func (metrics *Metrics) observeRequest(handler string, code int, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.httpRequests.add(1, []string{handler, strconv.Itoa(code)})
+	metrics.httpDuration.observe(duration.Seconds(), []string{handler})
+}
+
+// statusRecorder 记录handler写入的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (recorder *statusRecorder) WriteHeader(code int) {
+	recorder.code = code
+	recorder.ResponseWriter.WriteHeader(code)
+}
+
+// Flush 供 /watch 推送事件
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument 统计handler的请求数和延迟, 包括认证失败的请求
+func (metrics *Metrics) instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next(recorder, req)
+		metrics.observeRequest(handler, recorder.code, time.Since(start))
+	}
+}
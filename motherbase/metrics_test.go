@@ -0,0 +1,77 @@
+package motherbase
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	manager := gateway.Manager
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	defer manager.Quit()
+
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("doconfig failed: %v %v", recorder.Code, recorder.Body.String())
+	}
+	gateway.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/getconfig", nil))
+
+	var instance Configurable = newFakeBidder()
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.EnableAgent("bidder1", &instance)
+	manager.runRound(nil, manager.enabledSnapshot())
+
+	recorder = httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, expect := range []string{
+		"# TYPE motherbase_pushes_total counter",
+		`motherbase_pushes_total{agent="bidder1",action="doconfig"} 1`,
+		`motherbase_push_failures_total{agent="bidder1",action="doconfig"} 0`,
+		"motherbase_cache_configs 1",
+		"motherbase_cache_bytes 12",
+		`motherbase_http_requests_total{handler="/doconfig",code="200"} 1`,
+		`motherbase_http_requests_total{handler="/getconfig",code="400"} 1`,
+		`motherbase_http_request_duration_seconds_count{handler="/doconfig"} 1`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Fatalf("expect %q in metrics:\n%v", expect, body)
+		}
+	}
+
+	// 删除agent后不再输出它的数据
+	manager.metrics.observePing("bidder1", time.Millisecond, nil)
+	manager.metrics.observePing("bidder2", time.Millisecond, nil)
+	manager.syncer.Add(1)
+	go manager.Controller()
+	manager.RemoveAgent("bidder1", nil)
+	expose := func() string {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return recorder.Body.String()
+	}
+	if !waitFor(func() bool { return !strings.Contains(expose(), `agent="bidder1"`) }) {
+		t.Fatalf("metrics of removed agent kept:\n%v", expose())
+	}
+	if !strings.Contains(expose(), `motherbase_ping_failures_total{agent="bidder2"} 0`) {
+		t.Fatal("metrics of other agents should be kept")
+	}
+
+	// 删除前开始的ping和推送完成后不再记录
+	manager.metrics.observePing("bidder1", time.Millisecond, nil)
+	manager.metrics.observePush("bidder1", PushDoConfig, nil)
+	if body := expose(); strings.Contains(body, `agent="bidder1"`) {
+		t.Fatalf("late observation recreated removed agent:\n%v", body)
+	}
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.metrics.observePing("bidder1", time.Millisecond, nil)
+	if body := expose(); !strings.Contains(body, `motherbase_ping_failures_total{agent="bidder1"} 0`) {
+		t.Fatalf("metrics of re-added agent missing:\n%v", body)
+	}
+}
@@ -0,0 +1,99 @@
+package motherbase
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	DefaultPushWorkers    = 32
+	DefaultAgentPushLimit = 4
+	DefaultDiffLimit      = 32
+)
+
+// workerPool 固定数量的worker执行推送, 每个agent同时进行的推送数不超过 perAgent
+type workerPool struct {
+	tasks      chan func()
+	workers    int
+	perAgent   int
+	agentSlots map[string]chan struct{}
+	mutex      sync.Mutex
+	quit       chan bool
+}
+
+func newWorkerPool(workers int, perAgent int, quit chan bool) *workerPool {
+	return &workerPool{
+		tasks:      make(chan func()),
+		workers:    workers,
+		perAgent:   perAgent,
+		agentSlots: make(map[string]chan struct{}),
+		quit:       quit,
+	}
+}
+
+func (pool *workerPool) start(syncer *sync.WaitGroup) {
+	for index := 0; index < pool.workers; index++ {
+		syncer.Add(1)
+		go func() {
+			defer syncer.Done()
+			for {
+				select {
+				case task := <-pool.tasks:
+					task()
+				case <-pool.quit:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (pool *workerPool) agentSlot(agent string) chan struct{} {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	slot, ok := pool.agentSlots[agent]
+	if !ok {
+		slot = make(chan struct{}, pool.perAgent)
+		pool.agentSlots[agent] = slot
+	}
+	return slot
+}
+
+func (pool *workerPool) forget(agent string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.agentSlots, agent)
+}
+
+/**
+* @brief 提交任务, agent的并发已满或没有空闲worker时阻塞,
+*        任务完成时调用 done.Done()
+*
+* @param agent
+* @param done
+* @param task
+*
+* @return 退出时返回错误, 任务不会被执行
+ */
+func (pool *workerPool) submit(agent string, done *sync.WaitGroup, task func()) error {
+	slot := pool.agentSlot(agent)
+	select {
+	case slot <- struct{}{}:
+	case <-pool.quit:
+		return errors.New("worker pool stopped")
+	}
+	done.Add(1)
+	wrapped := func() {
+		defer done.Done()
+		defer func() { <-slot }()
+		task()
+	}
+	select {
+	case pool.tasks <- wrapped:
+		return nil
+	case <-pool.quit:
+		<-slot
+		done.Done()
+		return errors.New("worker pool stopped")
+	}
+}
@@ -0,0 +1,372 @@
+package motherbase
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	PushDoConfig = "doconfig"
+	PushUnConfig = "unconfig"
+)
+
+const (
+	DefaultPushMaxAttempts = 5
+	DefaultPushBaseBackoff = 5 * time.Second
+	DefaultPushMaxBackoff  = 5 * time.Minute
+	pushHistorySize        = 1000
+)
+
+// RetryPolicy 推送失败后等待 BaseBackoff * 2^(attempts-1) 重试, 最长 MaxBackoff,
+// 失败 MaxAttempts 次后进入dead letter, 直到配置变化、agent重新启用或人工重试
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (policy *RetryPolicy) Validate() error {
+	if policy.MaxAttempts <= 0 {
+		return errors.New("max attempts should be positive")
+	}
+	if policy.BaseBackoff <= 0 || policy.MaxBackoff < policy.BaseBackoff {
+		return errors.New("invalid push backoff")
+	}
+	return nil
+}
+
+func (policy *RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := policy.BaseBackoff
+	for index := 1; index < attempts && backoff < policy.MaxBackoff; index++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	return backoff
+}
+
+// PushOperation 为某个agent上某个配置的一次DoConfig或UnConfig
+type PushOperation struct {
+	Agent       string     `json:"agent"`
+	Id          string     `json:"id"`
+	Action      string     `json:"action"`
+	Md5sum      string     `json:"md5sum,omitempty"`
+	Before      string     `json:"before,omitempty"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	FirstTime   time.Time  `json:"first_time"`
+	LastTime    time.Time  `json:"last_time"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
+
+type PushOutcome struct {
+	Agent   string    `json:"agent"`
+	Id      string    `json:"id"`
+	Action  string    `json:"action"`
+	Md5sum  string    `json:"md5sum,omitempty"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func pushKey(agent string, id string) string {
+	return agent + "|" + id
+}
+
+// pushQueue 每个(agent, 配置)最多一个失败待重试的操作, 新的操作覆盖旧的
+type pushQueue struct {
+	policy  RetryPolicy
+	pending map[string]*PushOperation
+	dead    map[string]*PushOperation
+	history []PushOutcome
+	logger  *logging.Logger
+	mutex   sync.Mutex
+}
+
+func newPushQueue() *pushQueue {
+	return &pushQueue{
+		policy: RetryPolicy{
+			MaxAttempts: DefaultPushMaxAttempts,
+			BaseBackoff: DefaultPushBaseBackoff,
+			MaxBackoff:  DefaultPushMaxBackoff,
+		},
+		pending: make(map[string]*PushOperation),
+		dead:    make(map[string]*PushOperation),
+		history: make([]PushOutcome, 0),
+		logger:  defaultLogger(managerModule),
+	}
+}
+
+func (queue *pushQueue) setPolicy(policy RetryPolicy) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.policy = policy
+}
+
+// owned 判断操作是否已在重试队列或dead letter中, 是则由重试流程负责, diff时跳过
+func (queue *pushQueue) owned(agent string, id string, action string, md5sum string) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	key := pushKey(agent, id)
+	for _, operations := range []map[string]*PushOperation{queue.pending, queue.dead} {
+		if operation, ok := operations[key]; ok {
+			if operation.Action == action && operation.Md5sum == md5sum {
+				return true
+			}
+			delete(operations, key)
+		}
+	}
+	return false
+}
+
+/**
+* @brief 记录一次推送的结果, 成功时从队列中移除, 失败时按退避策略等待重试
+*
+* @param operation
+* @param err
+*
+* @return 同一推送已经尝试的次数, 以及是否进入了dead letter
+ */
+func (queue *pushQueue) record(operation PushOperation, err error) (int, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	now := time.Now()
+	key := pushKey(operation.Agent, operation.Id)
+	current, ok := queue.pending[key]
+	if !ok || current.Action != operation.Action || current.Md5sum != operation.Md5sum {
+		current = &operation
+		current.Attempts = 0
+		current.FirstTime = now
+	}
+	current.Attempts++
+	current.LastTime = now
+
+	outcome := PushOutcome{
+		Agent:   operation.Agent,
+		Id:      operation.Id,
+		Action:  operation.Action,
+		Md5sum:  operation.Md5sum,
+		Attempt: current.Attempts,
+		Time:    now,
+	}
+	if err == nil {
+		delete(queue.pending, key)
+		delete(queue.dead, key)
+	} else {
+		outcome.Error = err.Error()
+		current.LastError = err.Error()
+		if current.Attempts >= queue.policy.MaxAttempts {
+			current.NextAttempt = nil
+			delete(queue.pending, key)
+			queue.dead[key] = current
+			queue.logger.Warning(fmt.Sprintf("%v %v on %v dead after %v attempts: %v",
+				operation.Action, operation.Id, operation.Agent, current.Attempts, err.Error()))
+		} else {
+			next := now.Add(queue.policy.backoff(current.Attempts))
+			current.NextAttempt = &next
+			queue.pending[key] = current
+		}
+	}
+	queue.history = append(queue.history, outcome)
+	if len(queue.history) > pushHistorySize {
+		queue.history = queue.history[len(queue.history)-pushHistorySize:]
+	}
+	_, dead := queue.dead[key]
+	return current.Attempts, dead && err != nil
+}
+
+// due 返回到达重试时间的操作
+func (queue *pushQueue) due() []PushOperation {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	now := time.Now()
+	operations := make([]PushOperation, 0)
+	for _, operation := range queue.pending {
+		if operation.NextAttempt != nil && !now.Before(*operation.NextAttempt) {
+			operations = append(operations, *operation)
+			operation.NextAttempt = nil
+		}
+	}
+	return operations
+}
+
+func (queue *pushQueue) drop(agent string, id string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	delete(queue.pending, pushKey(agent, id))
+	delete(queue.dead, pushKey(agent, id))
+}
+
+// dropAgent 删除agent的所有操作
+func (queue *pushQueue) dropAgent(agent string) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for _, operations := range []map[string]*PushOperation{queue.pending, queue.dead} {
+		for key, operation := range operations {
+			if operation.Agent == agent {
+				delete(operations, key)
+			}
+		}
+	}
+}
+
+// requeue 将dead letter中的操作重新放入队列立即重试
+func (queue *pushQueue) requeue(agent string, id string) error {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	key := pushKey(agent, id)
+	operation, ok := queue.dead[key]
+	if !ok {
+		return errors.New(fmt.Sprintf("no dead push of %v on %v", id, agent))
+	}
+	delete(queue.dead, key)
+	now := time.Now()
+	operation.Attempts = 0
+	operation.NextAttempt = &now
+	queue.pending[key] = operation
+	return nil
+}
+
+func sortedOperations(operations map[string]*PushOperation) []PushOperation {
+	result := make([]PushOperation, 0, len(operations))
+	for _, operation := range operations {
+		result = append(result, *operation)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return pushKey(result[i].Agent, result[i].Id) < pushKey(result[j].Agent, result[j].Id)
+	})
+	return result
+}
+
+func (queue *pushQueue) list() ([]PushOperation, []PushOperation) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return sortedOperations(queue.pending), sortedOperations(queue.dead)
+}
+
+func (queue *pushQueue) outcomes() []PushOutcome {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	result := make([]PushOutcome, len(queue.history))
+	copy(result, queue.history)
+	return result
+}
+
+/**
+* @brief 在agent上执行一次推送并记录结果
+*
+* @param bridge
+* @param operation
+*
+* @return
+ */
+func (manager *AgentManager) executePush(bridge Configurable, operation PushOperation) error {
+	var err error
+	entry := AuditEntry{Actor: actorDiffer, Id: operation.Id, Agent: operation.Agent, Before: operation.Before}
+	switch operation.Action {
+	case PushDoConfig:
+		manager.logger.Debug("try boot agent config: " + operation.Id)
+		var config string
+		config, err = manager.cache.Get(operation.Id)
+		if err != nil {
+			manager.logger.Debug("no config for: " + operation.Id)
+			manager.pushes.drop(operation.Agent, operation.Id)
+			return err
+		}
+		if Md5Sum([]byte(config)) != operation.Md5sum {
+			manager.logger.Debug("config changed, skip outdated push of " + operation.Id)
+			manager.pushes.drop(operation.Agent, operation.Id)
+			return nil
+		}
+		manager.logger.Debug("do config")
+		err = bridge.DoConfig(operation.Id, config)
+		manager.rollout.pushed(operation.Id, operation.Md5sum, operation.Agent, err)
+		entry.Action = AuditPushDo
+		entry.After = operation.Md5sum
+	case PushUnConfig:
+		err = bridge.UnConfig(operation.Id)
+		entry.Action = AuditPushUn
+	default:
+		err = errors.New("unknown push action: " + operation.Action)
+	}
+	if err != nil {
+		manager.logger.Debug(fmt.Sprintf("fail to %v %v on %v: %v", operation.Action, operation.Id, operation.Agent, err.Error()))
+	}
+	if len(entry.Action) > 0 {
+		manager.audit(entry, err)
+		manager.metrics.observePush(operation.Agent, operation.Action, err)
+	}
+	attempts, dead := manager.pushes.record(operation, err)
+	if err != nil {
+		manager.notify(Notification{
+			Event:    EventPushFailed,
+			Agent:    operation.Agent,
+			Id:       operation.Id,
+			Action:   operation.Action,
+			Md5sum:   operation.Md5sum,
+			Attempts: attempts,
+			Dead:     dead,
+			Error:    err.Error(),
+		})
+	}
+	return err
+}
+
+func (manager *AgentManager) PushRetrier() {
+	manager.logger.Debug("enter push retrier")
+	defer manager.logger.Debug("leave push retrier")
+	defer manager.syncer.Done()
+
+	timer := time.NewTimer(time.Second)
+	for {
+		select {
+		case <-timer.C:
+			agents := manager.enabledSnapshot()
+			waitForDone := sync.WaitGroup{}
+			for _, operation := range manager.pushes.due() {
+				bridge, ok := agents[operation.Agent]
+				if !ok {
+					// agent不可用时丢弃, 恢复后由 EnableAgent 触发的diff重新提交
+					manager.logger.Info(fmt.Sprintf("drop %v %v on %v: agent not enabled",
+						operation.Action, operation.Id, operation.Agent))
+					manager.pushes.drop(operation.Agent, operation.Id)
+					continue
+				}
+				operation := operation
+				manager.pool.submit(operation.Agent, &waitForDone, func() {
+					manager.executePush(bridge, operation)
+				})
+			}
+			waitForDone.Wait()
+			timer.Reset(time.Second)
+		case <-manager.quit:
+			return
+		}
+	}
+}
+
+func (manager *AgentManager) SetRetryPolicy(policy RetryPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	manager.pushes.setPolicy(policy)
+	return nil
+}
+
+func (manager *AgentManager) ListPushes() ([]PushOperation, []PushOperation) {
+	return manager.pushes.list()
+}
+
+func (manager *AgentManager) PushHistory() []PushOutcome {
+	return manager.pushes.outcomes()
+}
+
+func (manager *AgentManager) RequeuePush(agent string, id string) error {
+	return manager.pushes.requeue(agent, id)
+}
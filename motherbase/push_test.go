@@ -0,0 +1,83 @@
+package motherbase
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPushDeadLetter(t *testing.T) {
+	queue := newPushQueue()
+	queue.setPolicy(RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	operation := PushOperation{Agent: "a", Id: "agent1", Action: PushDoConfig, Md5sum: "md5"}
+
+	queue.record(operation, errors.New("refused"))
+	if !queue.owned("a", "agent1", PushDoConfig, "md5") {
+		t.Fatal("failed push should wait for retry")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if due := queue.due(); len(due) != 1 {
+		t.Fatalf("expect 1 due push, got %v", due)
+	}
+	queue.record(operation, errors.New("refused"))
+	pending, dead := queue.list()
+	if len(pending) != 0 || len(dead) != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("expect dead push, got %v %v", pending, dead)
+	}
+	if queue.owned("a", "agent1", PushDoConfig, "md5new") {
+		t.Fatal("new revision should replace dead push")
+	}
+	if len(queue.outcomes()) != 2 {
+		t.Fatalf("expect 2 outcomes, got %v", queue.outcomes())
+	}
+}
+
+func TestPushRetrierDisabledAgent(t *testing.T) {
+	cache := NewPersistCacheWithStorage(NewMemoryStorage())
+	manager := NewAgentManager(cache)
+	if err := cache.Replace("agent1", "body of agent1"); err != nil {
+		t.Fatal(err)
+	}
+	bidder := newFakeBidder()
+	var instance Configurable = bidder
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.pushes.setPolicy(RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	operation := PushOperation{Agent: "bidder1", Id: "agent1", Action: PushDoConfig, Md5sum: Md5Sum([]byte("body of agent1"))}
+	manager.pushes.record(operation, errors.New("refused"))
+
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	manager.syncer.Add(1)
+	go manager.PushRetrier()
+	defer manager.Quit()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for pending, _ := manager.ListPushes(); len(pending) != 0; pending, _ = manager.ListPushes() {
+		if time.Now().After(deadline) {
+			t.Fatalf("retry of disabled agent should be dropped, got %v", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, dead := manager.ListPushes(); len(dead) != 0 {
+		t.Fatalf("disabled agent should not fill dead letter, got %v", dead)
+	}
+
+	// 重试次数用尽的推送在agent恢复后也要重新提交
+	for attempt := 0; attempt < 3; attempt++ {
+		manager.pushes.record(operation, errors.New("refused"))
+	}
+	if _, dead := manager.ListPushes(); len(dead) != 1 {
+		t.Fatalf("expect dead push, got %v", dead)
+	}
+	manager.EnableAgent("bidder1", &instance)
+	result := manager.runRound(newDiffScope(nil, []string{"bidder1"}), manager.enabledSnapshot())
+	if result.Pushes != 1 || result.Failures != 0 {
+		t.Fatalf("expect push after agent enabled, got %+v", result)
+	}
+	if configs, _ := bidder.ListConfig(); configs["agent1"] != operation.Md5sum {
+		t.Fatalf("unexpected configs after enable: %v", configs)
+	}
+	if pending, dead := manager.ListPushes(); len(pending) != 0 || len(dead) != 0 {
+		t.Fatalf("expect empty push queue, got %v %v", pending, dead)
+	}
+}
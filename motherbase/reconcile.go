@@ -0,0 +1,244 @@
+package motherbase
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultReconcileDebounce = 500 * time.Millisecond
+
+// diffScope 限定一轮diff涉及的配置和agent, nil表示全部
+type diffScope struct {
+	ids    map[string]bool
+	agents map[string]bool
+}
+
+func newDiffScope(ids []string, agents []string) *diffScope {
+	scope := &diffScope{}
+	if ids != nil {
+		scope.ids = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			scope.ids[id] = true
+		}
+	}
+	if agents != nil {
+		scope.agents = make(map[string]bool, len(agents))
+		for _, name := range agents {
+			scope.agents[name] = true
+		}
+	}
+	return scope
+}
+
+func mergeSet(left map[string]bool, right map[string]bool) map[string]bool {
+	if left == nil || right == nil {
+		return nil
+	}
+	merged := make(map[string]bool, len(left)+len(right))
+	for key := range left {
+		merged[key] = true
+	}
+	for key := range right {
+		merged[key] = true
+	}
+	return merged
+}
+
+// merge 合并两个范围, 结果覆盖两者, 可能比两者的并集更大
+func (scope *diffScope) merge(other *diffScope) *diffScope {
+	if scope == nil || other == nil {
+		return nil
+	}
+	return &diffScope{
+		ids:    mergeSet(scope.ids, other.ids),
+		agents: mergeSet(scope.agents, other.agents),
+	}
+}
+
+func (scope *diffScope) hasId(id string) bool {
+	return scope == nil || scope.ids == nil || scope.ids[id]
+}
+
+func (scope *diffScope) hasAgent(name string) bool {
+	return scope == nil || scope.agents == nil || scope.agents[name]
+}
+
+func keys(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for key := range set {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// reconcileRound 一轮diff, 所有推送完成后才算结束
+type reconcileRound struct {
+	pushes   sync.WaitGroup
+	pushed   int32
+	failed   int32
+	start    time.Time
+	agents   int
+	complete bool
+}
+
+type RoundResult struct {
+	Complete   bool      `json:"complete"`
+	Agents     int       `json:"agents"`
+	Pushes     int       `json:"pushes"`
+	Failures   int       `json:"failures"`
+	StartTime  time.Time `json:"start_time"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+func newReconcileRound(scope *diffScope) *reconcileRound {
+	return &reconcileRound{
+		start:    time.Now(),
+		complete: scope == nil,
+	}
+}
+
+func (round *reconcileRound) result() RoundResult {
+	return RoundResult{
+		Complete:   round.complete,
+		Agents:     round.agents,
+		Pushes:     int(atomic.LoadInt32(&round.pushed)),
+		Failures:   int(atomic.LoadInt32(&round.failed)),
+		StartTime:  round.start,
+		DurationMs: int64(time.Since(round.start) / time.Millisecond),
+	}
+}
+
+// SetConcurrency 设置推送worker数量、每个agent的推送并发数和同时diff的agent数, 在Go()之前调用
+func (manager *AgentManager) SetConcurrency(workers int, perAgent int, diffLimit int) error {
+	if workers <= 0 || perAgent <= 0 || diffLimit <= 0 {
+		return errors.New("concurrency limits should be positive")
+	}
+	manager.pushWorkers = workers
+	manager.agentPushLimit = perAgent
+	manager.diffLimit = diffLimit
+	return nil
+}
+
+func (manager *AgentManager) LastRound() RoundResult {
+	manager.roundMutex.Lock()
+	defer manager.roundMutex.Unlock()
+	return manager.lastRound
+}
+
+/**
+* @brief 提交一次推送到worker pool, 已在重试队列中的操作交给 PushRetrier
+*
+* @param round
+* @param bridge
+* @param operation
+ */
+func (manager *AgentManager) submitPush(round *reconcileRound, bridge Configurable, operation PushOperation) {
+	if manager.pushes.owned(operation.Agent, operation.Id, operation.Action, operation.Md5sum) {
+		manager.logger.Debug(fmt.Sprintf("%v %v on %v is waiting for retry", operation.Action, operation.Id, operation.Agent))
+		return
+	}
+	manager.pool.submit(operation.Agent, &round.pushes, func() {
+		atomic.AddInt32(&round.pushed, 1)
+		if err := manager.executePush(bridge, operation); err != nil {
+			atomic.AddInt32(&round.failed, 1)
+		}
+	})
+}
+
+// runRound 并发diff范围内的agent, 同时diff的agent数受 diffLimit 限制, 返回时所有推送已完成
+func (manager *AgentManager) runRound(scope *diffScope, agents map[string]Configurable) RoundResult {
+	round := newReconcileRound(scope)
+	activatedAgents, err := manager.cache.List()
+	if err != nil {
+		return round.result()
+	}
+	diffSlots := make(chan struct{}, manager.diffLimit)
+	waitForDone := sync.WaitGroup{}
+	for name, agent := range agents {
+		if !scope.hasAgent(name) {
+			continue
+		}
+		select {
+		case diffSlots <- struct{}{}:
+		case <-manager.quit:
+			waitForDone.Wait()
+			return round.result()
+		}
+		round.agents++
+		waitForDone.Add(1)
+		manager.logger.Debug("diff -> " + name)
+		go func(name string, bridge Configurable) {
+			defer waitForDone.Done()
+			defer func() { <-diffSlots }()
+			manager.diffAgent(round, name, bridge, activatedAgents, scope)
+		}(name, agent)
+	}
+	waitForDone.Wait()
+	round.pushes.Wait()
+	result := round.result()
+	manager.roundMutex.Lock()
+	manager.lastRound = result
+	manager.roundMutex.Unlock()
+	manager.logger.Info(fmt.Sprintf("reconcile round done: agents -- %v, pushes -- %v, failures -- %v, duration -- %vms",
+		result.Agents, result.Pushes, result.Failures, result.DurationMs))
+	return result
+}
+
+/**
+* @brief 请求对指定配置和agent做一次diff, 多个请求在 debounce 时间内合并,
+*        请求过多时丢弃, 并将下一轮diff扩大为全量
+*
+* @param ids 涉及的配置, nil表示全部
+* @param agents 涉及的agent, nil表示全部
+ */
+func (manager *AgentManager) Trigger(ids []string, agents []string) {
+	select {
+	case manager.reconcileChannel <- newDiffScope(ids, agents):
+	default:
+		atomic.StoreInt32(&manager.reconcileOverflow, 1)
+		manager.logger.Warning("reconcile queue full, next round will be complete")
+	}
+}
+
+func (manager *AgentManager) Reconciler() {
+	manager.logger.Debug("enter reconciler")
+	defer manager.logger.Debug("leave reconciler")
+	defer manager.syncer.Done()
+
+	var pending *diffScope
+	waiting := false
+	timer := time.NewTimer(manager.reconcileDebounce)
+	timer.Stop()
+	for {
+		select {
+		case scope := <-manager.reconcileChannel:
+			if atomic.SwapInt32(&manager.reconcileOverflow, 0) == 1 {
+				scope = nil
+			}
+			if !waiting {
+				pending = scope
+				waiting = true
+				timer.Reset(manager.reconcileDebounce)
+			} else {
+				pending = pending.merge(scope)
+			}
+		case <-timer.C:
+			waiting = false
+			if pending != nil {
+				manager.logger.Debug("reconcile ids: ", keys(pending.ids), " agents: ", keys(pending.agents))
+			}
+			select {
+			case manager.agentRunDiffer <- pending:
+			case <-manager.quit:
+				return
+			}
+		case <-manager.quit:
+			return
+		}
+	}
+}
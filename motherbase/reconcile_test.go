@@ -0,0 +1,94 @@
+package motherbase
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffScopeMerge(t *testing.T) {
+	scope := newDiffScope([]string{"agent1"}, nil).merge(newDiffScope([]string{"agent2"}, nil))
+	if !scope.hasId("agent1") || !scope.hasId("agent2") || scope.hasId("agent3") {
+		t.Fatalf("unexpected ids: %v", keys(scope.ids))
+	}
+	if !scope.hasAgent("any") {
+		t.Fatal("nil agents should match all")
+	}
+	if merged := scope.merge(nil); !merged.hasId("agent3") {
+		t.Fatal("merge with full scope should be full")
+	}
+}
+
+// nextRound 等待Reconciler发出的一轮diff
+func nextRound(t *testing.T, manager *AgentManager, timeout time.Duration) (*diffScope, bool) {
+	select {
+	case scope := <-manager.agentRunDiffer:
+		return scope, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func TestReconcilerDebounce(t *testing.T) {
+	cache := NewPersistCacheWithStorage(NewMemoryStorage())
+	manager := NewAgentManager(cache)
+	manager.syncer.Add(1)
+	go manager.Reconciler()
+	defer manager.Quit()
+
+	// 配置修改触发只涉及该配置的diff
+	if err := cache.Replace("agent1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	scope, ok := nextRound(t, manager, 2*DefaultReconcileDebounce)
+	if !ok || scope == nil || strings.Join(keys(scope.ids), ",") != "agent1" || scope.agents != nil {
+		t.Fatalf("unexpected scope of config change: %+v", scope)
+	}
+
+	// agent启用触发只涉及该agent的diff
+	var instance Configurable = newFakeBidder()
+	manager.EnableAgent("bidder1", &instance)
+	scope, ok = nextRound(t, manager, 2*DefaultReconcileDebounce)
+	if !ok || scope == nil || scope.ids != nil || strings.Join(keys(scope.agents), ",") != "bidder1" {
+		t.Fatalf("unexpected scope of enabled agent: %+v", scope)
+	}
+
+	// debounce 时间内的多个请求合并为一轮
+	start := time.Now()
+	manager.Trigger([]string{"agent1"}, []string{"bidder1"})
+	manager.Trigger([]string{"agent2"}, []string{"bidder2"})
+	manager.Trigger([]string{"agent3"}, []string{"bidder1"})
+	scope, ok = nextRound(t, manager, 2*DefaultReconcileDebounce)
+	if !ok || scope == nil {
+		t.Fatalf("expect scoped round, got %+v", scope)
+	}
+	if elapsed := time.Since(start); elapsed < DefaultReconcileDebounce {
+		t.Fatalf("round started before debounce: %v", elapsed)
+	}
+	if ids, agents := strings.Join(keys(scope.ids), ","), strings.Join(keys(scope.agents), ","); ids != "agent1,agent2,agent3" || agents != "bidder1,bidder2" {
+		t.Fatalf("unexpected merged scope: %v %v", ids, agents)
+	}
+	if scope, ok := nextRound(t, manager, DefaultReconcileDebounce+100*time.Millisecond); ok {
+		t.Fatalf("expect one round, got another %+v", scope)
+	}
+}
+
+func TestReconcilerOverflow(t *testing.T) {
+	manager := NewAgentManager(NewPersistCacheWithStorage(NewMemoryStorage()))
+	// 队列满时丢弃的请求使下一轮变为全量
+	for i := 0; i <= cap(manager.reconcileChannel); i++ {
+		manager.Trigger([]string{"agent1"}, []string{"bidder1"})
+	}
+	manager.syncer.Add(1)
+	go manager.Reconciler()
+	defer manager.Quit()
+
+	scope, ok := nextRound(t, manager, 2*DefaultReconcileDebounce)
+	if !ok || scope != nil {
+		t.Fatalf("expect complete round after overflow, got %v %+v", ok, scope)
+	}
+	manager.Trigger([]string{"agent1"}, []string{"bidder1"})
+	if scope, ok := nextRound(t, manager, 2*DefaultReconcileDebounce); !ok || scope == nil {
+		t.Fatalf("expect scoped round after overflow is handled, got %v %+v", ok, scope)
+	}
+}
@@ -0,0 +1,421 @@
+package motherbase
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	RolloutRunning   = "running"
+	RolloutHalted    = "halted"
+	RolloutCompleted = "completed"
+)
+
+// DefaultWaveTimeout 一批agent在这段时间内没有全部同步时停止rollout
+const DefaultWaveTimeout = 10 * time.Minute
+
+// RolloutPolicy 控制配置变更在agent间的扩散方式:
+// 先推送给 CanaryCount 个canary agent, 再按 Waves 中的累计百分比分批推送,
+// 每批全部同步完成后等待 PauseSeconds 秒再进入下一批,
+// 超过 WaveTimeoutSeconds 秒(0表示 DefaultWaveTimeout)仍未同步完时停止rollout.
+// rollout开始后才启用的agent不属于任何批次, 在第一批完成后同步.
+// CanaryCount 为0且 Waves 为空时不做分批, 所有agent在下一轮diff时同步
+type RolloutPolicy struct {
+	CanaryCount        int   `json:"canary_count"`
+	Waves              []int `json:"waves"`
+	PauseSeconds       int   `json:"pause_seconds"`
+	WaveTimeoutSeconds int   `json:"wave_timeout_seconds"`
+}
+
+func (policy *RolloutPolicy) Enabled() bool {
+	return policy != nil && (policy.CanaryCount > 0 || len(policy.Waves) > 0)
+}
+
+func (policy *RolloutPolicy) Validate() error {
+	if policy.CanaryCount < 0 {
+		return errors.New("canary_count should not be negative")
+	}
+	if policy.PauseSeconds < 0 {
+		return errors.New("pause_seconds should not be negative")
+	}
+	if policy.WaveTimeoutSeconds < 0 {
+		return errors.New("wave_timeout_seconds should not be negative")
+	}
+	last := 0
+	for _, percent := range policy.Waves {
+		if percent <= last || percent > 100 {
+			return errors.New("waves should be increasing percentages in (0, 100]")
+		}
+		last = percent
+	}
+	return nil
+}
+
+func (policy *RolloutPolicy) waveTimeout() time.Duration {
+	if policy.WaveTimeoutSeconds == 0 {
+		return DefaultWaveTimeout
+	}
+	return time.Duration(policy.WaveTimeoutSeconds) * time.Second
+}
+
+// split 将agent分为canary和各个百分比批次, 最后一批总是包含剩余的全部agent
+func (policy *RolloutPolicy) split(agents []string) [][]string {
+	sort.Strings(agents)
+	waves := make([][]string, 0)
+	offset := 0
+	if policy.CanaryCount > 0 {
+		offset = policy.CanaryCount
+		if offset > len(agents) {
+			offset = len(agents)
+		}
+		waves = append(waves, agents[:offset])
+	}
+	for _, percent := range policy.Waves {
+		end := (len(agents)*percent + 99) / 100
+		if end <= offset {
+			continue
+		}
+		waves = append(waves, agents[offset:end])
+		offset = end
+	}
+	if offset < len(agents) {
+		waves = append(waves, agents[offset:])
+	}
+	return waves
+}
+
+type Rollout struct {
+	Id          string            `json:"id"`
+	Md5sum      string            `json:"md5sum"`
+	State       string            `json:"state"`
+	Waves       [][]string        `json:"waves"`
+	CurrentWave int               `json:"current_wave"`
+	Synced      map[string]bool   `json:"synced"`
+	Failed      map[string]string `json:"failed"`
+	HaltReason  string            `json:"halt_reason,omitempty"`
+	StartTime   time.Time         `json:"start_time"`
+	WaveStart   time.Time         `json:"wave_start_time"`
+	WaveDone    *time.Time        `json:"wave_done_time,omitempty"`
+	Pruned      []string          `json:"pruned,omitempty"`
+	pause       time.Duration
+	timeout     time.Duration
+}
+
+func (rollout *Rollout) admitted(agent string) bool {
+	for index := 0; index <= rollout.CurrentWave && index < len(rollout.Waves); index++ {
+		for _, name := range rollout.Waves[index] {
+			if name == agent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// joined 判断agent是否在rollout开始时被分到某一批, 之后启用或被移除后恢复的agent不在任何批次中
+func (rollout *Rollout) joined(agent string) bool {
+	for _, wave := range rollout.Waves {
+		for _, name := range wave {
+			if name == agent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rollout *Rollout) inCurrentWave(agent string) bool {
+	if rollout.CurrentWave >= len(rollout.Waves) {
+		return false
+	}
+	for _, name := range rollout.Waves[rollout.CurrentWave] {
+		if name == agent {
+			return true
+		}
+	}
+	return false
+}
+
+func (rollout *Rollout) halt(reason string) {
+	rollout.State = RolloutHalted
+	rollout.HaltReason = reason
+}
+
+// prune 从所有批次中移除已经不参与diff的agent(被删除或下线), 返回被移除的agent
+func (rollout *Rollout) prune(enabled map[string]Configurable) []string {
+	pruned := make([]string, 0)
+	for index, wave := range rollout.Waves {
+		kept := make([]string, 0, len(wave))
+		for _, name := range wave {
+			if _, ok := enabled[name]; ok {
+				kept = append(kept, name)
+			} else {
+				pruned = append(pruned, name)
+			}
+		}
+		rollout.Waves[index] = kept
+	}
+	rollout.Pruned = append(rollout.Pruned, pruned...)
+	return pruned
+}
+
+// pending 当前批次中还没有同步的agent
+func (rollout *Rollout) pending() []string {
+	pending := make([]string, 0)
+	for _, name := range rollout.Waves[rollout.CurrentWave] {
+		if !rollout.Synced[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+// advance 当前批次全部同步且暂停时间已到时进入下一批, 返回是否进入了下一批;
+// 当前批次超时仍未同步完时停止rollout
+func (rollout *Rollout) advance(now time.Time) bool {
+	if rollout.State != RolloutRunning {
+		return false
+	}
+	if rollout.CurrentWave >= len(rollout.Waves) {
+		rollout.State = RolloutCompleted
+		return true
+	}
+	if pending := rollout.pending(); len(pending) > 0 {
+		if rollout.timeout > 0 && now.Sub(rollout.WaveStart) > rollout.timeout {
+			rollout.halt(fmt.Sprintf("wave %v timed out after %v, not synced: %v", rollout.CurrentWave, rollout.timeout, pending))
+		}
+		return false
+	}
+	if rollout.WaveDone == nil {
+		rollout.WaveDone = &now
+	}
+	if rollout.CurrentWave+1 < len(rollout.Waves) && now.Sub(*rollout.WaveDone) < rollout.pause {
+		return false
+	}
+	rollout.CurrentWave++
+	rollout.WaveStart = now
+	rollout.WaveDone = nil
+	if rollout.CurrentWave >= len(rollout.Waves) {
+		rollout.State = RolloutCompleted
+	}
+	return true
+}
+
+func (rollout *Rollout) copy() Rollout {
+	copied := *rollout
+	copied.Synced = make(map[string]bool, len(rollout.Synced))
+	for name, value := range rollout.Synced {
+		copied.Synced[name] = value
+	}
+	copied.Failed = make(map[string]string, len(rollout.Failed))
+	for name, value := range rollout.Failed {
+		copied.Failed[name] = value
+	}
+	copied.Waves = make([][]string, len(rollout.Waves))
+	for index, wave := range rollout.Waves {
+		copied.Waves[index] = append([]string(nil), wave...)
+	}
+	copied.Pruned = append([]string(nil), rollout.Pruned...)
+	return copied
+}
+
+// rolloutTracker 记录每个配置id正在进行的rollout, 完成后删除, 没有rollout的配置直接同步到所有agent
+type rolloutTracker struct {
+	policy   RolloutPolicy
+	rollouts map[string]*Rollout
+	logger   *logging.Logger
+	mutex    sync.Mutex
+}
+
+func newRolloutTracker() *rolloutTracker {
+	return &rolloutTracker{
+		rollouts: make(map[string]*Rollout),
+		logger:   defaultLogger(managerModule),
+	}
+}
+
+func (tracker *rolloutTracker) halt(rollout *Rollout, reason string) {
+	rollout.halt(reason)
+	tracker.logger.Warning(fmt.Sprintf("rollout of %v halted: %v", rollout.Id, reason))
+}
+
+func (tracker *rolloutTracker) setPolicy(policy RolloutPolicy) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.policy = policy
+}
+
+func (tracker *rolloutTracker) getPolicy() RolloutPolicy {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.policy
+}
+
+func (tracker *rolloutTracker) start(id string, md5sum string, agents []string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if !tracker.policy.Enabled() {
+		delete(tracker.rollouts, id)
+		return
+	}
+	if rollout, ok := tracker.rollouts[id]; ok && rollout.Md5sum == md5sum {
+		return
+	}
+	now := time.Now()
+	tracker.rollouts[id] = &Rollout{
+		Id:        id,
+		Md5sum:    md5sum,
+		State:     RolloutRunning,
+		Waves:     tracker.policy.split(agents),
+		Synced:    make(map[string]bool),
+		Failed:    make(map[string]string),
+		StartTime: now,
+		WaveStart: now,
+		pause:     time.Duration(tracker.policy.PauseSeconds) * time.Second,
+		timeout:   tracker.policy.waveTimeout(),
+	}
+	tracker.logger.Info(fmt.Sprintf("rollout of %v started with %v wave(s)", id, len(tracker.rollouts[id].Waves)))
+}
+
+func (tracker *rolloutTracker) remove(id string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.rollouts, id)
+}
+
+// admit 判断配置id的md5sum版本能否推送到agent, 不在任何批次中的agent在第一批(canary)完成后推送
+func (tracker *rolloutTracker) admit(id string, md5sum string, agent string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rollout, ok := tracker.rollouts[id]
+	if !ok || rollout.Md5sum != md5sum || rollout.State == RolloutCompleted {
+		return true
+	}
+	if rollout.State == RolloutHalted {
+		return false
+	}
+	if !rollout.joined(agent) {
+		return rollout.CurrentWave > 0
+	}
+	return rollout.admitted(agent)
+}
+
+func (tracker *rolloutTracker) synced(id string, md5sum string, agent string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if rollout, ok := tracker.rollouts[id]; ok && rollout.Md5sum == md5sum {
+		rollout.Synced[agent] = true
+		delete(rollout.Failed, agent)
+	}
+}
+
+// pushed 记录DoConfig的结果, 当前批次推送失败时停止rollout
+func (tracker *rolloutTracker) pushed(id string, md5sum string, agent string, err error) {
+	if err == nil {
+		return
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rollout, ok := tracker.rollouts[id]
+	if !ok || rollout.Md5sum != md5sum || rollout.State != RolloutRunning {
+		return
+	}
+	rollout.Failed[agent] = err.Error()
+	if rollout.inCurrentWave(agent) {
+		tracker.halt(rollout, fmt.Sprintf("doconfig failed on %v: %v", agent, err.Error()))
+	}
+}
+
+// agentFailed 当前批次中的agent探活失败时停止rollout
+func (tracker *rolloutTracker) agentFailed(agent string, err error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	for _, rollout := range tracker.rollouts {
+		if rollout.State == RolloutRunning && rollout.inCurrentWave(agent) {
+			rollout.Failed[agent] = err.Error()
+			tracker.halt(rollout, fmt.Sprintf("ping failed on %v: %v", agent, err.Error()))
+		}
+	}
+}
+
+/**
+* @brief 推进所有rollout: 先从批次中移除不再参与diff的agent,
+*        再进入下一批或停止超时的批次, 完成的rollout被删除
+*
+* @param enabled 当前参与diff的agent
+*
+* @return 进入下一批的配置id
+ */
+func (tracker *rolloutTracker) advance(enabled map[string]Configurable) []string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := time.Now()
+	advanced := make([]string, 0)
+	for id, rollout := range tracker.rollouts {
+		if pruned := rollout.prune(enabled); len(pruned) > 0 {
+			tracker.logger.Info(fmt.Sprintf("rollout of %v pruned agent(s) no longer enabled: %v", id, pruned))
+		}
+		running := rollout.State == RolloutRunning
+		if rollout.advance(now) {
+			advanced = append(advanced, id)
+			if rollout.State == RolloutCompleted {
+				tracker.logger.Info(fmt.Sprintf("rollout of %v completed", id))
+				delete(tracker.rollouts, id)
+			} else {
+				tracker.logger.Info(fmt.Sprintf("rollout of %v enter wave %v", id, rollout.CurrentWave))
+			}
+		} else if running && rollout.State == RolloutHalted {
+			tracker.logger.Warning(fmt.Sprintf("rollout of %v halted: %v", id, rollout.HaltReason))
+		}
+	}
+	return advanced
+}
+
+func (tracker *rolloutTracker) resume(id string) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rollout, ok := tracker.rollouts[id]
+	if !ok {
+		return errors.New("no rollout for " + id)
+	}
+	if rollout.State != RolloutHalted {
+		return errors.New("rollout of " + id + " is " + rollout.State)
+	}
+	rollout.State = RolloutRunning
+	rollout.HaltReason = ""
+	rollout.Failed = make(map[string]string)
+	rollout.WaveStart = time.Now()
+	return nil
+}
+
+// promote 跳过剩余批次, 直接推送到所有agent
+func (tracker *rolloutTracker) promote(id string) error {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if _, ok := tracker.rollouts[id]; !ok {
+		return errors.New("no rollout for " + id)
+	}
+	delete(tracker.rollouts, id)
+	tracker.logger.Info(fmt.Sprintf("rollout of %v promoted", id))
+	return nil
+}
+
+func (tracker *rolloutTracker) list() []Rollout {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	ids := make([]string, 0, len(tracker.rollouts))
+	for id := range tracker.rollouts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rollouts := make([]Rollout, 0, len(ids))
+	for _, id := range ids {
+		rollouts = append(rollouts, tracker.rollouts[id].copy())
+	}
+	return rollouts
+}
@@ -0,0 +1,152 @@
+package motherbase
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enabledAgents 构造参与diff的agent集合
+func enabledAgents(names ...string) map[string]Configurable {
+	agents := make(map[string]Configurable, len(names))
+	for _, name := range names {
+		agents[name] = newFakeBidder()
+	}
+	return agents
+}
+
+func TestRolloutWaves(t *testing.T) {
+	tracker := newRolloutTracker()
+	enabled := enabledAgents("a", "b", "c", "d")
+	tracker.setPolicy(RolloutPolicy{CanaryCount: 1, Waves: []int{50}})
+	tracker.start("agent1", "md5", []string{"d", "c", "b", "a"})
+
+	rollouts := tracker.list()
+	if len(rollouts) != 1 || len(rollouts[0].Waves) != 3 {
+		t.Fatalf("expect 3 waves, got %v", rollouts)
+	}
+	if !tracker.admit("agent1", "md5", "a") || tracker.admit("agent1", "md5", "b") {
+		t.Fatal("only canary should be admitted")
+	}
+	tracker.synced("agent1", "md5", "a")
+	tracker.advance(enabled)
+	if !tracker.admit("agent1", "md5", "b") || tracker.admit("agent1", "md5", "c") {
+		t.Fatal("second wave should be admitted")
+	}
+	tracker.synced("agent1", "md5", "b")
+	tracker.advance(enabled)
+	tracker.synced("agent1", "md5", "c")
+	tracker.synced("agent1", "md5", "d")
+	if advanced := tracker.advance(enabled); len(advanced) != 1 {
+		t.Fatalf("expect rollout completed, got %v", advanced)
+	}
+	if rollouts := tracker.list(); len(rollouts) != 0 {
+		t.Fatalf("completed rollout should be removed, got %v", rollouts)
+	}
+	if !tracker.admit("agent1", "md5", "new") {
+		t.Fatal("new agent should be admitted after completion")
+	}
+}
+
+func TestRolloutHalt(t *testing.T) {
+	tracker := newRolloutTracker()
+	tracker.setPolicy(RolloutPolicy{CanaryCount: 1})
+	tracker.start("agent1", "md5", []string{"a", "b"})
+
+	tracker.pushed("agent1", "md5", "a", errors.New("bad config"))
+	if state := tracker.list()[0].State; state != RolloutHalted {
+		t.Fatalf("expect halted, got %v", state)
+	}
+	if tracker.admit("agent1", "md5", "a") {
+		t.Fatal("halted rollout should not admit")
+	}
+	if err := tracker.resume("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.admit("agent1", "md5", "a") {
+		t.Fatal("resumed rollout should admit canary")
+	}
+}
+
+func TestRolloutPruneRemovedAgent(t *testing.T) {
+	tracker := newRolloutTracker()
+	tracker.setPolicy(RolloutPolicy{Waves: []int{50}})
+	tracker.start("agent1", "md5", []string{"a", "b", "c", "d"})
+
+	// b 在第一批中被删除, 不应该让这一批永远无法完成
+	tracker.synced("agent1", "md5", "a")
+	if advanced := tracker.advance(enabledAgents("a", "b", "c", "d")); len(advanced) != 0 {
+		t.Fatalf("wave should wait for b, got %v", advanced)
+	}
+	if advanced := tracker.advance(enabledAgents("a", "c", "d")); len(advanced) != 1 {
+		t.Fatalf("wave should advance after b removed, got %v", advanced)
+	}
+	rollout := tracker.list()[0]
+	if rollout.CurrentWave != 1 || len(rollout.Waves[0]) != 1 || len(rollout.Pruned) != 1 || rollout.Pruned[0] != "b" {
+		t.Fatalf("unexpected rollout %+v", rollout)
+	}
+
+	// 后续批次中被删除的agent也会被移除
+	tracker.synced("agent1", "md5", "c")
+	tracker.advance(enabledAgents("a", "c"))
+	if rollouts := tracker.list(); len(rollouts) != 0 {
+		t.Fatalf("expect completed, got %+v", rollouts)
+	}
+}
+
+func TestRolloutWaveTimeout(t *testing.T) {
+	tracker := newRolloutTracker()
+	tracker.setPolicy(RolloutPolicy{CanaryCount: 1, WaveTimeoutSeconds: 60})
+	tracker.start("agent1", "md5", []string{"a", "b"})
+	enabled := enabledAgents("a", "b")
+
+	tracker.advance(enabled)
+	if state := tracker.list()[0].State; state != RolloutRunning {
+		t.Fatalf("expect running, got %v", state)
+	}
+	tracker.rollouts["agent1"].WaveStart = time.Now().Add(-2 * time.Minute)
+	tracker.advance(enabled)
+	rollout := tracker.list()[0]
+	if rollout.State != RolloutHalted || !strings.Contains(rollout.HaltReason, "timed out") {
+		t.Fatalf("expect halted by timeout, got %+v", rollout)
+	}
+	if err := tracker.resume("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	tracker.advance(enabled)
+	if state := tracker.list()[0].State; state != RolloutRunning {
+		t.Fatalf("resumed rollout should get a new deadline, got %v", state)
+	}
+}
+
+func TestRolloutLateAgent(t *testing.T) {
+	tracker := newRolloutTracker()
+	tracker.setPolicy(RolloutPolicy{CanaryCount: 1, Waves: []int{50}})
+	tracker.start("agent1", "md5", []string{"a", "b", "c", "d"})
+	enabled := enabledAgents("a", "b", "c", "d", "e")
+
+	// e 在rollout开始后才启用, canary完成前不推送
+	if tracker.admit("agent1", "md5", "e") {
+		t.Fatal("late agent should wait for canary")
+	}
+	tracker.synced("agent1", "md5", "a")
+	tracker.advance(enabled)
+	if !tracker.admit("agent1", "md5", "e") || tracker.admit("agent1", "md5", "c") {
+		t.Fatal("late agent should be admitted after canary")
+	}
+	if rollout := tracker.list()[0]; rollout.joined("e") || len(rollout.pending()) != 1 {
+		t.Fatalf("late agent should not block waves, got %+v", rollout)
+	}
+
+	tracker.pushed("agent1", "md5", "b", errors.New("bad config"))
+	if tracker.admit("agent1", "md5", "e") {
+		t.Fatal("halted rollout should not admit late agent")
+	}
+	if err := tracker.promote("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if rollouts := tracker.list(); len(rollouts) != 0 || !tracker.admit("agent1", "md5", "e") {
+		t.Fatalf("promoted rollout should be removed, got %v", rollouts)
+	}
+}
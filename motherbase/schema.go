@@ -0,0 +1,266 @@
+package motherbase
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+/**
+* @brief agent配置文档的JSON Schema, 支持的关键字:
+*        type, enum, properties, required, additionalProperties, items,
+*        minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+*        minLength, maxLength, pattern, minItems, maxItems;
+*        其余关键字(如$ref, oneOf)会在加载时报错, 避免被静默忽略
+ */
+type JSONSchema struct {
+	Schema      string `json:"$schema,omitempty"`
+	Id          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type                 interface{}            `json:"type,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+
+	types            []string
+	pattern          *regexp.Regexp
+	denyAdditional   bool
+	additionalSchema *JSONSchema
+}
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+func ParseJSONSchema(content []byte) (*JSONSchema, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	schema := &JSONSchema{}
+	if err := decoder.Decode(schema); err != nil {
+		return nil, errors.New("invalid json schema: " + err.Error())
+	}
+	if err := schema.compile("$"); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func LoadJSONSchema(fileName string) (*JSONSchema, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJSONSchema(content)
+}
+
+// compile 检查关键字并预处理type, pattern和additionalProperties
+func (schema *JSONSchema) compile(path string) error {
+	switch value := schema.Type.(type) {
+	case nil:
+	case string:
+		schema.types = []string{value}
+	case []interface{}:
+		for _, item := range value {
+			name, ok := item.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("invalid type at %v", path))
+			}
+			schema.types = append(schema.types, name)
+		}
+	default:
+		return errors.New(fmt.Sprintf("invalid type at %v", path))
+	}
+	for _, name := range schema.types {
+		if !schemaTypes[name] {
+			return errors.New(fmt.Sprintf("unknown type %v at %v", name, path))
+		}
+	}
+	if len(schema.Pattern) > 0 {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid pattern at %v: %v", path, err.Error()))
+		}
+		schema.pattern = pattern
+	}
+	if len(schema.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowed); err == nil {
+			schema.denyAdditional = !allowed
+		} else {
+			additional, err := ParseJSONSchema(schema.AdditionalProperties)
+			if err != nil {
+				return errors.New(fmt.Sprintf("invalid additionalProperties at %v: %v", path, err.Error()))
+			}
+			schema.additionalSchema = additional
+		}
+	}
+	for name, property := range schema.Properties {
+		if err := property.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		if err := schema.Items.compile(path + "[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return "null"
+}
+
+func (schema *JSONSchema) matchesType(value interface{}) bool {
+	if len(schema.types) == 0 {
+		return true
+	}
+	actual := jsonType(value)
+	for _, expected := range schema.types {
+		if expected == actual {
+			return true
+		}
+		if expected == "integer" && actual == "number" && value.(float64) == math.Trunc(value.(float64)) {
+			return true
+		}
+		if expected == "number" && actual == "number" {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+* @brief 校验已经解析的JSON文档
+*
+* @param value json.Unmarshal 得到的值
+* @param path 当前位置, 根为$
+*
+* @return 所有不符合的字段
+ */
+func (schema *JSONSchema) Validate(value interface{}, path string) []FieldError {
+	errs := make([]FieldError, 0)
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+	if !schema.matchesType(value) {
+		fail("expect %v, got %v", joinTypes(schema.types), jsonType(value))
+		return errs
+	}
+	if len(schema.Enum) > 0 {
+		matched := false
+		for _, candidate := range schema.Enum {
+			if reflect.DeepEqual(candidate, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("should be one of %v", schema.Enum)
+		}
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				errs = append(errs, FieldError{Path: path + "." + name, Message: "required"})
+			}
+		}
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := schema.Properties[name]; ok {
+				errs = append(errs, property.Validate(value[name], path+"."+name)...)
+			} else if schema.denyAdditional {
+				errs = append(errs, FieldError{Path: path + "." + name, Message: "unknown field"})
+			} else if schema.additionalSchema != nil {
+				errs = append(errs, schema.additionalSchema.Validate(value[name], path+"."+name)...)
+			}
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			fail("should have at least %v item(s)", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			fail("should have at most %v item(s)", *schema.MaxItems)
+		}
+		if schema.Items != nil {
+			for index, item := range value {
+				errs = append(errs, schema.Items.Validate(item, fmt.Sprintf("%v[%v]", path, index))...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			fail("should be at least %v character(s)", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			fail("should be at most %v character(s)", *schema.MaxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			fail("should match %v", schema.Pattern)
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			fail("should be >= %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			fail("should be <= %v", *schema.Maximum)
+		}
+		if schema.ExclusiveMinimum != nil && value <= *schema.ExclusiveMinimum {
+			fail("should be > %v", *schema.ExclusiveMinimum)
+		}
+		if schema.ExclusiveMaximum != nil && value >= *schema.ExclusiveMaximum {
+			fail("should be < %v", *schema.ExclusiveMaximum)
+		}
+	}
+	return errs
+}
+
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
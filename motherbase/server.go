@@ -0,0 +1,230 @@
+package motherbase
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/yangzhao28/phantom/commonlog"
+)
+
+// Server 按配置运行一个gateway及其http服务, 同一进程中可以运行多个
+type Server struct {
+	Gateway   *AgentGateway
+	configure *Configure
+	server    *http.Server
+	stopped   chan struct{}
+	stopOnce  sync.Once
+	stopErr   error
+	mutex     sync.Mutex
+}
+
+/**
+* @brief 创建Server, options 在配置之后应用, 可以覆盖配置中的存储和日志
+*
+* @param configure
+* @param options
+*
+* @return
+ */
+func NewServer(configure *Configure, options ...GatewayOption) (*Server, error) {
+	if err := configure.Validate(); err != nil {
+		return nil, err
+	}
+	level, err := commonlog.ParseLevel(configure.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := NewAuthenticator(configure.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(configure.auditFile()), 0755); err != nil {
+		return nil, err
+	}
+	auditLog, err := NewFileAuditLog(configure.auditFile())
+	if err != nil {
+		return nil, err
+	}
+	storage, err := configure.storage()
+	if err != nil {
+		auditLog.Close()
+		return nil, err
+	}
+	options = append([]GatewayOption{
+		WithStorage(storage),
+		WithLogDir(configure.LogDir, level),
+		WithAuthenticator(auth),
+		WithAuditLog(auditLog),
+	}, options...)
+	gateway := NewAgentGateway(options...)
+	if !auth.Enabled() {
+		gateway.logger.Warning("no credentials configured, API is open to everyone")
+	}
+	if err := gateway.Manager.SetBridgeTimeout(configure.httpTimeout()); err != nil {
+		return nil, err
+	}
+	if configure.BridgeTLS != nil {
+		bridgeTLS, err := NewClientTLSConfig(*configure.BridgeTLS)
+		if err != nil {
+			return nil, err
+		}
+		gateway.Manager.SetBridgeTLS(bridgeTLS)
+	}
+	if err := gateway.Manager.SetConcurrency(configure.PushWorkers, configure.AgentPushLimit, configure.DiffLimit); err != nil {
+		return nil, err
+	}
+	if err := gateway.Manager.SetDiscoveryInterval(configure.discoveryInterval()); err != nil {
+		return nil, err
+	}
+	for _, source := range configure.discoverySources() {
+		gateway.Manager.AddDiscoverySource(source)
+	}
+	httpServer := &http.Server{
+		Addr:    configure.Listen,
+		Handler: gateway.Handler(),
+	}
+	// 关闭时断开watch长连接, 否则http服务要等到超时
+	httpServer.RegisterOnShutdown(gateway.Manager.CloseWatches)
+	if configure.TLS != nil {
+		if httpServer.TLSConfig, err = NewServerTLSConfig(*configure.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return &Server{
+		Gateway:   gateway,
+		configure: configure,
+		server:    httpServer,
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+// Apply 应用可以重新加载的配置项: Detector和Differ的周期, agent列表, API credential, webhook, 配置校验规则,
+// revision保留策略, 健康阈值, 推送重试和心跳超时
+func (server *Server) Apply(configure *Configure) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	gateway := server.Gateway
+	if err := gateway.Manager.SetIntervals(configure.detectorInterval(), configure.differInterval()); err != nil {
+		gateway.logger.Warning(err.Error())
+	}
+	gateway.Cache.SetRetention(configure.MaxRevisions, configure.maxRevisionAge())
+	if err := gateway.Manager.SetHealthPolicy(configure.healthPolicy()); err != nil {
+		gateway.logger.Warning("something wrong when set health policy: " + err.Error())
+	}
+	if err := gateway.Manager.SetRetryPolicy(configure.retryPolicy()); err != nil {
+		gateway.logger.Warning("something wrong when set retry policy: " + err.Error())
+	}
+	if err := gateway.Manager.SetHeartbeatPolicy(configure.heartbeatInterval(), configure.HeartbeatMaxMissed); err != nil {
+		gateway.logger.Warning("something wrong when set heartbeat policy: " + err.Error())
+	}
+	if err := gateway.SyncAgents(configure.Agents); err != nil {
+		gateway.logger.Warning("something wrong when sync agents: " + err.Error())
+	}
+	if gateway.auth != nil {
+		if err := gateway.auth.SetCredentials(configure.Credentials); err != nil {
+			gateway.logger.Warning("something wrong when set credentials: " + err.Error())
+		}
+	}
+	if err := gateway.Manager.SetWebhooks(configure.Webhooks); err != nil {
+		gateway.logger.Warning("something wrong when set webhooks: " + err.Error())
+	}
+	if schema, err := configure.schema(); err != nil {
+		gateway.logger.Warning("something wrong when load schema: " + err.Error())
+	} else {
+		gateway.Validator.SetSchema(schema)
+		server.configure.SchemaFile = configure.SchemaFile
+	}
+	gateway.Validator.SetValidator(maxBidPriceValidator, configure.maxBidPrice())
+	server.configure.DetectorInterval = configure.DetectorInterval
+	server.configure.DifferInterval = configure.DifferInterval
+	server.configure.Agents = configure.Agents
+	server.configure.Credentials = configure.Credentials
+	server.configure.Webhooks = configure.Webhooks
+	server.configure.MaxBidPrice = configure.MaxBidPrice
+	server.configure.BidPriceField = configure.BidPriceField
+	server.configure.MaxRevisions = configure.MaxRevisions
+	server.configure.MaxRevisionAge = configure.MaxRevisionAge
+	server.configure.FailureThreshold = configure.FailureThreshold
+	server.configure.SuccessThreshold = configure.SuccessThreshold
+	server.configure.MaxProbeBackoff = configure.MaxProbeBackoff
+	server.configure.PushMaxAttempts = configure.PushMaxAttempts
+	server.configure.PushBaseBackoff = configure.PushBaseBackoff
+	server.configure.PushMaxBackoff = configure.PushMaxBackoff
+	server.configure.HeartbeatInterval = configure.HeartbeatInterval
+	server.configure.HeartbeatMaxMissed = configure.HeartbeatMaxMissed
+}
+
+// Reload 以启动时的参数重新加载配置文件并应用, 失败时保留当前配置
+func (server *Server) Reload() error {
+	server.mutex.Lock()
+	reloaded, err := server.configure.Reload()
+	server.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	server.Gateway.logger.Notice("reload configure")
+	reloaded.Print(server.Gateway.logger)
+	server.Apply(reloaded)
+	return nil
+}
+
+// Run 启动gateway和http服务, 阻塞到 Shutdown 完成
+func (server *Server) Run() error {
+	gateway := server.Gateway
+	server.configure.Print(gateway.logger)
+	go gateway.Go()
+
+	server.Apply(server.configure)
+
+	if err := gateway.Cache.Clean(); err != nil {
+		gateway.logger.Warning("something wrong when clean save files")
+	}
+	if err := gateway.Cache.Reload(); err != nil {
+		gateway.logger.Warning("something wrong when clean save files")
+	}
+
+	var err error
+	if server.server.TLSConfig != nil {
+		gateway.logger.Notice("listen: " + server.configure.Listen + " (https)")
+		err = server.server.ListenAndServeTLS("", "")
+	} else {
+		gateway.logger.Notice("listen: " + server.configure.Listen)
+		err = server.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		server.Shutdown()
+		return err
+	}
+	<-server.stopped
+	gateway.logger.Notice("motherbase stopped")
+	return server.stopErr
+}
+
+/**
+* @brief 停止http服务, 等待进行中的请求和推送完成后关闭cache, 可重复调用
+*
+* @return 第一个发生的错误
+ */
+func (server *Server) Shutdown() error {
+	server.stopOnce.Do(func() {
+		defer close(server.stopped)
+		timeout := server.configure.shutdownTimeout()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.server.Shutdown(ctx); err != nil {
+			server.Gateway.logger.Warning("http server shutdown: " + err.Error())
+			server.stopErr = err
+		}
+		if err := server.Gateway.Shutdown(timeout); err != nil {
+			server.Gateway.logger.Warning("gateway shutdown: " + err.Error())
+			if server.stopErr == nil {
+				server.stopErr = err
+			}
+		}
+	})
+	<-server.stopped
+	return server.stopErr
+}
@@ -0,0 +1,131 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Storage 为PersistCache提供持久化, 每个(id, revision)对应一条记录
+type Storage interface {
+	Get(id string, revision int64) (*CacheItem, error)
+	Save(item *CacheItem) error
+	Remove(id string, revision int64) error
+	// List 返回所有完整revision的元信息, 只读, 不隔离损坏的数据
+	List() ([]CacheItemInfo, error)
+	// Reload 加载所有完整可用的revision, 损坏的数据在这里隔离
+	Reload() ([]*CacheItem, error)
+}
+
+// storageCleaner 由需要额外清理(如无效文件)的Storage实现
+type storageCleaner interface {
+	Clean() error
+}
+
+type cacheRecord struct {
+	Id         string            `json:"id"`
+	Body       string            `json:"body"`
+	Md5sum     string            `json:"md5sum"`
+	UpdateTime int64             `json:"update_time"`
+	Meta       map[string]string `json:"meta,omitempty"`
+}
+
+func (item *CacheItem) marshal() ([]byte, error) {
+	return json.Marshal(&cacheRecord{
+		Id:         item.id,
+		Body:       item.body,
+		Md5sum:     item.md5sum,
+		UpdateTime: item.updateTime,
+		Meta:       item.meta,
+	})
+}
+
+func unmarshalCacheItem(data []byte) (*CacheItem, error) {
+	record := &cacheRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	// 检查MD5
+	if Md5Sum([]byte(record.Body)) != record.Md5sum {
+		return nil, errors.New("unmatched md5sum")
+	}
+	return &CacheItem{
+		id:         record.Id,
+		body:       record.Body,
+		md5sum:     record.Md5sum,
+		updateTime: record.UpdateTime,
+		meta:       record.Meta,
+	}, nil
+}
+
+func (item *CacheItem) copy() *CacheItem {
+	copied := *item
+	if item.meta != nil {
+		copied.meta = make(map[string]string, len(item.meta))
+		for key, value := range item.meta {
+			copied.meta[key] = value
+		}
+	}
+	return &copied
+}
+
+func revisionKey(id string, revision int64) string {
+	return fmt.Sprintf("%s_%020d", id, revision)
+}
+
+// MemoryStorage 不落盘, 用于测试
+type MemoryStorage struct {
+	items map[string]*CacheItem
+	mutex sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		items: make(map[string]*CacheItem),
+	}
+}
+
+func (storage *MemoryStorage) Get(id string, revision int64) (*CacheItem, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	item, ok := storage.items[revisionKey(id, revision)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%v revision %v not exist", id, revision))
+	}
+	return item.copy(), nil
+}
+
+func (storage *MemoryStorage) Save(item *CacheItem) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.items[revisionKey(item.id, item.updateTime)] = item.copy()
+	return nil
+}
+
+func (storage *MemoryStorage) Remove(id string, revision int64) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.items, revisionKey(id, revision))
+	return nil
+}
+
+func (storage *MemoryStorage) List() ([]CacheItemInfo, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	itemList := make([]CacheItemInfo, 0, len(storage.items))
+	for _, item := range storage.items {
+		itemList = append(itemList, item.info())
+	}
+	return itemList, nil
+}
+
+func (storage *MemoryStorage) Reload() ([]*CacheItem, error) {
+	storage.mutex.RLock()
+	defer storage.mutex.RUnlock()
+	items := make([]*CacheItem, 0, len(storage.items))
+	for _, item := range storage.items {
+		items = append(items, item.copy())
+	}
+	return items, nil
+}
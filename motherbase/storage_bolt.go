@@ -0,0 +1,142 @@
+package motherbase
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("configs")
+
+// BoltStorage 将所有revision保存在一个bolt数据库文件中,
+// 损坏的记录保留在数据库中, 通过 Quarantine 列出
+type BoltStorage struct {
+	db         *bolt.DB
+	quarantine []QuarantineEntry
+	logger     *logging.Logger
+	mutex      sync.Mutex
+}
+
+func NewBoltStorage(fileName string) (*BoltStorage, error) {
+	db, err := bolt.Open(fileName, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{
+		db:         db,
+		quarantine: make([]QuarantineEntry, 0),
+		logger:     defaultLogger(cacheModule),
+	}, nil
+}
+
+func (storage *BoltStorage) setLogger(logger *logging.Logger) {
+	storage.logger = logger
+}
+
+func (storage *BoltStorage) Close() error {
+	return storage.db.Close()
+}
+
+func (storage *BoltStorage) Get(id string, revision int64) (*CacheItem, error) {
+	var item *CacheItem
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltBucket).Get([]byte(revisionKey(id, revision)))
+		if data == nil {
+			return errors.New(fmt.Sprintf("%v revision %v not exist", id, revision))
+		}
+		var err error
+		item, err = unmarshalCacheItem(data)
+		return err
+	})
+	return item, err
+}
+
+func (storage *BoltStorage) Save(item *CacheItem) error {
+	data, err := item.marshal()
+	if err != nil {
+		return err
+	}
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(revisionKey(item.id, item.updateTime)), data)
+	})
+}
+
+func (storage *BoltStorage) Remove(id string, revision int64) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(revisionKey(id, revision)))
+	})
+}
+
+// List 只读, 跳过损坏的记录, 不更新 Quarantine
+func (storage *BoltStorage) List() ([]CacheItemInfo, error) {
+	items, _, err := storage.scan()
+	if err != nil {
+		return nil, err
+	}
+	itemList := make([]CacheItemInfo, 0, len(items))
+	for _, item := range items {
+		itemList = append(itemList, item.info())
+	}
+	return itemList, nil
+}
+
+// scan 读取所有记录, 返回完整的revision和损坏的记录
+func (storage *BoltStorage) scan() ([]*CacheItem, []QuarantineEntry, error) {
+	items := make([]*CacheItem, 0)
+	quarantine := make([]QuarantineEntry, 0)
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(key []byte, value []byte) error {
+			item, err := unmarshalCacheItem(value)
+			if err != nil {
+				quarantine = append(quarantine, QuarantineEntry{
+					File:   string(key),
+					Reason: err.Error(),
+					Size:   int64(len(value)),
+				})
+				return nil
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, quarantine, nil
+}
+
+// Reload 加载所有revision, 并记录损坏的记录
+func (storage *BoltStorage) Reload() ([]*CacheItem, error) {
+	items, quarantine, err := storage.scan()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range quarantine {
+		storage.logger.Warning(fmt.Sprintf("quarantine -> key:%s reason:%v", entry.File, entry.Reason))
+	}
+	storage.mutex.Lock()
+	storage.quarantine = quarantine
+	storage.mutex.Unlock()
+	storage.logger.Notice(fmt.Sprintf("reload from %s", storage.db.Path()))
+	return items, nil
+}
+
+func (storage *BoltStorage) Quarantine() ([]QuarantineEntry, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	entries := make([]QuarantineEntry, len(storage.quarantine))
+	copy(entries, storage.quarantine)
+	return entries, nil
+}
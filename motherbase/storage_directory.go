@@ -0,0 +1,387 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	metaSuffix          = ".meta"
+	tempPrefix          = ".tmp_"
+	quarantineDirectory = "quarantine"
+)
+
+var (
+	fileNameMatcher = regexp.MustCompile(`^([a-zA-Z0-9]+)_([0-9a-fA-F]+)_([0-9]+)$`)
+	idMatcher       = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+)
+
+func parseName(baseName string) (string, string, int64, error) {
+	result := fileNameMatcher.FindStringSubmatch(baseName)
+	if len(result) < 4 {
+		return "", "", 0, errors.New("invalid file name: " + baseName)
+	}
+	updateTime, err := strconv.ParseInt(result[3], 10, 64)
+	if err != nil {
+		return "", "", 0, err
+	}
+	return result[1], result[2], updateTime, nil
+}
+
+func fromFile(fileName string) (*CacheItem, error) {
+	baseName := filepath.Base(fileName)
+	id, md5sum, updateTime, err := parseName(baseName)
+	if err != nil {
+		return nil, err
+	}
+	configFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+	body, err := ioutil.ReadAll(configFile)
+	if err != nil {
+		return nil, err
+	}
+	// 检查MD5
+	if Md5Sum(body) != md5sum {
+		return nil, errors.New("unmatched md5sum")
+	}
+	item := &CacheItem{
+		id:         id,
+		body:       string(body),
+		md5sum:     md5sum,
+		updateTime: updateTime,
+	}
+	if meta, err := ioutil.ReadFile(fileName + metaSuffix); err == nil {
+		if err := json.Unmarshal(meta, &item.meta); err != nil {
+			return nil, errors.New("invalid meta: " + err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return item, nil
+}
+
+func syncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+/**
+* @brief 先写临时文件并fsync, 再rename为目标文件, 最后fsync目录,
+*        崩溃时只会留下临时文件, 不会出现截断的目标文件
+*
+* @param directory
+* @param fileName
+* @param data
+*
+* @return
+ */
+func writeFileAtomic(directory string, fileName string, data []byte) error {
+	tempFile, err := ioutil.TempFile(directory, tempPrefix+fileName+".")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if err := os.Chmod(tempName, 0644); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if err := os.Rename(tempName, filepath.Join(directory, fileName)); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+func (item *CacheItem) GetFileName() string {
+	return item.id + "_" + item.md5sum + "_" + strconv.FormatInt(item.updateTime, 10)
+}
+
+// toFile 先写 .meta 再写配置文件, 配置文件存在即表示该revision完整
+func (item *CacheItem) toFile(directory string) error {
+	fileName := item.GetFileName()
+	if len(item.meta) > 0 {
+		meta, err := json.Marshal(item.meta)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(directory, fileName+metaSuffix, meta); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(directory, fileName, []byte(item.body))
+}
+
+// QuarantineEntry 为Reload时发现的损坏或孤立文件
+type QuarantineEntry struct {
+	File    string    `json:"file"`
+	Reason  string    `json:"reason"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// storageQuarantine 由能报告损坏数据的Storage实现
+type storageQuarantine interface {
+	Quarantine() ([]QuarantineEntry, error)
+}
+
+// DirectoryStorage 每个revision一个文件, 文件名为 id_md5_timestamp,
+// 无法放入文件名的元信息保存在同名的 .meta 文件中,
+// 损坏或孤立的文件会被移动到 quarantine 子目录
+type DirectoryStorage struct {
+	directory string
+	reasons   map[string]string
+	logger    *logging.Logger
+	mutex     sync.Mutex
+}
+
+func NewDirectoryStorage(directory string) *DirectoryStorage {
+	return &DirectoryStorage{
+		directory: directory,
+		reasons:   make(map[string]string),
+		logger:    defaultLogger(cacheModule),
+	}
+}
+
+func (storage *DirectoryStorage) setLogger(logger *logging.Logger) {
+	storage.logger = logger
+}
+
+// lookupFile 返回revision对应的文件, 不存在时返回空字符串, 目录读取失败时返回错误
+func (storage *DirectoryStorage) lookupFile(id string, revision int64) (string, error) {
+	files, err := ioutil.ReadDir(storage.directory)
+	if err != nil {
+		return "", err
+	}
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+		fileId, _, updateTime, err := parseName(fileInfo.Name())
+		if err == nil && fileId == id && updateTime == revision {
+			return filepath.Join(storage.directory, fileInfo.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+func (storage *DirectoryStorage) findFile(id string, revision int64) (string, error) {
+	fullFileName, err := storage.lookupFile(id, revision)
+	if err != nil {
+		return "", err
+	}
+	if len(fullFileName) == 0 {
+		return "", errors.New(fmt.Sprintf("%v revision %v not exist", id, revision))
+	}
+	return fullFileName, nil
+}
+
+func (storage *DirectoryStorage) Get(id string, revision int64) (*CacheItem, error) {
+	fullFileName, err := storage.findFile(id, revision)
+	if err != nil {
+		return nil, err
+	}
+	return fromFile(fullFileName)
+}
+
+func (storage *DirectoryStorage) Save(item *CacheItem) error {
+	if !idMatcher.MatchString(item.id) {
+		return errors.New("invalid id for directory storage: " + item.id)
+	}
+	return item.toFile(storage.directory)
+}
+
+func (storage *DirectoryStorage) Remove(id string, revision int64) error {
+	fullFileName, err := storage.lookupFile(id, revision)
+	if err != nil {
+		return err
+	}
+	if len(fullFileName) == 0 {
+		return nil
+	}
+	if err := os.Remove(fullFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(fullFileName + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDirectory(storage.directory)
+}
+
+// List 只读, 跳过损坏和孤立的文件, 隔离只在 Reload 和 Clean 时进行
+func (storage *DirectoryStorage) List() ([]CacheItemInfo, error) {
+	fullPath, err := filepath.Abs(storage.directory)
+	if err != nil {
+		return nil, err
+	}
+	items, broken, err := storage.scan(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	for fileName, reason := range broken {
+		storage.logger.Debug(fmt.Sprintf("skip -> file:%v reason:%v", fileName, reason))
+	}
+	itemList := make([]CacheItemInfo, 0, len(items))
+	for _, item := range items {
+		itemList = append(itemList, item.info())
+	}
+	return itemList, nil
+}
+
+// quarantine 将文件移入 quarantine 子目录
+func (storage *DirectoryStorage) quarantine(fullPath string, fileName string, reason string) {
+	storage.logger.Warning(fmt.Sprintf("quarantine -> file:%v reason:%v", fileName, reason))
+	quarantinePath := filepath.Join(fullPath, quarantineDirectory)
+	if err := os.MkdirAll(quarantinePath, 0755); err != nil {
+		storage.logger.Warning(err.Error())
+		return
+	}
+	if err := os.Rename(filepath.Join(fullPath, fileName), filepath.Join(quarantinePath, fileName)); err != nil {
+		storage.logger.Warning(err.Error())
+		return
+	}
+	storage.mutex.Lock()
+	storage.reasons[fileName] = reason
+	storage.mutex.Unlock()
+}
+
+// check 检查临时文件和 .meta 文件, 返回不可用的原因, 可用时返回空字符串
+func (storage *DirectoryStorage) check(fullPath string, fileInfo os.FileInfo) string {
+	name := fileInfo.Name()
+	if strings.HasPrefix(name, tempPrefix) {
+		return "orphaned temporary file"
+	}
+	if strings.HasSuffix(name, metaSuffix) {
+		dataName := strings.TrimSuffix(name, metaSuffix)
+		if _, _, _, err := parseName(dataName); err != nil {
+			return err.Error()
+		}
+		if _, err := os.Stat(filepath.Join(fullPath, dataName)); os.IsNotExist(err) {
+			return "orphaned meta file"
+		}
+	}
+	return ""
+}
+
+// scan 只读地读取目录, 返回完整的revision, 以及不可用的文件和原因
+func (storage *DirectoryStorage) scan(fullPath string) ([]*CacheItem, map[string]string, error) {
+	files, err := ioutil.ReadDir(fullPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	items := make([]*CacheItem, 0)
+	broken := make(map[string]string)
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+		if reason := storage.check(fullPath, fileInfo); len(reason) > 0 {
+			broken[fileInfo.Name()] = reason
+			continue
+		}
+		if strings.HasSuffix(fileInfo.Name(), metaSuffix) {
+			continue
+		}
+		item, err := fromFile(filepath.Join(fullPath, fileInfo.Name()))
+		if err != nil {
+			broken[fileInfo.Name()] = err.Error()
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, broken, nil
+}
+
+// Reload 加载所有revision, 同时将不可用的文件移入 quarantine
+func (storage *DirectoryStorage) Reload() ([]*CacheItem, error) {
+	fullPath, err := filepath.Abs(storage.directory)
+	if err != nil {
+		storage.logger.Warning(err.Error())
+		return nil, err
+	}
+	storage.logger.Notice(fmt.Sprintf("reload from %s", fullPath))
+	items, broken, err := storage.scan(fullPath)
+	if err != nil {
+		storage.logger.Warning(err.Error())
+		return nil, err
+	}
+	for fileName, reason := range broken {
+		storage.quarantine(fullPath, fileName, reason)
+	}
+	for _, item := range items {
+		storage.logger.Debug(fmt.Sprintf("loaded -> file:%v", filepath.Join(fullPath, item.GetFileName())))
+	}
+	return items, nil
+}
+
+// Clean 将无法识别的文件、孤立文件和损坏的文件移入 quarantine
+func (storage *DirectoryStorage) Clean() error {
+	_, err := storage.Reload()
+	return err
+}
+
+// Quarantine 列出 quarantine 子目录中的文件, 原因未知的为之前运行时隔离的文件
+func (storage *DirectoryStorage) Quarantine() ([]QuarantineEntry, error) {
+	quarantinePath := filepath.Join(storage.directory, quarantineDirectory)
+	files, err := ioutil.ReadDir(quarantinePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make([]QuarantineEntry, 0), nil
+		}
+		return nil, err
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	entries := make([]QuarantineEntry, 0, len(files))
+	for _, fileInfo := range files {
+		if fileInfo.IsDir() {
+			continue
+		}
+		reason, ok := storage.reasons[fileInfo.Name()]
+		if !ok {
+			reason = "unknown"
+		}
+		entries = append(entries, QuarantineEntry{
+			File:    fileInfo.Name(),
+			Reason:  reason,
+			Size:    fileInfo.Size(),
+			ModTime: fileInfo.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].File < entries[j].File
+	})
+	return entries, nil
+}
@@ -0,0 +1,147 @@
+package motherbase
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkStorage(t *testing.T, storage Storage) {
+	cache := NewPersistCacheWithStorage(storage)
+	meta := map[string]string{"owner": "ops"}
+	if err := cache.ReplaceWithMeta("agent1", "v1", meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Replace("agent1", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := NewPersistCacheWithStorage(storage)
+	if err := reloaded.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := reloaded.Get("agent1"); body != "v2" {
+		t.Fatalf("expect v2, got %v", body)
+	}
+	revisions, _ := reloaded.ListRevisions("agent1")
+	if len(revisions) != 2 {
+		t.Fatalf("expect 2 revisions, got %v", len(revisions))
+	}
+	item, err := storage.Get("agent1", revisions[0].updateTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.body != "v1" || item.meta["owner"] != "ops" {
+		t.Fatalf("unexpected first revision: %v %v", item.body, item.meta)
+	}
+
+	if err := reloaded.Remove("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if itemList, _ := storage.List(); len(itemList) != 0 {
+		t.Fatalf("expect empty storage, got %v", len(itemList))
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	checkStorage(t, NewMemoryStorage())
+}
+
+func TestDirectoryStorage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	checkStorage(t, NewDirectoryStorage(directory))
+}
+
+func TestBoltStorage(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	storage, err := NewBoltStorage(filepath.Join(directory, "configs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	checkStorage(t, storage)
+}
+
+func TestDirectoryQuarantine(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	cache := NewPersistCache(directory)
+	if err := cache.Replace("agent1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	truncated := "agent2_" + Md5Sum([]byte("full body")) + "_1444735040"
+	ioutil.WriteFile(filepath.Join(directory, truncated), []byte("full"), 0644)
+	ioutil.WriteFile(filepath.Join(directory, tempPrefix+"agent3"), []byte("partial"), 0644)
+
+	// List 不修改目录
+	itemList, err := NewDirectoryStorage(directory).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itemList) != 1 {
+		t.Fatalf("expect 1 revision, got %v", itemList)
+	}
+	if _, err := os.Stat(filepath.Join(directory, truncated)); err != nil {
+		t.Fatalf("list should not quarantine: %v", err)
+	}
+	if entries, _ := cache.Quarantine(); len(entries) != 0 {
+		t.Fatalf("list should not quarantine, got %v", entries)
+	}
+
+	if err := cache.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := cache.Get("agent1"); body != "v1" {
+		t.Fatalf("expect v1, got %v", body)
+	}
+	entries, err := cache.Quarantine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expect 2 quarantined files, got %v", entries)
+	}
+	for _, entry := range entries {
+		if entry.Reason == "unknown" {
+			t.Fatalf("missing reason for %v", entry.File)
+		}
+	}
+}
+
+func TestDirectoryStorageRemove(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	storage := NewDirectoryStorage(filepath.Join(directory, "configs"))
+	if err := os.Mkdir(storage.directory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Remove("agent1", 1444735040); err != nil {
+		t.Fatalf("remove of missing revision should succeed: %v", err)
+	}
+
+	// 目录无法读取时不能当作删除成功
+	if err := os.Remove(storage.directory); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(storage.directory, []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Remove("agent1", 1444735040); err == nil {
+		t.Fatal("remove should fail when the directory can not be read")
+	}
+}
@@ -0,0 +1,145 @@
+package motherbase
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles 证书文件, 服务端 CAFile 用于校验客户端证书(mTLS),
+// 客户端 CAFile 用于校验bidder的证书, CertFile/KeyFile 为客户端证书
+type TLSFiles struct {
+	CertFile   string `json:"cert_file,omitempty" yaml:"cert_file"`
+	KeyFile    string `json:"key_file,omitempty" yaml:"key_file"`
+	CAFile     string `json:"ca_file,omitempty" yaml:"ca_file"`
+	ServerName string `json:"server_name,omitempty" yaml:"server_name"`
+}
+
+func (files *TLSFiles) Validate() error {
+	if (len(files.CertFile) == 0) != (len(files.KeyFile) == 0) {
+		return errors.New("cert_file and key_file should be set together")
+	}
+	return nil
+}
+
+// certReloader 证书文件修改后在下一次握手时重新加载, 加载失败时继续使用旧证书
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	mutex    sync.Mutex
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := reloader.certificate(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (reloader *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, fileName := range []string{reloader.certFile, reloader.keyFile} {
+		fileInfo, err := os.Stat(fileName)
+		if err != nil {
+			return latest, err
+		}
+		if fileInfo.ModTime().After(latest) {
+			latest = fileInfo.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (reloader *certReloader) certificate() (*tls.Certificate, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	modTime, err := reloader.latestModTime()
+	if err == nil && (reloader.cert == nil || !modTime.Equal(reloader.modTime)) {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile); err == nil {
+			reloader.cert = &cert
+			reloader.modTime = modTime
+		}
+	}
+	if reloader.cert == nil {
+		return nil, err
+	}
+	return reloader.cert, nil
+}
+
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.certificate()
+}
+
+func (reloader *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return reloader.certificate()
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no certificate found in " + caFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig API服务的TLS配置, 设置了 CAFile 时要求客户端证书
+func NewServerTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if len(files.CertFile) == 0 || len(files.KeyFile) == 0 {
+		return nil, errors.New("server tls requires cert_file and key_file")
+	}
+	reloader, err := newCertReloader(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if len(files.CAFile) > 0 {
+		if config.ClientCAs, err = loadCertPool(files.CAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig 连接bidder的TLS配置, 未设置 CAFile 时使用系统CA
+func NewClientTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if err := files.Validate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: files.ServerName,
+	}
+	var err error
+	if len(files.CAFile) > 0 {
+		if config.RootCAs, err = loadCertPool(files.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(files.CertFile) > 0 {
+		reloader, err := newCertReloader(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
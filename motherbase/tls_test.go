@@ -0,0 +1,123 @@
+package motherbase
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeCert 生成由parent签发的证书, parent为nil时生成自签名CA
+func writeCert(t *testing.T, directory string, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(directory, name+".crt"), certPem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, name+".key"), keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMutualTLSBridge(t *testing.T) {
+	directory, err := ioutil.TempDir("", "motherbase-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	ca, caKey := writeCert(t, directory, "ca", 1, nil, nil)
+	writeCert(t, directory, "bidder", 2, ca, caKey)
+	writeCert(t, directory, "motherbase", 3, ca, caKey)
+	path := func(name string) string { return filepath.Join(directory, name) }
+
+	serverTLS, err := NewServerTLSConfig(TLSFiles{CertFile: path("bidder.crt"), KeyFile: path("bidder.key"), CAFile: path("ca.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bidder := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("pong"))
+	})}
+	go bidder.Serve(listener)
+	defer bidder.Close()
+	host, portString, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	clientTLS, err := NewClientTLSConfig(TLSFiles{CertFile: path("motherbase.crt"), KeyFile: path("motherbase.key"), CAFile: path("ca.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBidderHttpsBridge(host, port, clientTLS, HttpTimeout).Ping(); err != nil {
+		t.Fatalf("ping with client cert failed: %v", err)
+	}
+	anonymousTLS, err := NewClientTLSConfig(TLSFiles{CAFile: path("ca.crt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBidderHttpsBridge(host, port, anonymousTLS, HttpTimeout).Ping(); err == nil {
+		t.Fatal("expect ping without client cert to fail")
+	}
+	if err := NewBidderHttpBridge(host, port).Ping(); err == nil {
+		t.Fatal("expect plain http ping to fail")
+	}
+
+	// 替换bidder证书后, 新的连接使用新证书
+	time.Sleep(10 * time.Millisecond)
+	renewed, _ := writeCert(t, directory, "bidder", 4, ca, caKey)
+	now := time.Now().Add(time.Second)
+	os.Chtimes(path("bidder.crt"), now, now)
+	connection, err := tls.Dial("tcp", listener.Addr().String(), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	if serial := connection.ConnectionState().PeerCertificates[0].SerialNumber; serial.Cmp(renewed.SerialNumber) != 0 {
+		t.Fatalf("expect renewed certificate %v, got %v", renewed.SerialNumber, serial)
+	}
+}
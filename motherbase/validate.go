@@ -0,0 +1,165 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FieldError 一个字段的校验错误, Path 形如 $.deals[0].price
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// ValidationError 配置没有通过校验, 不会被保存和推送
+type ValidationError struct {
+	Id        string       `json:"id"`
+	Errors    []FieldError `json:"errors"`
+	malformed bool
+}
+
+func (err *ValidationError) Error() string {
+	messages := make([]string, 0, len(err.Errors))
+	for _, fieldError := range err.Errors {
+		messages = append(messages, fieldError.Path+": "+fieldError.Message)
+	}
+	return fmt.Sprintf("config %v is invalid: %v", err.Id, strings.Join(messages, "; "))
+}
+
+// status 不是合法JSON时返回400, 不符合schema或校验规则时返回422
+func (err *ValidationError) status() int {
+	if err.malformed {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// maxBidPriceValidator 配置文件中 max_bid_price 对应的校验
+const maxBidPriceValidator = "max_bid_price"
+
+// ConfigValidator 自定义校验, document 为 json.Unmarshal 得到的配置
+type ConfigValidator func(id string, document interface{}) []FieldError
+
+/**
+* @brief 保存配置之前的校验: 合法的JSON, 符合schema(如果设置), 通过所有自定义校验;
+*        自定义校验按名字排序执行, 同名的校验会被替换
+ */
+type Validator struct {
+	schema     *JSONSchema
+	validators map[string]ConfigValidator
+	mutex      sync.RWMutex
+}
+
+func NewValidator() *Validator {
+	return &Validator{validators: make(map[string]ConfigValidator)}
+}
+
+// SetSchema 设置配置的schema, nil表示不校验schema
+func (validator *Validator) SetSchema(schema *JSONSchema) {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	validator.schema = schema
+}
+
+// SetValidator 添加或替换自定义校验, nil表示删除
+func (validator *Validator) SetValidator(name string, check ConfigValidator) {
+	validator.mutex.Lock()
+	defer validator.mutex.Unlock()
+	if check == nil {
+		delete(validator.validators, name)
+		return
+	}
+	validator.validators[name] = check
+}
+
+func decodeDocument(body string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New(fmt.Sprintf("unexpected data after offset %v", decoder.InputOffset()))
+	}
+	return document, nil
+}
+
+func (validator *Validator) Validate(id string, body string) error {
+	document, err := decodeDocument(body)
+	if err != nil {
+		message := err.Error()
+		if syntaxError, ok := err.(*json.SyntaxError); ok {
+			message = fmt.Sprintf("%v (offset %v)", message, syntaxError.Offset)
+		}
+		return &ValidationError{Id: id, Errors: []FieldError{{Path: "$", Message: "malformed json: " + message}}, malformed: true}
+	}
+	validator.mutex.RLock()
+	defer validator.mutex.RUnlock()
+	errs := make([]FieldError, 0)
+	if validator.schema != nil {
+		errs = append(errs, validator.schema.Validate(document, "$")...)
+	}
+	names := make([]string, 0, len(validator.validators))
+	for name := range validator.validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		errs = append(errs, validator.validators[name](id, document)...)
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Id: id, Errors: errs}
+	}
+	return nil
+}
+
+/**
+* @brief 出价上限校验, 配置中任意层级名为 field 的数字都不能超过 limit
+*
+* @param field 出价字段名, 如 price
+* @param limit
+*
+* @return
+ */
+func MaxBidPrice(field string, limit float64) ConfigValidator {
+	return func(id string, document interface{}) []FieldError {
+		errs := make([]FieldError, 0)
+		var walk func(value interface{}, path string)
+		walk = func(value interface{}, path string) {
+			switch value := value.(type) {
+			case map[string]interface{}:
+				names := make([]string, 0, len(value))
+				for name := range value {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					if price, ok := value[name].(float64); ok && name == field && price > limit {
+						errs = append(errs, FieldError{Path: path + "." + name, Message: fmt.Sprintf("bid price %v exceeds limit %v", price, limit)})
+					}
+					walk(value[name], path+"."+name)
+				}
+			case []interface{}:
+				for index, item := range value {
+					walk(item, fmt.Sprintf("%v[%v]", path, index))
+				}
+			}
+		}
+		walk(document, "$")
+		return errs
+	}
+}
+
+// writeValidationError 以JSON返回字段错误
+func writeValidationError(w http.ResponseWriter, err *ValidationError) {
+	body, _ := json.Marshal(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.status())
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,97 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"type": "object",
+	"required": ["price", "deals"],
+	"additionalProperties": false,
+	"properties": {
+		"price": {"type": "number", "minimum": 0},
+		"currency": {"enum": ["USD", "CNY"]},
+		"deals": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"required": ["id"],
+				"properties": {
+					"id": {"type": "string", "pattern": "^d-[0-9]+$"},
+					"price": {"type": "number"}
+				}
+			}
+		}
+	}
+}`
+
+func TestParseJSONSchema(t *testing.T) {
+	if _, err := ParseJSONSchema([]byte(`{"oneOf": [{"type": "string"}]}`)); err == nil {
+		t.Fatal("unsupported keyword should be rejected")
+	}
+	if _, err := ParseJSONSchema([]byte(`{"type": "float"}`)); err == nil {
+		t.Fatal("unknown type should be rejected")
+	}
+	schema, err := ParseJSONSchema([]byte(`{"type": "integer", "exclusiveMaximum": 10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value, valid := range map[float64]bool{1: true, 1.5: false, 10: false} {
+		if errs := schema.Validate(value, "$"); (len(errs) == 0) != valid {
+			t.Fatalf("%v: unexpected result %v", value, errs)
+		}
+	}
+}
+
+func TestDoConfigValidation(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := NewValidator()
+	validator.SetSchema(schema)
+	validator.SetValidator(maxBidPriceValidator, MaxBidPrice("price", 10))
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()), WithValidator(validator))
+
+	for _, expect := range []struct {
+		body   string
+		code   int
+		fields []string
+	}{
+		{`{"price": 1,`, http.StatusBadRequest, []string{"$"}},
+		{`{"price": 1} {}`, http.StatusBadRequest, []string{"$"}},
+		{`{"price": -1, "currency": "EUR", "bogus": 1}`, http.StatusUnprocessableEntity, []string{"$.deals", "$.bogus", "$.currency", "$.price"}},
+		{`{"price": 1, "deals": [{"id": "d-1", "price": 20}, {"id": "x"}]}`, http.StatusUnprocessableEntity, []string{"$.deals[1].id", "$.deals[0].price"}},
+	} {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(expect.body)))
+		if recorder.Code != expect.code {
+			t.Fatalf("%v: expect %v, got %v %v", expect.body, expect.code, recorder.Code, recorder.Body.String())
+		}
+		result := ValidationError{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		fields := make([]string, 0)
+		for _, fieldError := range result.Errors {
+			fields = append(fields, fieldError.Path)
+		}
+		if strings.Join(fields, ",") != strings.Join(expect.fields, ",") {
+			t.Fatalf("%v: expect errors on %v, got %v", expect.body, expect.fields, result.Errors)
+		}
+	}
+	if _, err := gateway.Cache.Get("agent1"); err == nil {
+		t.Fatal("invalid config should not be saved")
+	}
+
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("POST", "/doconfig?name=agent1", strings.NewReader(`{"price": 1, "deals": [{"id": "d-1"}]}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("valid config rejected: %v %v", recorder.Code, recorder.Body.String())
+	}
+}
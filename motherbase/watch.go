@@ -0,0 +1,353 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWatchHistory   = 1024
+	DefaultWatchKeepalive = 15 * time.Second
+	MaxWatchPoll          = 60 * time.Second
+	RevisionHeader        = "X-Motherbase-Revision"
+	watchBuffer           = 256
+)
+
+const (
+	WatchConfig = "config"
+	WatchAgent  = "agent"
+)
+
+// agent状态变化的事件类型, 配置变化使用 CacheCreated/CacheUpdated/CacheDeleted
+const (
+	AgentAdded    = "add"
+	AgentRemoved  = "remove"
+	AgentEnabled  = "enable"
+	AgentDisabled = "disable"
+)
+
+var (
+	errWatchExpired = errors.New("resume revision has been compacted, relist and watch again")
+	errWatchReset   = errors.New("resume revision is newer than current, motherbase may have restarted, relist and watch again")
+	errWatchResync  = errors.New("resync required: resume token is from another motherbase process, relist and watch again")
+	errWatchClosed  = errors.New("watch closed")
+)
+
+/**
+* @brief watch推送的事件, Revision 在 Epoch 内单调递增, 客户端重连时以 "<epoch>:<revision>"
+*        作为resume token, 重启后epoch改变, 旧的token需要重新list; ConfigRevision 为配置本身的revision
+ */
+type WatchEvent struct {
+	Revision       int64     `json:"revision"`
+	Epoch          string    `json:"epoch"`
+	Time           time.Time `json:"time"`
+	Kind           string    `json:"kind"`
+	Type           string    `json:"type"`
+	Id             string    `json:"id,omitempty"`
+	Md5sum         string    `json:"md5sum,omitempty"`
+	ConfigRevision int64     `json:"config_revision,omitempty"`
+	Agent          string    `json:"agent,omitempty"`
+}
+
+type watcher struct {
+	events chan WatchEvent
+}
+
+// watchHub 保留最近的事件供断线重连, 并分发给所有watcher; 跟不上的watcher会被断开
+type watchHub struct {
+	cache       *PersistCache
+	history     []WatchEvent
+	maxHistory  int
+	subscribers map[*watcher]bool
+	closed      bool
+	mutex       sync.Mutex
+}
+
+func newWatchHub(cache *PersistCache) *watchHub {
+	return &watchHub{
+		cache:       cache,
+		history:     make([]WatchEvent, 0),
+		maxHistory:  DefaultWatchHistory,
+		subscribers: make(map[*watcher]bool),
+	}
+}
+
+// publish 分配revision并分发事件, 可以在持有cache锁时调用
+func (hub *watchHub) publish(event WatchEvent) {
+	if hub == nil {
+		return
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	event.Revision = hub.cache.nextWatchRevision()
+	event.Epoch = hub.cache.WatchEpoch()
+	event.Time = time.Now()
+	hub.history = append(hub.history, event)
+	if len(hub.history) > hub.maxHistory {
+		hub.history = hub.history[len(hub.history)-hub.maxHistory:]
+	}
+	for subscriber := range hub.subscribers {
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(hub.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+}
+
+/**
+* @brief 订阅 since 之后的事件
+*
+* @param epoch resume token中的epoch
+* @param since 客户端收到的最后一个revision
+*
+* @return 已经发生的事件和之后事件的watcher, epoch 不同, since 已被清理或大于当前revision时返回错误
+ */
+func (hub *watchHub) subscribe(epoch string, since int64) ([]WatchEvent, *watcher, error) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.closed {
+		return nil, nil, errWatchClosed
+	}
+	if epoch != hub.cache.WatchEpoch() {
+		return nil, nil, errWatchResync
+	}
+	current := hub.cache.WatchRevision()
+	if since > current {
+		return nil, nil, errWatchReset
+	}
+	oldest := current + 1
+	if len(hub.history) > 0 {
+		oldest = hub.history[0].Revision
+	}
+	if since < oldest-1 {
+		return nil, nil, errWatchExpired
+	}
+	backlog := make([]WatchEvent, 0)
+	for _, event := range hub.history {
+		if event.Revision > since {
+			backlog = append(backlog, event)
+		}
+	}
+	subscriber := &watcher{events: make(chan WatchEvent, watchBuffer)}
+	hub.subscribers[subscriber] = true
+	return backlog, subscriber, nil
+}
+
+func (hub *watchHub) unsubscribe(subscriber *watcher) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if hub.subscribers[subscriber] {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// close 断开所有watcher, 之后不能再订阅
+func (hub *watchHub) close() {
+	if hub == nil {
+		return
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.closed = true
+	for subscriber := range hub.subscribers {
+		delete(hub.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+func (manager *AgentManager) publishAgent(eventType string, name string) {
+	manager.watch.publish(WatchEvent{Kind: WatchAgent, Type: eventType, Agent: name})
+}
+
+// WatchRevision 当前的watch revision
+func (manager *AgentManager) WatchRevision() int64 {
+	if manager.cache == nil {
+		return 0
+	}
+	return manager.cache.WatchRevision()
+}
+
+// WatchToken 当前的resume token, 用于先list再从这个位置开始watch
+func (manager *AgentManager) WatchToken() string {
+	if manager.cache == nil {
+		return FormatWatchToken("", 0)
+	}
+	return FormatWatchToken(manager.cache.WatchEpoch(), manager.cache.WatchRevision())
+}
+
+func FormatWatchToken(epoch string, revision int64) string {
+	return fmt.Sprintf("%v:%v", epoch, revision)
+}
+
+// ParseWatchToken 解析 "<epoch>:<revision>", 只有revision的旧格式返回空的epoch
+func ParseWatchToken(token string) (string, int64, error) {
+	epoch := ""
+	if index := strings.LastIndex(token, ":"); index >= 0 {
+		epoch, token = token[:index], token[index+1:]
+	}
+	revision, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return epoch, revision, nil
+}
+
+// CloseWatches 断开所有watch连接, 在http服务关闭前调用
+func (manager *AgentManager) CloseWatches() {
+	manager.watch.close()
+}
+
+func watchSince(req *http.Request, current string) (string, int64, error) {
+	value := req.URL.Query().Get("since")
+	if len(value) == 0 {
+		value = req.Header.Get("Last-Event-ID")
+	}
+	if len(value) == 0 {
+		value = current
+	}
+	return ParseWatchToken(value)
+}
+
+/**
+* @brief eg: /watch?since=<epoch>:42 以SSE推送配置和agent状态的变化, 断线后以最后收到的id(或
+*        Last-Event-ID)重连即可收到期间的事件; 不带since时从当前revision开始;
+*        /watch?since=<epoch>:42&poll=30 为long-poll, 最多等待30秒, 返回事件的JSON数组;
+*        since 已经过期或epoch不同(motherbase重启过)时返回410, 客户端需要重新list
+*
+* @param http.ResponseWriter
+* @param http.Request
+*
+* @return
+ */
+func (gateway *AgentGateway) watch(w http.ResponseWriter, req *http.Request) {
+	gateway.logger.Debug("receive watch request from", req.Host)
+	if gateway.Manager.watch == nil {
+		http.Error(w, "watch not available", http.StatusNotFound)
+		return
+	}
+	epoch, since, err := watchSince(req, gateway.Manager.WatchToken())
+	if err != nil {
+		http.Error(w, "invalid 'since'", http.StatusBadRequest)
+		gateway.logger.Warning("invalid 'since'")
+		return
+	}
+	var poll time.Duration
+	if value := req.URL.Query().Get("poll"); len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > MaxWatchPoll {
+			http.Error(w, fmt.Sprintf("'poll' should be between 1 and %v", int(MaxWatchPoll/time.Second)), http.StatusBadRequest)
+			gateway.logger.Warning("invalid 'poll'")
+			return
+		}
+		poll = time.Duration(seconds) * time.Second
+	}
+	backlog, subscriber, err := gateway.Manager.watch.subscribe(epoch, since)
+	if err != nil {
+		status := http.StatusGone
+		if err == errWatchClosed {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
+		gateway.logger.Warning(fmt.Sprintf("watch since %v: %v", FormatWatchToken(epoch, since), err.Error()))
+		return
+	}
+	defer gateway.Manager.watch.unsubscribe(subscriber)
+	gateway.logger.Info(fmt.Sprintf("watch request: since -- %v, poll -- %v, by -- %v", since, poll, PrincipalFrom(req).Name))
+	if poll > 0 {
+		gateway.longPoll(w, req, backlog, subscriber, poll)
+	} else {
+		gateway.streamEvents(w, req, backlog, subscriber)
+	}
+}
+
+func (gateway *AgentGateway) longPoll(w http.ResponseWriter, req *http.Request, events []WatchEvent, subscriber *watcher, poll time.Duration) {
+	if len(events) == 0 {
+		timer := time.NewTimer(poll)
+		defer timer.Stop()
+		select {
+		case event, ok := <-subscriber.events:
+			if ok {
+				events = append(events, event)
+			}
+		case <-timer.C:
+		case <-req.Context().Done():
+			return
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case event, ok := <-subscriber.events:
+			if ok {
+				events = append(events, event)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		gateway.logger.Warning(err.Error())
+		return
+	}
+	w.Header().Set(RevisionHeader, gateway.Manager.WatchToken())
+	w.Write(body)
+}
+
+func (gateway *AgentGateway) streamEvents(w http.ResponseWriter, req *http.Request, backlog []WatchEvent, subscriber *watcher) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range backlog {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+	keepalive := time.NewTicker(DefaultWatchKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.events:
+			if !ok {
+				// 跟不上或服务关闭, 客户端以最后的id重连
+				return
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event WatchEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", FormatWatchToken(event.Epoch, event.Revision), event.Kind, data)
+	return err
+}
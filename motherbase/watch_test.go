@@ -0,0 +1,102 @@
+package motherbase
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	gateway := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	server := httptest.NewServer(gateway.Handler())
+	defer server.Close()
+	defer gateway.Manager.CloseWatches()
+
+	for _, id := range []string{"agent1", "agent2"} {
+		if err := gateway.NewConfig(id, `{"price": 1}`, nil, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	epoch := gateway.Cache.WatchEpoch()
+	response, err := http.Get(server.URL + "/watch?since=" + epoch + ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %v", response.Header.Get("Content-Type"))
+	}
+	var instance Configurable = newFakeBidder()
+	gateway.Manager.NewAvailableAgent("bidder1", &instance, nil)
+
+	reader := bufio.NewReader(response.Body)
+	events := make([]WatchEvent, 0)
+	for len(events) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "id: ") && strings.TrimSpace(line) != "id: "+FormatWatchToken(epoch, int64(len(events)+1)) {
+			t.Fatalf("unexpected event id %v", line)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			event := WatchEvent{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		}
+	}
+	if events[0].Revision != 1 || events[0].Epoch != epoch || events[0].Kind != WatchConfig || events[0].Type != CacheCreated || events[0].Id != "agent1" {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+	if events[2].Revision != 3 || events[2].Kind != WatchAgent || events[2].Type != AgentAdded || events[2].Agent != "bidder1" {
+		t.Fatalf("unexpected event %+v", events[2])
+	}
+
+	// long-poll 从断开的位置继续
+	recorder := httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/watch?since="+epoch+":2&poll=1", nil))
+	missed := make([]WatchEvent, 0)
+	if err := json.Unmarshal(recorder.Body.Bytes(), &missed); err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 1 || missed[0].Revision != 3 {
+		t.Fatalf("expect event 3, got %v", missed)
+	}
+
+	recorder = httptest.NewRecorder()
+	gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/listconfig", nil))
+	if recorder.Header().Get(RevisionHeader) != epoch+":3" {
+		t.Fatalf("expect revision 3, got %v", recorder.Header().Get(RevisionHeader))
+	}
+
+	gateway.Manager.watch.maxHistory = 1
+	gateway.Manager.DisableAgent("bidder1")
+	gateway.Manager.EnableAgent("bidder1", &instance)
+	for _, since := range []string{epoch + ":1", epoch + ":100", "3"} {
+		recorder := httptest.NewRecorder()
+		gateway.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/watch?poll=1&since="+since, nil))
+		if recorder.Code != http.StatusGone {
+			t.Fatalf("expect 410 for since %v, got %v", since, recorder.Code)
+		}
+	}
+
+	// 重启后revision重新计数, 旧的token需要重新list
+	restarted := NewAgentGateway(WithStorage(NewMemoryStorage()))
+	defer restarted.Manager.CloseWatches()
+	for _, id := range []string{"agent1", "agent2", "agent3"} {
+		if err := restarted.NewConfig(id, `{"price": 1}`, nil, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	restarted.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/watch?poll=1&since="+epoch+":2", nil))
+	if recorder.Code != http.StatusGone || !strings.Contains(recorder.Body.String(), "resync required") {
+		t.Fatalf("expect 410 resync required, got %v %v", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,312 @@
+package motherbase
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	EventAgentDown     = "agent_down"
+	EventAgentUp       = "agent_up"
+	EventPushFailed    = "push_failed"
+	EventDriftDetected = "drift_detected"
+	EventConfigChanged = "config_changed"
+)
+
+var webhookEvents = map[string]bool{
+	EventAgentDown:     true,
+	EventAgentUp:       true,
+	EventPushFailed:    true,
+	EventDriftDetected: true,
+	EventConfigChanged: true,
+}
+
+const (
+	EventHeader     = "X-Motherbase-Event"
+	DeliveryHeader  = "X-Motherbase-Delivery"
+	SignatureHeader = "X-Motherbase-Signature"
+
+	DefaultWebhookAttempts = 5
+	DefaultWebhookTimeout  = 5
+	webhookQueueSize       = 1024
+)
+
+var DefaultWebhookRetry = RetryPolicy{
+	MaxAttempts: DefaultWebhookAttempts,
+	BaseBackoff: time.Second,
+	MaxBackoff:  time.Minute,
+}
+
+// Webhook 一个接收通知的地址, Events 为空时接收所有事件,
+// 设置 Secret 时以 X-Motherbase-Signature 签名
+type Webhook struct {
+	Name        string   `json:"name" yaml:"name"`
+	URL         string   `json:"url" yaml:"url"`
+	Secret      string   `json:"-" yaml:"secret"`
+	Events      []string `json:"events,omitempty" yaml:"events"`
+	MaxAttempts int      `json:"max_attempts,omitempty" yaml:"max_attempts"`
+	Timeout     int      `json:"timeout,omitempty" yaml:"timeout"`
+}
+
+// String 输出时隐藏secret
+func (webhook Webhook) String() string {
+	return fmt.Sprintf("{%v %v %v}", webhook.Name, webhook.URL, webhook.Events)
+}
+
+func (webhook *Webhook) Validate() error {
+	if len(webhook.Name) == 0 {
+		return errors.New("empty webhook name")
+	}
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || len(target.Host) == 0 {
+		return errors.New(fmt.Sprintf("invalid url %v of webhook %v", webhook.URL, webhook.Name))
+	}
+	for _, event := range webhook.Events {
+		if !webhookEvents[event] {
+			return errors.New(fmt.Sprintf("unknown event %v of webhook %v", event, webhook.Name))
+		}
+	}
+	if webhook.MaxAttempts < 0 || webhook.Timeout < 0 {
+		return errors.New("max_attempts and timeout of webhook " + webhook.Name + " should not be negative")
+	}
+	return nil
+}
+
+func (webhook *Webhook) accepts(event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, accepted := range webhook.Events {
+		if accepted == event {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+* @brief 通知内容, 按事件类型填写对应字段:
+*        agent_down/agent_up: Agent, From, To, Error
+*        push_failed: Agent, Id, Action, Md5sum, Attempts, Dead, Error
+*        drift_detected: Agent, Drifted
+*        config_changed: Id, Type, Md5sum, Revision
+ */
+type Notification struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Agent    string    `json:"agent,omitempty"`
+	Id       string    `json:"id,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Action   string    `json:"action,omitempty"`
+	Md5sum   string    `json:"md5sum,omitempty"`
+	Revision int64     `json:"revision,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+	Dead     bool      `json:"dead,omitempty"`
+	Drifted  []string  `json:"drifted,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// SignWebhook 签名内容为 "<timestamp>.<body>", 接收方用相同的secret校验
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifier 异步发送webhook, 队列满时丢弃通知, 失败的发送按 retry 退避重试
+type notifier struct {
+	webhooks []Webhook
+	queue    chan Notification
+	retry    RetryPolicy
+	mutex    sync.RWMutex
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		webhooks: make([]Webhook, 0),
+		queue:    make(chan Notification, webhookQueueSize),
+		retry:    DefaultWebhookRetry,
+	}
+}
+
+func (notifier *notifier) enabled() bool {
+	notifier.mutex.RLock()
+	defer notifier.mutex.RUnlock()
+	return len(notifier.webhooks) > 0
+}
+
+func (notifier *notifier) subscribers(event string) []Webhook {
+	notifier.mutex.RLock()
+	defer notifier.mutex.RUnlock()
+	webhooks := make([]Webhook, 0)
+	for _, webhook := range notifier.webhooks {
+		if webhook.accepts(event) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks
+}
+
+func validateWebhooks(webhooks []Webhook) error {
+	names := make(map[string]bool)
+	for index := range webhooks {
+		if err := webhooks[index].Validate(); err != nil {
+			return err
+		}
+		if names[webhooks[index].Name] {
+			return errors.New("duplicated webhook " + webhooks[index].Name)
+		}
+		names[webhooks[index].Name] = true
+	}
+	return nil
+}
+
+// SetWebhooks 替换所有webhook, 已经在重试中的通知仍发送到旧的地址
+func (manager *AgentManager) SetWebhooks(webhooks []Webhook) error {
+	if err := validateWebhooks(webhooks); err != nil {
+		return err
+	}
+	manager.notifier.mutex.Lock()
+	defer manager.notifier.mutex.Unlock()
+	manager.notifier.webhooks = append([]Webhook(nil), webhooks...)
+	return nil
+}
+
+// notify 不阻塞, 没有配置webhook时直接忽略
+func (manager *AgentManager) notify(notification Notification) {
+	if !manager.notifier.enabled() {
+		return
+	}
+	notification.Time = time.Now()
+	select {
+	case manager.notifier.queue <- notification:
+	default:
+		manager.logger.Warning(fmt.Sprintf("webhook queue full, %v of %v%v dropped", notification.Event, notification.Agent, notification.Id))
+	}
+}
+
+/**
+* @brief 发送webhook通知, 并把agent健康状态的变化转换为 agent_down/agent_up;
+*        只有通知过down的agent恢复时才发送up
+ */
+func (manager *AgentManager) Notifier() {
+	manager.logger.Debug("enter notifier")
+	defer manager.logger.Debug("leave notifier")
+	defer manager.syncer.Done()
+
+	healthEvents, cancel := manager.health.subscribe()
+	defer cancel()
+	down := make(map[string]bool)
+	for {
+		select {
+		case event := <-healthEvents:
+			notification := Notification{Agent: event.Agent, From: event.From, To: event.To, Error: event.Error}
+			switch {
+			case event.To == HealthDown && !down[event.Agent]:
+				down[event.Agent] = true
+				notification.Event = EventAgentDown
+			case event.To == HealthHealthy && down[event.Agent]:
+				delete(down, event.Agent)
+				notification.Event = EventAgentUp
+			default:
+				continue
+			}
+			manager.notify(notification)
+		case notification := <-manager.notifier.queue:
+			notification.Delivery = newDeliveryId()
+			body, err := json.Marshal(notification)
+			if err != nil {
+				manager.logger.Warning("marshal webhook notification: " + err.Error())
+				continue
+			}
+			for _, webhook := range manager.notifier.subscribers(notification.Event) {
+				manager.syncer.Add(1)
+				go manager.deliver(webhook, notification, body)
+			}
+		case <-manager.quit:
+			return
+		}
+	}
+}
+
+func newDeliveryId() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// deliver 发送一个通知到一个webhook, 2xx为成功, 其余按退避重试, 退出时放弃
+func (manager *AgentManager) deliver(webhook Webhook, notification Notification, body []byte) {
+	defer manager.syncer.Done()
+	policy := manager.notifier.retry
+	if webhook.MaxAttempts > 0 {
+		policy.MaxAttempts = webhook.MaxAttempts
+	}
+	timeout := time.Duration(DefaultWebhookTimeout) * time.Second
+	if webhook.Timeout > 0 {
+		timeout = time.Duration(webhook.Timeout) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	for attempts := 1; ; attempts++ {
+		err := postWebhook(client, webhook, notification, body)
+		if err == nil {
+			manager.logger.Debug(fmt.Sprintf("webhook %v delivered %v %v", webhook.Name, notification.Event, notification.Delivery))
+			return
+		}
+		if attempts >= policy.MaxAttempts {
+			manager.logger.Warning(fmt.Sprintf("webhook %v gave up %v %v after %v attempts: %v",
+				webhook.Name, notification.Event, notification.Delivery, attempts, err.Error()))
+			return
+		}
+		manager.logger.Debug(fmt.Sprintf("webhook %v attempt %v failed: %v", webhook.Name, attempts, err.Error()))
+		timer := time.NewTimer(policy.backoff(attempts))
+		select {
+		case <-timer.C:
+		case <-manager.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func postWebhook(client *http.Client, webhook Webhook, notification Notification, body []byte) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, notification.Event)
+	req.Header.Set(DeliveryHeader, notification.Delivery)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	if len(webhook.Secret) > 0 {
+		req.Header.Set(SignatureHeader, SignWebhook(webhook.Secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("unexpected status %v", resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package motherbase
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// brokenBidder 所有DoConfig都失败
+type brokenBidder struct {
+	*fakeBidder
+}
+
+func (bidder *brokenBidder) DoConfig(name string, body string) error {
+	return errors.New("connection refused")
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan Notification, 16)
+	var requests int
+	var mutex sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		first := requests == 1
+		mutex.Unlock()
+		if first {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		timestamp, _ := strconv.ParseInt(req.Header.Get(TimestampHeader), 10, 64)
+		if req.Header.Get(SignatureHeader) != SignWebhook("secret", timestamp, body) {
+			t.Errorf("invalid signature of %s", body)
+		}
+		notification := Notification{}
+		json.Unmarshal(body, &notification)
+		if req.Header.Get(EventHeader) != notification.Event {
+			t.Errorf("event header %v mismatch %v", req.Header.Get(EventHeader), notification.Event)
+		}
+		received <- notification
+	}))
+	defer receiver.Close()
+
+	cache := NewPersistCacheWithStorage(NewMemoryStorage())
+	manager := NewAgentManager(cache)
+	manager.notifier.retry = RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	err := manager.SetWebhooks([]Webhook{{
+		Name:   "alert",
+		URL:    receiver.URL,
+		Secret: "secret",
+		Events: []string{EventPushFailed, EventDriftDetected},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.pool = newWorkerPool(manager.pushWorkers, manager.agentPushLimit, manager.quit)
+	manager.pool.start(&manager.syncer)
+	manager.syncer.Add(1)
+	go manager.Notifier()
+	defer manager.Quit()
+
+	// config_changed 被过滤
+	if err := cache.Replace("agent1", "body of agent1"); err != nil {
+		t.Fatal(err)
+	}
+	manager.executePush(&brokenBidder{newFakeBidder()}, PushOperation{Agent: "broken", Id: "agent1", Action: PushDoConfig, Md5sum: Md5Sum([]byte("body of agent1"))})
+
+	bidder := newFakeBidder()
+	var instance Configurable = bidder
+	manager.NewAvailableAgent("bidder1", &instance, nil)
+	manager.EnableAgent("bidder1", &instance)
+	manager.runRound(nil, manager.enabledSnapshot())
+	manager.runRound(nil, manager.enabledSnapshot())
+	bidder.mutex.Lock()
+	bidder.configs["agent1"] = "tampered"
+	bidder.mutex.Unlock()
+	manager.runRound(nil, manager.enabledSnapshot())
+
+	events := make(map[string]Notification)
+	for len(events) < 2 {
+		select {
+		case notification := <-received:
+			events[notification.Event] = notification
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhooks not delivered, got %v", events)
+		}
+	}
+	if failed := events[EventPushFailed]; failed.Agent != "broken" || failed.Attempts != 1 || failed.Error != "connection refused" {
+		t.Fatalf("unexpected push_failed %+v", failed)
+	}
+	if drift := events[EventDriftDetected]; drift.Agent != "bidder1" || len(drift.Drifted) != 1 || drift.Drifted[0] != "agent1" {
+		t.Fatalf("unexpected drift_detected %+v", drift)
+	}
+	select {
+	case notification := <-received:
+		t.Fatalf("unexpected notification %+v", notification)
+	case <-time.After(50 * time.Millisecond):
+	}
+}